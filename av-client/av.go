@@ -4,7 +4,6 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
-	"strings"
 	"time"
 )
 
@@ -44,15 +43,36 @@ func NewAvClient(apiKey string) *AvClient {
 	}
 }
 
-// URL validates url values to have required params, such as
-// QueryFunction, QueryInterval and QuerySymbol.
+// URL validates url values to have params required by
+// QueryFunction (see LookupFunction), e.g. QuerySymbol and QueryInterval
+// for TIME_SERIES_INTRADAY.
 // Returns URL to go to alphavantage service.
 func (av *AvClient) URL(values url.Values) (string, error) {
+	return av.url(values, av.ApiKey)
+}
+
+// URLWithKey returns URL to go to alphavantage service with apiKey
+// instead of ApiKey of the client. Values must be already validated
+// by URL, otherwise empty string is returned.
+func (av *AvClient) URLWithKey(values url.Values, apiKey string) string {
+	u, _ := av.url(values, apiKey)
+	return u
+}
+
+func (av *AvClient) url(values url.Values, apiKey string) (string, error) {
 	function := values.Get(QueryFunction)
-	symbol := values.Get(QuerySymbol)
-	if function == "" || symbol == "" {
+	if function == "" {
 		return "", errors.New("Params required")
 	}
+	f, ok := LookupFunction(function)
+	if !ok {
+		return "", errors.New("Unknown function " + function)
+	}
+	for _, param := range f.Required {
+		if values.Get(param) == "" {
+			return "", errors.New("Params required")
+		}
+	}
 
 	u := &url.URL{
 		Scheme: schemeHttps,
@@ -62,27 +82,14 @@ func (av *AvClient) URL(values url.Values) (string, error) {
 
 	// base parameters
 	query := u.Query()
-	query.Set(QueryApiKey, av.ApiKey)
-	query.Set(QueryFunction, function)
-	query.Set(QuerySymbol, symbol)
+	query.Set(QueryApiKey, apiKey)
+	query.Set(QueryFunction, f.Name)
 
-	interval := values.Get(QueryInterval)
-	if strings.ToUpper(function) == "TIME_SERIES_INTRADAY" {
-		if interval == "" {
-			return "", errors.New("Params required")
+	// function parameters
+	for _, param := range f.Params() {
+		if v := values.Get(param); v != "" {
+			query.Set(param, v)
 		}
-		query.Set(QueryInterval, interval)
-	}
-
-	// extra parameters
-	outputsize := values.Get(QueryOutputSize)
-	if outputsize != "" {
-		query.Set(QueryOutputSize, outputsize)
-	}
-	datatype := values.Get(QueryDataType)
-	if datatype != "" {
-		query.Set(QueryDataType, datatype)
-
 	}
 	u.RawQuery = query.Encode()
 
@@ -2,6 +2,7 @@ package av
 
 import (
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -63,6 +64,59 @@ func TestURL(t *testing.T) {
 			},
 			result: "",
 		},
+		TestCase{
+			params: url.Values{
+				QueryFunction: {"GLOBAL_QUOTE"},
+				QuerySymbol:   {"amzn"},
+			},
+			result: "https://www.alphavantage.co/query?apikey=7Z29L509PNF9IE24&function=GLOBAL_QUOTE&symbol=amzn",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction: {"SYMBOL_SEARCH"},
+				QueryKeywords: {"amaz"},
+			},
+			result: "https://www.alphavantage.co/query?apikey=7Z29L509PNF9IE24&function=SYMBOL_SEARCH&keywords=amaz",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction: {"SYMBOL_SEARCH"},
+				QuerySymbol:   {"amzn"},
+			},
+			result: "",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction:     {"CURRENCY_EXCHANGE_RATE"},
+				QueryFromCurrency: {"BTC"},
+				QueryToCurrency:   {"USD"},
+				QueryOutputSize:   {"full"},
+			},
+			result: "https://www.alphavantage.co/query?apikey=7Z29L509PNF9IE24&from_currency=BTC&function=CURRENCY_EXCHANGE_RATE&to_currency=USD",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction:   {"FX_DAILY"},
+				QueryFromSymbol: {"EUR"},
+				QueryToSymbol:   {"USD"},
+			},
+			result: "https://www.alphavantage.co/query?apikey=7Z29L509PNF9IE24&from_symbol=EUR&function=FX_DAILY&to_symbol=USD",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction: {"DIGITAL_CURRENCY_DAILY"},
+				QuerySymbol:   {"BTC"},
+				QueryMarket:   {"CNY"},
+			},
+			result: "https://www.alphavantage.co/query?apikey=7Z29L509PNF9IE24&function=DIGITAL_CURRENCY_DAILY&market=CNY&symbol=BTC",
+		},
+		TestCase{
+			params: url.Values{
+				QueryFunction: {"TIME_SERIES_HOURLY"},
+				QuerySymbol:   {"amzn"},
+			},
+			result: "",
+		},
 	}
 
 	for caseNum, cs := range cases {
@@ -81,3 +135,87 @@ func TestURL(t *testing.T) {
 	}
 
 }
+
+func TestFunctionKey(t *testing.T) {
+	cases := []struct {
+		params url.Values
+		key    string
+	}{
+		{
+			params: url.Values{
+				QueryFunction: {"TIME_SERIES_INTRADAY"},
+				QueryInterval: {"5min"},
+				QuerySymbol:   {"amzn"},
+			},
+			key: "AMZN",
+		},
+		{
+			params: url.Values{
+				QueryFunction:   {"fx_daily"},
+				QueryFromSymbol: {"eur"},
+				QueryToSymbol:   {"usd"},
+			},
+			key: "FX:EUR/USD",
+		},
+		{
+			params: url.Values{
+				QueryFunction:     {"CURRENCY_EXCHANGE_RATE"},
+				QueryFromCurrency: {"BTC"},
+				QueryToCurrency:   {"USD"},
+			},
+			key: "FX_RATE:BTC/USD",
+		},
+		{
+			params: url.Values{
+				QueryFunction: {"GLOBAL_QUOTE"},
+				QuerySymbol:   {"amzn"},
+			},
+			key: "QUOTE:AMZN",
+		},
+		{
+			params: url.Values{
+				QueryFunction: {"SYMBOL_SEARCH"},
+				QueryKeywords: {"amzn"},
+			},
+			key: "SEARCH:AMZN",
+		},
+	}
+
+	for caseNum, cs := range cases {
+		f, ok := LookupFunction(cs.params.Get(QueryFunction))
+		if !ok {
+			t.Fatalf("[%d] function %s not found", caseNum, cs.params.Get(QueryFunction))
+		}
+		if key := f.Key(cs.params); key != cs.key {
+			t.Errorf("[%d] Got %s, expected %s", caseNum, key, cs.key)
+		}
+	}
+}
+
+// TestFunctionKeysDistinct checks that functions store responses of
+// the same param values under distinct keys, except time series of a
+// symbol, which share history of the symbol.
+func TestFunctionKeysDistinct(t *testing.T) {
+	params := url.Values{}
+	for _, name := range FunctionNames() {
+		f, _ := LookupFunction(name)
+		for _, param := range f.Params() {
+			params.Set(param, "EUR")
+		}
+	}
+	params.Set(QueryInterval, "5min")
+
+	owners := map[string]string{}
+	for _, name := range FunctionNames() {
+		f, _ := LookupFunction(name)
+		key := f.Key(params)
+		family := name
+		if strings.HasPrefix(name, "TIME_SERIES_") {
+			family = "TIME_SERIES"
+		}
+		if owner, ok := owners[key]; ok && owner != family {
+			t.Errorf("%s and %s share key %s", owner, family, key)
+		}
+		owners[key] = family
+	}
+}
@@ -0,0 +1,207 @@
+package av
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+)
+
+const (
+	QueryKeywords     = "keywords"
+	QueryFromCurrency = "from_currency"
+	QueryToCurrency   = "to_currency"
+	QueryFromSymbol   = "from_symbol"
+	QueryToSymbol     = "to_symbol"
+	QueryMarket       = "market"
+)
+
+// Shape describes the layout of an Alpha Vantage response.
+type Shape uint8
+
+const (
+	// ShapeTimeSeries is a "Meta Data" object and a series of OHLCV bars.
+	ShapeTimeSeries Shape = iota
+	// ShapeQuote is a single latest quote for a symbol.
+	ShapeQuote
+	// ShapeSearch is a list of best matching symbols.
+	ShapeSearch
+	// ShapeExchangeRate is a single realtime exchange rate.
+	ShapeExchangeRate
+	// ShapeDigitalCurrency is a series of bars quoted in two markets.
+	ShapeDigitalCurrency
+)
+
+func (s Shape) String() string {
+	switch s {
+	case ShapeTimeSeries:
+		return "TimeSeries"
+	case ShapeQuote:
+		return "Quote"
+	case ShapeSearch:
+		return "Search"
+	case ShapeExchangeRate:
+		return "ExchangeRate"
+	case ShapeDigitalCurrency:
+		return "DigitalCurrency"
+	}
+	return "Unknown"
+}
+
+// Function describes an Alpha Vantage API function: its query params,
+// the shape of its response and the params identifying stored history.
+type Function struct {
+	Name     string
+	Required []string
+	Optional []string
+	Shape    Shape
+
+	// dataKey is the top level JSON key with payload, "%s" is
+	// replaced by interval.
+	dataKey string
+	// keyParams are params joined into storage key.
+	keyParams []string
+	// keyPrefix is family of function in storage key, so that
+	// functions other than time series of a symbol do not share
+	// records with them or with each other.
+	keyPrefix string
+}
+
+// DataKey returns top level key of JSON response holding the payload.
+func (f *Function) DataKey(values url.Values) string {
+	return strings.Replace(f.dataKey, "%s", values.Get(QueryInterval), 1)
+}
+
+// Key returns key by which responses of the function are stored,
+// e.g. "AMZN" for time series, "QUOTE:AMZN" for quote and "FX:EUR/USD"
+// for FX.
+func (f *Function) Key(values url.Values) string {
+	parts := make([]string, 0, len(f.keyParams))
+	for _, param := range f.keyParams {
+		parts = append(parts, strings.ToUpper(values.Get(param)))
+	}
+	key := strings.Join(parts, "/")
+	if f.keyPrefix != "" {
+		key = f.keyPrefix + ":" + key
+	}
+	return key
+}
+
+// Params returns all params accepted by the function.
+func (f *Function) Params() []string {
+	return append(append([]string{}, f.Required...), f.Optional...)
+}
+
+// functions is a registry of supported Alpha Vantage functions.
+var functions = map[string]*Function{
+	"TIME_SERIES_INTRADAY": &Function{
+		Required:  []string{QuerySymbol, QueryInterval},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Time Series (%s)",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_DAILY": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Time Series (Daily)",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_DAILY_ADJUSTED": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Time Series (Daily)",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_WEEKLY": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Weekly Time Series",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_WEEKLY_ADJUSTED": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Weekly Adjusted Time Series",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_MONTHLY": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Monthly Time Series",
+		keyParams: []string{QuerySymbol},
+	},
+	"TIME_SERIES_MONTHLY_ADJUSTED": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Monthly Adjusted Time Series",
+		keyParams: []string{QuerySymbol},
+	},
+	"GLOBAL_QUOTE": &Function{
+		Required:  []string{QuerySymbol},
+		Optional:  []string{QueryDataType},
+		Shape:     ShapeQuote,
+		dataKey:   "Global Quote",
+		keyParams: []string{QuerySymbol},
+		keyPrefix: "QUOTE",
+	},
+	"SYMBOL_SEARCH": &Function{
+		Required:  []string{QueryKeywords},
+		Optional:  []string{QueryDataType},
+		Shape:     ShapeSearch,
+		dataKey:   "bestMatches",
+		keyParams: []string{QueryKeywords},
+		keyPrefix: "SEARCH",
+	},
+	"CURRENCY_EXCHANGE_RATE": &Function{
+		Required:  []string{QueryFromCurrency, QueryToCurrency},
+		Shape:     ShapeExchangeRate,
+		dataKey:   "Realtime Currency Exchange Rate",
+		keyParams: []string{QueryFromCurrency, QueryToCurrency},
+		keyPrefix: "FX_RATE",
+	},
+	"FX_DAILY": &Function{
+		Required:  []string{QueryFromSymbol, QueryToSymbol},
+		Optional:  []string{QueryOutputSize, QueryDataType},
+		Shape:     ShapeTimeSeries,
+		dataKey:   "Time Series FX (Daily)",
+		keyParams: []string{QueryFromSymbol, QueryToSymbol},
+		keyPrefix: "FX",
+	},
+	"DIGITAL_CURRENCY_DAILY": &Function{
+		Required:  []string{QuerySymbol, QueryMarket},
+		Optional:  []string{QueryDataType},
+		Shape:     ShapeDigitalCurrency,
+		dataKey:   "Time Series (Digital Currency Daily)",
+		keyParams: []string{QuerySymbol, QueryMarket},
+		keyPrefix: "CRYPTO",
+	},
+}
+
+func init() {
+	for name, f := range functions {
+		f.Name = name
+	}
+}
+
+// LookupFunction returns registered function by its name,
+// case insensitive.
+func LookupFunction(name string) (*Function, bool) {
+	f, ok := functions[strings.ToUpper(name)]
+	return f, ok
+}
+
+// FunctionNames returns sorted names of all registered functions.
+func FunctionNames() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
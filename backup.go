@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/adnilote/stock-proxy/backup"
+	"github.com/adnilote/stock-proxy/config"
+	"github.com/adnilote/stock-proxy/proxy"
+)
+
+// backupCollections are history and jobs of proxy. Leases and calls
+// of API keys are not kept, they expire in minutes.
+var backupCollections = []backup.Collection{
+	{Name: "timeseries", Since: "updated"},
+	{Name: "corporate_actions"},
+	{Name: "pending_tasks", Since: "created"},
+}
+
+// loadConfig loads config of a command with its flags, it exits on
+// errors and -h.
+func loadConfig(args []string, flags func(fs *flag.FlagSet)) *config.Config {
+	cfg, err := config.NewLoader(args).WithFlags(flags).Load()
+	if err == flag.ErrHelp {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatalf("config loading failed, error: %v.", err)
+	}
+	return cfg
+}
+
+// commandContext returns context cancelled by SIGINT or SIGTERM.
+func commandContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+}
+
+// runBackup writes archive of history to file, "-" is stdout.
+//
+//	stock-proxy backup -out history.tar.gz [-since 2019-08-01T00:00:00Z]
+func runBackup(args []string) {
+	var out, since string
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&out, "out", "", "Archive file, - for stdout.")
+		fs.StringVar(&since, "since", "", "Export records changed since RFC3339 time, e.g. created of the previous backup.")
+	})
+	if out == "" {
+		log.Fatal("backup: -out required")
+	}
+	var from time.Time
+	if since != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, since); err != nil {
+			log.Fatalf("backup: invalid -since: %v", err)
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := connect(cfg)
+	if err != nil {
+		log.Fatalf("backup: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	var w io.Writer = os.Stdout
+	if out != "-" {
+		f, err := os.Create(out)
+		if err != nil {
+			log.Fatalf("backup: %v", err)
+		}
+		defer f.Close()
+		w = f
+	}
+	m, err := backup.Backup(ctx, client.Database("av"), backupCollections, from, w)
+	if err != nil {
+		if out != "-" {
+			os.Remove(out)
+		}
+		log.Fatalf("backup: %v", err)
+	}
+	for _, file := range m.Collections {
+		log.Printf("backup: %s %d documents", file.Collection, file.Documents)
+	}
+	log.Printf("backup: created %s, next incremental backup -since %s", out, m.Created.Format(time.RFC3339))
+}
+
+// runRestore restores archive of history from file, "-" is stdin.
+// Full backup is restored into empty store only.
+//
+//	stock-proxy restore -in history.tar.gz
+func runRestore(args []string) {
+	var in string
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&in, "in", "", "Archive file, - for stdin.")
+	})
+	if in == "" {
+		log.Fatal("restore: -in required")
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	client, err := connect(cfg)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	defer client.Disconnect(context.Background())
+	db := client.Database("av")
+
+	var r io.Reader = os.Stdin
+	if in != "-" {
+		f, err := os.Open(in)
+		if err != nil {
+			log.Fatalf("restore: %v", err)
+		}
+		defer f.Close()
+		r = f
+	}
+
+	// unique indexes first, so that restored records are checked
+	ictx, icancel := context.WithTimeout(ctx, indexTimeout)
+	err = proxy.EnsureIndexes(ictx, db)
+	icancel()
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	m, err := backup.Restore(ctx, db, r)
+	if err != nil {
+		log.Fatalf("restore: %v", err)
+	}
+	for _, file := range m.Collections {
+		log.Printf("restore: %s %d documents", file.Collection, file.Documents)
+	}
+}
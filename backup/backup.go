@@ -0,0 +1,339 @@
+// Package backup exports collections of mongoDB to a portable archive
+// and restores them.
+//
+// Archive is tar.gz of manifest.json and a file of each collection,
+// which holds a document per line in canonical extended JSON, so that
+// binary subtypes and ObjectIDs are kept. Manifest lists amount of
+// documents and sha256 of each file, which are verified before
+// restore.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Version of archive format.
+const Version = 1
+
+// manifestName is the first file of archive.
+const manifestName = "manifest.json"
+
+// batchSize is amount of documents restored by one bulk write.
+const batchSize = 500
+
+// ErrNotEmpty is returned by Restore of full backup into a store with
+// documents.
+var ErrNotEmpty = errors.New("store is not empty")
+
+// Collection is a collection to back up.
+type Collection struct {
+	Name string
+	// Since is field of modification time of documents, by which
+	// incremental backup selects documents. Collection without it is
+	// exported fully.
+	Since string
+}
+
+// filter selects documents modified since, all if since is zero.
+func (c Collection) filter(since time.Time) bson.M {
+	if since.IsZero() || c.Since == "" {
+		return bson.M{}
+	}
+	return bson.M{c.Since: bson.M{"$gte": since}}
+}
+
+// Manifest describes archive.
+type Manifest struct {
+	Version int `json:"version"`
+	// Created is start of export, next incremental backup is made
+	// since Created
+	Created time.Time `json:"created"`
+	// Since is set by incremental backup
+	Since       *time.Time `json:"since,omitempty"`
+	Collections []File     `json:"collections"`
+}
+
+// File is exported collection.
+type File struct {
+	Collection string `json:"collection"`
+	Name       string `json:"file"`
+	Documents  int    `json:"documents"`
+	SHA256     string `json:"sha256"`
+}
+
+// Backup writes archive of colls of db to w. Zero since exports all
+// documents, otherwise documents modified since.
+func Backup(ctx context.Context, db *mongo.Database, colls []Collection, since time.Time, w io.Writer) (*Manifest, error) {
+	dir, err := os.MkdirTemp("", "stock-proxy-backup")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	m := &Manifest{Version: Version, Created: time.Now().UTC(), Collections: []File{}}
+	if !since.IsZero() {
+		since = since.UTC()
+		m.Since = &since
+	}
+	for _, c := range colls {
+		file, err := export(ctx, db.Collection(c.Name), c.filter(since), dir)
+		if err != nil {
+			return nil, errors.Wrap(err, "export "+c.Name)
+		}
+		m.Collections = append(m.Collections, *file)
+	}
+	if err := writeArchive(w, m, dir); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// export writes documents of coll matching filter to file in dir
+func export(ctx context.Context, coll *mongo.Collection, filter bson.M, dir string) (*File, error) {
+	file := &File{Collection: coll.Name(), Name: coll.Name() + ".jsonl"}
+	f, err := os.Create(filepath.Join(dir, file.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(f, h))
+
+	cur, err := coll.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		line, err := bson.MarshalExtJSON(cur.Current, true, false)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+		file.Documents++
+	}
+	if err := cur.Err(); err != nil {
+		return nil, err
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+	file.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return file, f.Close()
+}
+
+// writeArchive writes manifest m and its files in dir to w
+func writeArchive(w io.Writer, m *Manifest, dir string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = tw.WriteHeader(&tar.Header{Name: manifestName, Mode: 0644, Size: int64(len(manifest)), ModTime: m.Created})
+	if err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		return err
+	}
+
+	for _, file := range m.Collections {
+		f, err := os.Open(filepath.Join(dir, file.Name))
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0644, Size: st.Size(), ModTime: m.Created})
+		}
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		f.Close()
+		if err != nil {
+			return errors.Wrap(err, "archive "+file.Name)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// readArchive extracts archive r to dir and verifies checksums of
+// files listed in its manifest.
+func readArchive(r io.Reader, dir string) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "read archive")
+	}
+	tr := tar.NewReader(gz)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, errors.Wrap(err, "read archive")
+	}
+	if hdr.Name != manifestName {
+		return nil, errors.Errorf("archive must start with %s, got %s", manifestName, hdr.Name)
+	}
+	m := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(m); err != nil {
+		return nil, errors.Wrap(err, "read manifest")
+	}
+	if m.Version != Version {
+		return nil, errors.Errorf("unsupported archive version %d", m.Version)
+	}
+	files := map[string]File{}
+	for _, file := range m.Collections {
+		files[file.Name] = file
+	}
+
+	sums := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "read archive")
+		}
+		// names of manifest only, so that archive can not write
+		// outside of dir
+		if _, ok := files[hdr.Name]; !ok || sums[hdr.Name] != "" {
+			return nil, errors.Errorf("unexpected file %s in archive", hdr.Name)
+		}
+		sum, err := extract(tr, filepath.Join(dir, hdr.Name))
+		if err != nil {
+			return nil, errors.Wrap(err, "extract "+hdr.Name)
+		}
+		sums[hdr.Name] = sum
+	}
+
+	for name, file := range files {
+		if sums[name] == "" {
+			return nil, errors.Errorf("no %s in archive", name)
+		}
+		if sums[name] != file.SHA256 {
+			return nil, errors.Errorf("checksum mismatch of %s", name)
+		}
+	}
+	return m, nil
+}
+
+// extract copies r to file path, returns sha256 of content
+func extract(r io.Reader, path string) (string, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), f.Close()
+}
+
+// Restore verifies archive r and writes its documents to db, documents
+// with the same _id are replaced. Full backup is restored only into
+// empty collections, see ErrNotEmpty, incremental one is applied over
+// restored previous backups.
+func Restore(ctx context.Context, db *mongo.Database, r io.Reader) (*Manifest, error) {
+	dir, err := os.MkdirTemp("", "stock-proxy-restore")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	m, err := readArchive(r, dir)
+	if err != nil {
+		return nil, err
+	}
+	if m.Since == nil {
+		for _, file := range m.Collections {
+			n, err := db.Collection(file.Collection).CountDocuments(ctx, bson.M{})
+			if err != nil {
+				return nil, errors.Wrap(err, "count "+file.Collection)
+			}
+			if n > 0 {
+				return nil, errors.Wrapf(ErrNotEmpty, "%s has %d documents", file.Collection, n)
+			}
+		}
+	}
+	for _, file := range m.Collections {
+		if err := restore(ctx, db.Collection(file.Collection), filepath.Join(dir, file.Name), file.Documents); err != nil {
+			return nil, errors.Wrap(err, "restore "+file.Collection)
+		}
+	}
+	return m, nil
+}
+
+// restore writes documents of file at path to coll
+func restore(ctx context.Context, coll *mongo.Collection, path string, documents int) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	models := make([]mongo.WriteModel, 0, batchSize)
+	flush := func() error {
+		if len(models) == 0 {
+			return nil
+		}
+		_, err := coll.BulkWrite(ctx, models)
+		models = models[:0]
+		return err
+	}
+
+	n := 0
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		var doc bson.Raw
+		if err := bson.UnmarshalExtJSON(line, true, &doc); err != nil {
+			return errors.Wrapf(err, "document %d", n)
+		}
+		id, err := doc.LookupErr("_id")
+		if err != nil {
+			return errors.Errorf("document %d has no _id", n)
+		}
+		models = append(models, mongo.NewReplaceOneModel().
+			SetFilter(bson.D{{Key: "_id", Value: id}}).SetReplacement(doc).SetUpsert(true))
+		n++
+		if len(models) == batchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+	if n != documents {
+		return errors.Errorf("expected %d documents, got %d", documents, n)
+	}
+	return flush()
+}
@@ -0,0 +1,182 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// tarball returns archive of manifest m and files by name
+func tarball(t *testing.T, m *Manifest, files map[string]string) []byte {
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+	write := func(name string, data []byte) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	manifest, err := json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(manifestName, manifest)
+	for name, data := range files {
+		write(name, []byte(data))
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func sum(data string) string {
+	h := sha256.Sum256([]byte(data))
+	return hex.EncodeToString(h[:])
+}
+
+func TestArchive(t *testing.T) {
+	const data = "{\"a\": 1}\n"
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "timeseries.jsonl"), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Version: Version, Created: time.Now().UTC(), Collections: []File{
+		{Collection: "timeseries", Name: "timeseries.jsonl", Documents: 1, SHA256: sum(data)},
+	}}
+	buf := &bytes.Buffer{}
+	if err := writeArchive(buf, m, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	out := t.TempDir()
+	got, err := readArchive(buf, out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Collections) != 1 || got.Collections[0] != m.Collections[0] || !got.Created.Equal(m.Created) {
+		t.Errorf("wrong manifest %+v", got)
+	}
+	extracted, err := os.ReadFile(filepath.Join(out, "timeseries.jsonl"))
+	if err != nil || string(extracted) != data {
+		t.Errorf("wrong extracted file %q: %v", extracted, err)
+	}
+}
+
+func TestArchiveErrors(t *testing.T) {
+	const data = "{\"a\": 1}\n"
+	file := File{Collection: "timeseries", Name: "timeseries.jsonl", Documents: 1, SHA256: sum(data)}
+
+	cases := []struct {
+		m     Manifest
+		files map[string]string
+	}{
+		// checksum mismatch
+		{Manifest{Version: Version, Collections: []File{file}}, map[string]string{file.Name: "{\"a\": 2}\n"}},
+		// missing file
+		{Manifest{Version: Version, Collections: []File{file}}, map[string]string{}},
+		// file not in manifest
+		{Manifest{Version: Version, Collections: []File{file}}, map[string]string{file.Name: data, "../x": data}},
+		// unsupported version
+		{Manifest{Version: Version + 1, Collections: []File{file}}, map[string]string{file.Name: data}},
+	}
+	for caseNum, item := range cases {
+		archive := tarball(t, &item.m, item.files)
+		if _, err := readArchive(bytes.NewReader(archive), t.TempDir()); err == nil {
+			t.Errorf("[%d] expected error", caseNum)
+		}
+	}
+
+	// archive without manifest
+	if _, err := readArchive(strings.NewReader("not an archive"), t.TempDir()); err == nil {
+		t.Errorf("expected error of invalid archive")
+	}
+}
+
+// testDB returns empty database of mongoDB at STOCK_PROXY_TEST_MONGO,
+// which is dropped after test. Test is skipped if variable is not set.
+func testDB(t *testing.T, client **mongo.Client) *mongo.Database {
+	uri := os.Getenv("STOCK_PROXY_TEST_MONGO")
+	if uri == "" {
+		t.Skip("STOCK_PROXY_TEST_MONGO is not set")
+	}
+	if *client == nil {
+		c, err := mongo.Connect(context.Background(), options.Client().ApplyURI(uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		*client = c
+		t.Cleanup(func() { c.Disconnect(context.Background()) })
+	}
+	db := (*client).Database("backup_test_" + strconv.FormatInt(time.Now().UnixNano(), 36))
+	t.Cleanup(func() { db.Drop(context.Background()) })
+	return db
+}
+
+// TestBackupRestore checks full and incremental backup restored into
+// an empty store.
+func TestBackupRestore(t *testing.T) {
+	var client *mongo.Client
+	src := testDB(t, &client)
+	ctx := context.Background()
+	colls := []Collection{{Name: "timeseries", Since: "updated"}}
+	ts := src.Collection("timeseries")
+
+	old := time.Now().Add(-time.Hour)
+	ts.InsertOne(ctx, bson.M{"ticker": "AMZN", "updated": old,
+		"ohlcv": []primitive.Binary{{Subtype: 0x80, Data: []byte{1, 2, 3}}}})
+	full := &bytes.Buffer{}
+	m, err := Backup(ctx, src, colls, time.Time{}, full)
+	if err != nil || m.Collections[0].Documents != 1 {
+		t.Fatalf("full backup %+v: %v", m, err)
+	}
+
+	ts.UpdateOne(ctx, bson.M{"ticker": "AMZN"}, bson.M{
+		"$push": bson.M{"ohlcv": primitive.Binary{Data: []byte("{}")}},
+		"$set":  bson.M{"updated": time.Now()}})
+	ts.InsertOne(ctx, bson.M{"ticker": "MSFT", "updated": time.Now(), "ohlcv": []primitive.Binary{}})
+	incremental := &bytes.Buffer{}
+	m, err = Backup(ctx, src, colls, m.Created, incremental)
+	if err != nil || m.Collections[0].Documents != 2 {
+		t.Fatalf("incremental backup %+v: %v", m, err)
+	}
+
+	dst := testDB(t, &client)
+	fullArchive := full.Bytes()
+	if _, err := Restore(ctx, dst, bytes.NewReader(fullArchive)); err != nil {
+		t.Fatal(err)
+	}
+	// full backup is restored into empty store only
+	if _, err := Restore(ctx, dst, bytes.NewReader(fullArchive)); err == nil {
+		t.Errorf("expected error of not empty store")
+	}
+	if _, err := Restore(ctx, dst, incremental); err != nil {
+		t.Fatal(err)
+	}
+
+	var item struct {
+		Ohlcv []primitive.Binary `bson:"ohlcv"`
+	}
+	if err := dst.Collection("timeseries").FindOne(ctx, bson.M{"ticker": "AMZN"}).Decode(&item); err != nil {
+		t.Fatal(err)
+	}
+	if len(item.Ohlcv) != 2 || item.Ohlcv[0].Subtype != 0x80 {
+		t.Errorf("wrong restored record %+v", item)
+	}
+	if n, _ := dst.Collection("timeseries").CountDocuments(ctx, bson.M{}); n != 2 {
+		t.Errorf("expected 2 records, got %d", n)
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	"github.com/adnilote/stock-proxy/config"
+	"github.com/adnilote/stock-proxy/proxy"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+// command is a subcommand of stock-proxy, the first arg.
+type command struct {
+	run   func(args []string)
+	usage string
+}
+
+// commands by name, each accepts config flags, see config package.
+var commands = map[string]command{
+	"serve":   {runServe, "run proxy server, the default command"},
+	"fetch":   {runFetch, "fetch and store one Alpha Vantage query within budget of limit_store: mongo, e.g. fetch function=TIME_SERIES_DAILY symbol=amzn"},
+	"history": {runHistory, "print stored bars as table, csv or json"},
+	"import":  {runImport, "store csv and json files of time series without API calls"},
+	"queue":   {runQueue, "inspect and control queue of running server by admin API"},
+	"backup":  {runBackup, "write archive of history"},
+	"restore": {runRestore, "restore archive of history into empty store"},
+}
+
+// usage writes list of commands to w.
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: stock-proxy [command] [flags] [args]")
+	fmt.Fprintln(w, "\nCommands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].usage)
+	}
+	tw.Flush()
+	fmt.Fprintln(w, "\nFlags of a command: stock-proxy <command> -h")
+}
+
+// openProxy returns proxy of cfg for one-off commands: it has no
+// workers and logs warnings to stderr. API key budget is shared with
+// servers by limit_store: mongo.
+func openProxy(cfg *config.Config) (*proxy.Proxy, *mongo.Client) {
+	logger, err := NewLogger([]string{"stderr"}, zap.NewAtomicLevelAt(zap.WarnLevel), "console")
+	if err != nil {
+		log.Fatal(err)
+	}
+	client, err := connect(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	db := client.Database("av")
+
+	opts := proxyOptions(cfg, nil)
+	opts.Reporter = nil
+	opts.LimitStore = limitStore(cfg, db)
+	opts.NoWorkers = true
+	p, err := proxy.NewProxy(db, logger, opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p, client
+}
+
+// parseQuery returns query of args in format param=value.
+func parseQuery(args []string) (url.Values, error) {
+	query := url.Values{}
+	for _, arg := range args {
+		kv := strings.SplitN(arg, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid param %q, expected param=value", arg)
+		}
+		query.Set(kv[0], kv[1])
+	}
+	return query, nil
+}
+
+// sharedBudget returns error unless API key budget of cfg is shared
+// with servers, or unshared budget is allowed.
+func sharedBudget(cfg *config.Config, unshared bool) error {
+	if cfg.LimitStore != "mongo" && !unshared {
+		return fmt.Errorf("API key budget is shared with servers only by limit_store: mongo, " +
+			"set -unshared to use budget of this process")
+	}
+	return nil
+}
+
+// runFetch fetches query of args, bypassing queue of servers, stores
+// the response and writes it to stdout. API key budget is shared with
+// servers only by limit_store: mongo, otherwise fetch is refused unless
+// -unshared is set, e.g. when no server runs.
+//
+//	stock-proxy fetch function=TIME_SERIES_INTRADAY symbol=amzn interval=5min
+func runFetch(args []string) {
+	var rest func() []string
+	var unshared bool
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.BoolVar(&unshared, "unshared", false, "Fetch with API key budget of this process, not shared with running servers.")
+		rest = fs.Args
+	})
+	if err := sharedBudget(cfg, unshared); err != nil {
+		log.Fatalf("fetch: %v", err)
+	}
+	query, err := parseQuery(rest())
+	if err != nil {
+		log.Fatalf("fetch: %v", err)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	p, client := openProxy(cfg)
+	defer client.Disconnect(context.Background())
+
+	body, _, err := p.Fetch(ctx, query)
+	os.Stdout.Write(body)
+	if err != nil {
+		log.Fatalf("fetch: %v", err)
+	}
+}
+
+// writeBars writes values to w in format table, csv or json. Dates
+// of daily bars have no time.
+func writeBars(w io.Writer, values []*proxy.TimeSeriesValue, format string) error {
+	bars := make([]proxy.Bar, 0, len(values))
+	for _, v := range values {
+		bars = append(bars, proxy.NewBar(v))
+	}
+	num := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(bars)
+	case "csv":
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"timestamp", "open", "high", "low", "close", "volume"})
+		for _, b := range bars {
+			cw.Write([]string{b.Time, num(b.Open), num(b.High), num(b.Low), num(b.Close), num(b.Volume)})
+		}
+		cw.Flush()
+		return cw.Error()
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(tw, "time\topen\thigh\tlow\tclose\tvolume\t")
+		for _, b := range bars {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n", b.Time, num(b.Open), num(b.High), num(b.Low), num(b.Close), num(b.Volume))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown format %q, expected table, csv or json", format)
+}
+
+// parseDay parses -from and -to of history, a date or date and time
+// in exchange wall clock.
+func parseDay(s string) (time.Time, error) {
+	for _, layout := range []string{"2006-01-02", "2006-01-02 15:04:05", "2006-01-02T15:04:05"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q, expected 2006-01-02 or 2006-01-02 15:04:05", s)
+}
+
+// runHistory writes stored bars of a series to stdout, bars are
+// filtered by time from and to, inclusive, and back-adjusted for
+// dividends and splits with -adjusted.
+//
+//	stock-proxy history -symbol amzn -function TIME_SERIES_INTRADAY -interval 5min -format csv -adjusted
+func runHistory(args []string) {
+	var symbol, function, interval, from, to, format string
+	var adjusted bool
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&symbol, "symbol", "", "Ticker, e.g. amzn.")
+		fs.StringVar(&function, "function", "TIME_SERIES_DAILY", "Time series function.")
+		fs.StringVar(&interval, "interval", "", "Interval of TIME_SERIES_INTRADAY, e.g. 5min.")
+		fs.StringVar(&from, "from", "", "First time, e.g. 2019-08-01.")
+		fs.StringVar(&to, "to", "", "Last time, e.g. 2019-08-31 16:00:00.")
+		fs.StringVar(&format, "format", "table", "Output format: table, csv or json.")
+		fs.BoolVar(&adjusted, "adjusted", false, "Back-adjust bars for stored dividends and splits.")
+	})
+	query := url.Values{}
+	query.Set(av.QueryFunction, strings.ToUpper(function))
+	query.Set(av.QuerySymbol, symbol)
+	if interval != "" {
+		query.Set(av.QueryInterval, interval)
+	}
+	var first, last time.Time
+	var err error
+	if from != "" {
+		if first, err = parseDay(from); err != nil {
+			log.Fatalf("history: %v", err)
+		}
+	}
+	if to != "" {
+		if last, err = parseDay(to); err != nil {
+			log.Fatalf("history: %v", err)
+		}
+		if len(to) == len("2006-01-02") {
+			last = last.Add(24*time.Hour - time.Second)
+		}
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	p, client := openProxy(cfg)
+	defer client.Disconnect(context.Background())
+
+	values, err := p.Bars(ctx, query)
+	if err == mongo.ErrNoDocuments {
+		log.Fatalf("history: no history of %s", strings.ToUpper(symbol))
+	}
+	if err == nil && adjusted {
+		values, err = p.AdjustHistory(ctx, strings.ToUpper(symbol), values)
+	}
+	if err != nil {
+		log.Fatalf("history: %v", err)
+	}
+	filtered := values[:0]
+	for _, v := range values {
+		if (first.IsZero() || !v.Time.Before(first)) && (last.IsZero() || !v.Time.After(last)) {
+			filtered = append(filtered, v)
+		}
+	}
+	if err := writeBars(os.Stdout, filtered, format); err != nil {
+		log.Fatalf("history: %v", err)
+	}
+}
+
+// importFiles returns files of paths, directories are walked for csv
+// and json files.
+func importFiles(paths []string) ([]string, error) {
+	files := []string{}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+			continue
+		}
+		err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			switch strings.ToLower(filepath.Ext(file)) {
+			case ".csv", ".json":
+				if !info.IsDir() {
+					files = append(files, file)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// runImport stores time series of csv and json files, e.g. saved by
+// fetch, without API calls. Series of csv files is inferred from file
+// name and timestamps, flags override it. Only bars which are not
+// stored yet are added.
+//
+//	stock-proxy import amzn_daily.json msft_5min.csv dumps/
+//	stock-proxy import -symbol IBM -function TIME_SERIES_DAILY_ADJUSTED ibm.csv
+func runImport(args []string) {
+	var rest func() []string
+	var symbol, function, interval string
+	var dryRun bool
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&symbol, "symbol", "", "Symbol of csv files, inferred from file name by default.")
+		fs.StringVar(&function, "function", "", "Time series of csv files, inferred from file name or timestamps by default.")
+		fs.StringVar(&interval, "interval", "", "Interval of intraday csv files, inferred from file name or timestamps by default.")
+		fs.BoolVar(&dryRun, "dry-run", false, "Report counts without storing.")
+		rest = fs.Args
+	})
+	if len(rest()) == 0 {
+		log.Fatal("import: files required")
+	}
+	files, err := importFiles(rest())
+	if err != nil {
+		log.Fatalf("import: %v", err)
+	}
+
+	ctx, cancel := commandContext()
+	defer cancel()
+	p, client := openProxy(cfg)
+	defer client.Disconnect(context.Background())
+
+	failed, added := 0, 0
+	for _, path := range files {
+		if ctx.Err() != nil {
+			log.Fatalf("import: %v", ctx.Err())
+		}
+		body, err := ioutil.ReadFile(path)
+		if err == nil {
+			hint := proxy.InferQuery(path)
+			for param, value := range map[string]string{
+				av.QuerySymbol:   symbol,
+				av.QueryFunction: function,
+				av.QueryInterval: interval,
+			} {
+				if value != "" {
+					hint.Set(param, value)
+				}
+			}
+			var res *proxy.ImportResult
+			if res, err = p.Import(ctx, body, hint, dryRun); err == nil {
+				series := res.Query.Get(av.QueryFunction)
+				if res.Query.Get(av.QueryInterval) != "" {
+					series += " " + res.Query.Get(av.QueryInterval)
+				}
+				fmt.Printf("%s: %s %s %d bars, %d new, %d duplicates\n", path,
+					strings.ToUpper(res.Query.Get(av.QuerySymbol)), series, res.Bars, res.New, res.Duplicates)
+				added += res.New
+				continue
+			}
+		}
+		failed++
+		fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+	}
+	fmt.Printf("%d files, %d failed, %d new bars\n", len(files), failed, added)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// adminClient calls admin API of a running server.
+type adminClient struct {
+	addr  string
+	token string
+	hc    *http.Client
+}
+
+// do sends request to admin path and decodes json response to out.
+func (c *adminClient) do(method, path string, out interface{}) error {
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.addr, "/")+"/admin/"+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	resp, err := c.hc.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.Unmarshal(body, out)
+}
+
+// writeTasks writes queued and in-flight tasks to w as table.
+func writeTasks(w io.Writer, tasks proxy.Tasks) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "paused: %v\n", tasks.Paused)
+	fmt.Fprintln(tw, "state\tid\tticker\tfunction\tage\tpriority\tclient\tsync")
+	write := func(state string, list []proxy.TaskInfo) {
+		for _, t := range list {
+			age := time.Duration(t.Age * float64(time.Second)).Round(time.Second)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%v\n", state, t.ID, t.Ticker, t.Function, age, t.Priority, t.Client, t.Sync)
+		}
+	}
+	write("in-flight", tasks.InFlight)
+	write("queued", tasks.Queued)
+	return tw.Flush()
+}
+
+// runQueue inspects or controls queue of a running server by admin
+// API, token is admin_token of config.
+//
+//	stock-proxy queue [-addr http://127.0.0.1:8082] [list | cancel <id> | priority <id> <n> | pause | resume | drain | storage]
+func runQueue(args []string) {
+	var addr string
+	var rest func() []string
+	cfg := loadConfig(args, func(fs *flag.FlagSet) {
+		fs.StringVar(&addr, "addr", "", "URL of server, default is http://127.0.0.1 with port of listen_address.")
+		rest = fs.Args
+	})
+	if cfg.AdminToken == "" {
+		log.Fatal("queue: admin_token required")
+	}
+	if addr == "" {
+		port := cfg.ListenAddress
+		if i := strings.LastIndex(port, ":"); i >= 0 {
+			port = port[i:]
+		}
+		addr = "http://127.0.0.1" + port
+	}
+	c := &adminClient{addr: addr, token: cfg.AdminToken, hc: &http.Client{Timeout: 30 * time.Second}}
+
+	action := []string{"list"}
+	if len(rest()) > 0 {
+		action = rest()
+	}
+	var out interface{}
+	var err error
+	switch {
+	case action[0] == "list" && len(action) == 1:
+		var tasks proxy.Tasks
+		if err = c.do(http.MethodGet, "tasks", &tasks); err == nil {
+			err = writeTasks(os.Stdout, tasks)
+		}
+	case action[0] == "cancel" && len(action) == 2:
+		err = c.do(http.MethodPost, "tasks/"+url.PathEscape(action[1])+"/cancel", &out)
+	case action[0] == "priority" && len(action) == 3:
+		err = c.do(http.MethodPost, "tasks/"+url.PathEscape(action[1])+"/priority?value="+url.QueryEscape(action[2]), &out)
+	case (action[0] == "pause" || action[0] == "resume" || action[0] == "drain") && len(action) == 1:
+		err = c.do(http.MethodPost, action[0], &out)
+	case action[0] == "storage" && len(action) == 1:
+		err = c.do(http.MethodGet, "storage", &out)
+	default:
+		log.Fatalf("queue: unknown action %q", strings.Join(action, " "))
+	}
+	if err != nil {
+		log.Fatalf("queue: %v", err)
+	}
+	if out != nil {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(out)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adnilote/stock-proxy/config"
+	"github.com/adnilote/stock-proxy/proxy"
+)
+
+func TestWriteBars(t *testing.T) {
+	values := []*proxy.TimeSeriesValue{
+		{Time: time.Date(2019, 8, 5, 0, 0, 0, 0, time.UTC), Open: 1, High: 2, Low: 0.5, Close: 1.5, Volume: 10},
+		{Time: time.Date(2019, 8, 6, 9, 35, 0, 0, time.UTC), Open: 2, High: 3, Low: 1.5, Close: 2.5, Volume: 20},
+	}
+	cases := []struct {
+		format   string
+		expected string
+	}{
+		{"csv", "timestamp,open,high,low,close,volume\n2019-08-05,1,2,0.5,1.5,10\n2019-08-06 09:35:00,2,3,1.5,2.5,20\n"},
+		{"json", `"time": "2019-08-06 09:35:00"`},
+		{"table", "2019-08-06 09:35:00"},
+	}
+	for caseNum, item := range cases {
+		buf := &bytes.Buffer{}
+		if err := writeBars(buf, values, item.format); err != nil {
+			t.Errorf("[%d] %v", caseNum, err)
+			continue
+		}
+		if !strings.Contains(buf.String(), item.expected) {
+			t.Errorf("[%d] %s output %q has no %q", caseNum, item.format, buf.String(), item.expected)
+		}
+	}
+	if err := writeBars(&bytes.Buffer{}, values, "xml"); err == nil {
+		t.Errorf("expected error of unknown format")
+	}
+}
+
+func TestParseQuery(t *testing.T) {
+	query, err := parseQuery([]string{"function=TIME_SERIES_DAILY", "symbol=amzn"})
+	if err != nil || query.Get("function") != "TIME_SERIES_DAILY" || query.Get("symbol") != "amzn" {
+		t.Errorf("wrong query %v: %v", query, err)
+	}
+	if _, err := parseQuery([]string{"amzn"}); err == nil {
+		t.Errorf("expected error of param without value")
+	}
+}
+
+func TestSharedBudget(t *testing.T) {
+	cases := []struct {
+		store    string
+		unshared bool
+		ok       bool
+	}{
+		{"mongo", false, true},
+		{"memory", false, false},
+		{"memory", true, true},
+	}
+	for caseNum, item := range cases {
+		err := sharedBudget(&config.Config{LimitStore: item.store}, item.unshared)
+		if (err == nil) != item.ok {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+		}
+	}
+}
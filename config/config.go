@@ -0,0 +1,345 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"go.uber.org/zap/zapcore"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// EnvPrefix is prefix of environment variables, e.g. STOCK_PROXY_MAX_QUEUE
+	EnvPrefix = "STOCK_PROXY_"
+
+	// DSN sentry error monitoring
+	DSN string = "https://91d94d4b63c0459cba56427529cc9a09@sentry.io/1519981"
+)
+
+// Config of stock-proxy. Options are loaded from defaults, file,
+// environment and flags, each next one overrides the previous.
+//
+// Zero proxy options (APIKeys, RequestLimit, MaxQueue, ShutdownTimeout) mean
+// defaults of proxy package.
+type Config struct {
+	ListenAddress string `yaml:"listen_address" toml:"listen_address"`
+	MongoAddress  string `yaml:"mongo_address" toml:"mongo_address"`
+	SentryDSN     string `yaml:"sentry_dsn" toml:"sentry_dsn"`
+	LogLevel      string `yaml:"log_level" toml:"log_level"`
+	// LogFormat is "console" for development or "json" for production
+	LogFormat      string        `yaml:"log_format" toml:"log_format"`
+	APIKeys        []string      `yaml:"api_keys" toml:"api_keys"`
+	RequestLimit   int           `yaml:"request_limit" toml:"request_limit"`
+	MaxQueue       int           `yaml:"max_queue" toml:"max_queue"`
+	Backfill       string        `yaml:"backfill" toml:"backfill"`
+	BackfillPeriod time.Duration `yaml:"backfill_period" toml:"backfill_period"`
+	// ShutdownTimeout is time to finish queued requests on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" toml:"shutdown_timeout"`
+	// TraceEndpoint is OTLP/HTTP endpoint of traces, empty disables
+	// tracing
+	TraceEndpoint string `yaml:"trace_endpoint" toml:"trace_endpoint"`
+	// AdminToken authorizes requests to admin API, empty disables it
+	AdminToken string `yaml:"admin_token" toml:"admin_token"`
+	// LimitStore keeps API key calls, "memory" of this instance or
+	// "mongo" shared by replicas
+	LimitStore string `yaml:"limit_store" toml:"limit_store"`
+	// MongoTimeout limits connect and operations of mongoDB
+	MongoTimeout time.Duration `yaml:"mongo_timeout" toml:"mongo_timeout"`
+	// MongoMaxPool is max amount of connections to mongoDB
+	MongoMaxPool int `yaml:"mongo_max_pool" toml:"mongo_max_pool"`
+	// Retention is comma separated function[:interval]=period, how
+	// long bars are stored, e.g. "TIME_SERIES_INTRADAY:1min=30d"
+	Retention       string        `yaml:"retention" toml:"retention"`
+	RetentionPeriod time.Duration `yaml:"retention_period" toml:"retention_period"`
+	// Compression of stored responses: zstd, snappy or none
+	Compression string `yaml:"compression" toml:"compression"`
+}
+
+// minAdminToken is min length of admin token, so that it can not be
+// guessed.
+const minAdminToken = 16
+
+// Default returns config with default values.
+func Default() *Config {
+	return &Config{
+		ListenAddress:  ":8082",
+		MongoAddress:   "mongo:27017", // mongo or 127.0.0.1
+		SentryDSN:      DSN,
+		LogLevel:       "debug",
+		LogFormat:      "console",
+		LimitStore:     "memory",
+		MongoTimeout:   10 * time.Second,
+		MongoMaxPool:   100,
+		BackfillPeriod: 10 * time.Minute,
+
+		RetentionPeriod: time.Hour,
+		Compression:     "zstd",
+	}
+}
+
+// Validate checks that options have valid values.
+func (c *Config) Validate() error {
+	if c.ListenAddress == "" {
+		return errors.New("listen_address required")
+	}
+	if c.MongoAddress == "" {
+		return errors.New("mongo_address required")
+	}
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return errors.Errorf("invalid log_level %q", c.LogLevel)
+	}
+	if c.LogFormat != "console" && c.LogFormat != "json" {
+		return errors.Errorf("invalid log_format %q", c.LogFormat)
+	}
+	for _, key := range c.APIKeys {
+		if key == "" {
+			return errors.New("empty key in api_keys")
+		}
+	}
+	if c.RequestLimit < 0 {
+		return errors.Errorf("invalid request_limit %d", c.RequestLimit)
+	}
+	if c.MaxQueue < 0 {
+		return errors.Errorf("invalid max_queue %d", c.MaxQueue)
+	}
+	if c.BackfillPeriod <= 0 {
+		return errors.Errorf("invalid backfill_period %s", c.BackfillPeriod)
+	}
+	if c.RetentionPeriod <= 0 {
+		return errors.Errorf("invalid retention_period %s", c.RetentionPeriod)
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.Errorf("invalid shutdown_timeout %s", c.ShutdownTimeout)
+	}
+	if c.MongoTimeout <= 0 {
+		return errors.Errorf("invalid mongo_timeout %s", c.MongoTimeout)
+	}
+	if c.MongoMaxPool <= 0 {
+		return errors.Errorf("invalid mongo_max_pool %d", c.MongoMaxPool)
+	}
+	if c.LimitStore != "memory" && c.LimitStore != "mongo" {
+		return errors.Errorf("invalid limit_store %q", c.LimitStore)
+	}
+	if c.Compression != "zstd" && c.Compression != "snappy" && c.Compression != "none" {
+		return errors.Errorf("invalid compression %q", c.Compression)
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < minAdminToken {
+		return errors.Errorf("admin_token must be at least %d characters", minAdminToken)
+	}
+	return nil
+}
+
+// option binds an option of Config to its file key, environment
+// variable and flag.
+type option struct {
+	// name is file key, flag name is name with "-" instead of "_",
+	// environment variable is EnvPrefix + upper name
+	name  string
+	usage string
+	set   func(c *Config, v string) error
+}
+
+func (o option) flag() string { return strings.Replace(o.name, "_", "-", -1) }
+func (o option) env() string  { return EnvPrefix + strings.ToUpper(o.name) }
+
+func setInt(field func(c *Config) *int) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func setDuration(field func(c *Config) *time.Duration) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+func setString(field func(c *Config) *string) func(c *Config, v string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+var options = []option{
+	{"listen_address", "The address to listen on for HTTP requests.",
+		setString(func(c *Config) *string { return &c.ListenAddress })},
+	{"mongo_address", "The address to connect to mongo.",
+		setString(func(c *Config) *string { return &c.MongoAddress })},
+	{"sentry_dsn", "Sentry DSN for error monitoring.",
+		setString(func(c *Config) *string { return &c.SentryDSN })},
+	{"log_level", "Log level: debug, info, warn, error.",
+		setString(func(c *Config) *string { return &c.LogLevel })},
+	{"log_format", "Log format: console or json.",
+		setString(func(c *Config) *string { return &c.LogFormat })},
+	{"api_keys", "Comma separated Alpha Vantage API keys.",
+		func(c *Config, v string) error {
+			c.APIKeys = nil
+			for _, key := range strings.Split(v, ",") {
+				if key = strings.TrimSpace(key); key != "" {
+					c.APIKeys = append(c.APIKeys, key)
+				}
+			}
+			return nil
+		}},
+	{"request_limit", "Requests per minute per API key.",
+		setInt(func(c *Config) *int { return &c.RequestLimit })},
+	{"max_queue", "Max amount of queued requests.",
+		setInt(func(c *Config) *int { return &c.MaxQueue })},
+	{"backfill", "Comma separated symbol:function[:interval] to check for gaps and backfill.",
+		setString(func(c *Config) *string { return &c.Backfill })},
+	{"backfill_period", "How often to check backfill targets for gaps.",
+		setDuration(func(c *Config) *time.Duration { return &c.BackfillPeriod })},
+	{"shutdown_timeout", "Time to finish queued requests on shutdown.",
+		setDuration(func(c *Config) *time.Duration { return &c.ShutdownTimeout })},
+	{"trace_endpoint", "OTLP/HTTP endpoint to export traces, e.g. http://otel-collector:4318.",
+		setString(func(c *Config) *string { return &c.TraceEndpoint })},
+	{"admin_token", "Bearer token of admin API, empty disables it.",
+		setString(func(c *Config) *string { return &c.AdminToken })},
+	{"mongo_timeout", "Timeout of connect and operations of mongoDB.",
+		setDuration(func(c *Config) *time.Duration { return &c.MongoTimeout })},
+	{"mongo_max_pool", "Max amount of connections to mongoDB.",
+		setInt(func(c *Config) *int { return &c.MongoMaxPool })},
+	{"limit_store", "Store of API key calls: memory, or mongo to share limit between replicas.",
+		setString(func(c *Config) *string { return &c.LimitStore })},
+	{"retention", "Comma separated function[:interval]=period to keep bars, e.g. TIME_SERIES_INTRADAY:1min=30d.",
+		setString(func(c *Config) *string { return &c.Retention })},
+	{"retention_period", "How often to compact stored history by retention rules.",
+		setDuration(func(c *Config) *time.Duration { return &c.RetentionPeriod })},
+	{"compression", "Compression of stored responses: zstd, snappy or none. Stored responses are migrated on start.",
+		setString(func(c *Config) *string { return &c.Compression })},
+}
+
+// Loader loads Config from file, environment and command line args.
+// Load may be called again to reload changed file or environment.
+type Loader struct {
+	args []string
+	// flags adds flags of a command, e.g. backup, to options
+	flags func(fs *flag.FlagSet)
+}
+
+// NewLoader returns loader of command line args, e.g. os.Args[1:].
+func NewLoader(args []string) *Loader {
+	return &Loader{args: args}
+}
+
+// WithFlags adds flags of a command to flags of options, which are
+// parsed from the same args.
+func (l *Loader) WithFlags(flags func(fs *flag.FlagSet)) *Loader {
+	l.flags = flags
+	return l
+}
+
+// flagValue is flag.Value which collects flag values as strings.
+type flagValue struct {
+	name   string
+	values map[string]string
+}
+
+func (f *flagValue) String() string { return "" }
+func (f *flagValue) Set(v string) error {
+	f.values[f.name] = v
+	return nil
+}
+
+// FlagSet returns flags of all options and -config, set flags are
+// collected to values by option name.
+func FlagSet(values map[string]string) *flag.FlagSet {
+	fs := flag.NewFlagSet("stock-proxy", flag.ContinueOnError)
+	fs.Var(&flagValue{name: "config", values: values}, "config",
+		"Path to YAML or TOML config file, also "+EnvPrefix+"CONFIG.")
+	for _, o := range options {
+		fs.Var(&flagValue{name: o.name, values: values}, o.flag(),
+			o.usage+" Also "+o.env()+".")
+	}
+	return fs
+}
+
+// Load returns config loaded from defaults, file, environment and
+// command line args, in increasing priority.
+func (l *Loader) Load() (*Config, error) {
+	flags := map[string]string{}
+	fs := FlagSet(flags)
+	if l.flags != nil {
+		l.flags(fs)
+	}
+	if err := fs.Parse(l.args); err != nil {
+		return nil, err
+	}
+
+	c := Default()
+
+	path := os.Getenv(EnvPrefix + "CONFIG")
+	if v, ok := flags["config"]; ok {
+		path = v
+	}
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := os.LookupEnv(o.env()); ok {
+			if err := o.set(c, v); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", o.env())
+			}
+		}
+	}
+
+	for _, o := range options {
+		if v, ok := flags[o.name]; ok {
+			if err := o.set(c, v); err != nil {
+				return nil, errors.Wrapf(err, "invalid -%s", o.flag())
+			}
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadFile overrides config by YAML or TOML file, chosen by
+// extension. Unknown keys are errors.
+func (c *Config) loadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(data, c)
+	case ".toml":
+		var meta toml.MetaData
+		meta, err = toml.NewDecoder(bytes.NewReader(data)).Decode(c)
+		if err == nil && len(meta.Undecoded()) > 0 {
+			err = fmt.Errorf("unknown keys %v", meta.Undecoded())
+		}
+	default:
+		err = errors.New("unknown config format, expected .yaml, .yml or .toml")
+	}
+	return errors.Wrapf(err, "error loading config %s", path)
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, data string) string {
+	dir, err := ioutil.TempDir("", "stock-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, "config.yaml", `
+listen_address: ":9000"
+mongo_address: "127.0.0.1:27017"
+log_level: info
+api_keys: [a, b]
+request_limit: 3
+max_queue: 20
+backfill_period: 5m
+`)
+	os.Setenv(EnvPrefix+"MAX_QUEUE", "30")
+	os.Setenv(EnvPrefix+"LOG_LEVEL", "warn")
+	defer os.Unsetenv(EnvPrefix + "MAX_QUEUE")
+	defer os.Unsetenv(EnvPrefix + "LOG_LEVEL")
+
+	cfg, err := NewLoader([]string{"-config", path, "-log-level", "error"}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// file
+	if cfg.ListenAddress != ":9000" || cfg.RequestLimit != 3 || cfg.BackfillPeriod != 5*time.Minute {
+		t.Errorf("file options not loaded: %+v", cfg)
+	}
+	if len(cfg.APIKeys) != 2 || cfg.APIKeys[1] != "b" {
+		t.Errorf("wrong api_keys: %v", cfg.APIKeys)
+	}
+	// env over file
+	if cfg.MaxQueue != 30 {
+		t.Errorf("wrong max_queue: got %d, expected 30", cfg.MaxQueue)
+	}
+	// flag over env
+	if cfg.LogLevel != "error" {
+		t.Errorf("wrong log_level: got %s, expected error", cfg.LogLevel)
+	}
+	// default
+	if cfg.SentryDSN != DSN {
+		t.Errorf("wrong sentry_dsn: %s", cfg.SentryDSN)
+	}
+}
+
+func TestLoadTOML(t *testing.T) {
+	path := writeFile(t, "config.toml", `
+api_keys = ["a"]
+request_limit = 2
+backfill = "amzn:TIME_SERIES_DAILY"
+backfill_period = "1h"
+`)
+	os.Setenv(EnvPrefix+"CONFIG", path)
+	defer os.Unsetenv(EnvPrefix + "CONFIG")
+
+	cfg, err := NewLoader([]string{"-api-keys", "c, d"}).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RequestLimit != 2 || cfg.Backfill != "amzn:TIME_SERIES_DAILY" || cfg.BackfillPeriod != time.Hour {
+		t.Errorf("toml options not loaded: %+v", cfg)
+	}
+	if len(cfg.APIKeys) != 2 || cfg.APIKeys[0] != "c" || cfg.APIKeys[1] != "d" {
+		t.Errorf("wrong api_keys: %v", cfg.APIKeys)
+	}
+}
+
+func TestLoadWithFlags(t *testing.T) {
+	var out string
+	cfg, err := NewLoader([]string{"-out", "history.tar.gz", "-mongo-address", "db:27017"}).
+		WithFlags(func(fs *flag.FlagSet) { fs.StringVar(&out, "out", "", "") }).
+		Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "history.tar.gz" || cfg.MongoAddress != "db:27017" {
+		t.Errorf("flags not parsed: out %q, %+v", out, cfg)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := [][]string{
+		{"-log-level", "verbose"},
+		{"-log-format", "xml"},
+		{"-max-queue", "-1"},
+		{"-request-limit", "five"},
+		{"-backfill-period", "0s"},
+		{"-shutdown-timeout", "-1s"},
+		{"-admin-token", "short"},
+		{"-limit-store", "redis"},
+		{"-mongo-timeout", "0s"},
+		{"-mongo-max-pool", "0"},
+		{"-retention-period", "0s"},
+		{"-compression", "gzip"},
+		{"-config", writeFile(t, "config.yaml", "max_queu: 1")},
+		{"-config", writeFile(t, "config.toml", "max_queu = 1")},
+		{"-config", writeFile(t, "config.json", "{}")},
+	}
+	for caseNum, args := range cases {
+		if _, err := NewLoader(args).Load(); err == nil {
+			t.Errorf("[%d] expected error for %v", caseNum, args)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package reporter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// maxBatch is amount of reports, which are forwarded without waiting
+// for interval.
+const maxBatch = 100
+
+type report struct {
+	err   error
+	level Level
+	extra map[string]interface{}
+}
+
+// Async forwards reports to next reporter in background batches,
+// so that callers never block on it. Reports exceeding buffer are
+// dropped.
+type Async struct {
+	next    Reporter
+	reports chan report
+	flush   chan chan struct{}
+	dropped int64
+}
+
+// NewAsync returns reporter buffering up to size reports and
+// forwarding them to next every interval or by maxBatch.
+func NewAsync(next Reporter, size int, interval time.Duration) *Async {
+	a := &Async{
+		next:    next,
+		reports: make(chan report, size),
+		flush:   make(chan chan struct{}),
+	}
+	go a.run(interval)
+	return a
+}
+
+// Report queues err, it is dropped if buffer is full.
+func (a *Async) Report(err error, level Level, extra map[string]interface{}) {
+	select {
+	case a.reports <- report{err: err, level: level, extra: extra}:
+	default:
+		atomic.AddInt64(&a.dropped, 1)
+	}
+}
+
+// Dropped returns amount of reports dropped as buffer was full.
+func (a *Async) Dropped() int64 {
+	return atomic.LoadInt64(&a.dropped)
+}
+
+// Flush forwards queued reports and flushes next reporter.
+func (a *Async) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	done := make(chan struct{})
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case a.flush <- done:
+	case <-timer.C:
+		return false
+	}
+	select {
+	case <-done:
+	case <-timer.C:
+		return false
+	}
+	return a.next.Flush(time.Until(deadline))
+}
+
+func (a *Async) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	batch := make([]report, 0, maxBatch)
+	forward := func() {
+		for _, r := range batch {
+			a.next.Report(r.err, r.level, r.extra)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case r := <-a.reports:
+			batch = append(batch, r)
+			if len(batch) >= maxBatch {
+				forward()
+			}
+		case <-ticker.C:
+			forward()
+		case done := <-a.flush:
+			// take reports queued before flush
+			for n := len(a.reports); n > 0; n-- {
+				batch = append(batch, <-a.reports)
+			}
+			forward()
+			close(done)
+		}
+	}
+}
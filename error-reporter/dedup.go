@@ -0,0 +1,100 @@
+package reporter
+
+import (
+	"sync"
+	"time"
+)
+
+// Dedup suppresses duplicates of reports, i.e. of the same level and
+// message, for window. When window is over, amount of suppressed
+// duplicates is reported with the error as "suppressed".
+type Dedup struct {
+	next   Reporter
+	window time.Duration
+	now    func() time.Time
+
+	mu   sync.Mutex
+	seen map[string]*seen
+}
+
+type seen struct {
+	report
+	reported   time.Time
+	suppressed int
+}
+
+// NewDedup returns reporter forwarding to next at most one of equal
+// reports per window.
+func NewDedup(next Reporter, window time.Duration) *Dedup {
+	return &Dedup{
+		next:   next,
+		window: window,
+		now:    time.Now,
+		seen:   map[string]*seen{},
+	}
+}
+
+// Report forwards err, unless it was reported within window.
+func (d *Dedup) Report(err error, level Level, extra map[string]interface{}) {
+	key := string(level) + ":" + err.Error()
+	now := d.now()
+
+	d.mu.Lock()
+	expired := d.expire(now)
+	s, ok := d.seen[key]
+	if ok {
+		s.suppressed++
+	} else {
+		d.seen[key] = &seen{report: report{err: err, level: level, extra: extra}, reported: now}
+	}
+	d.mu.Unlock()
+
+	d.summary(expired)
+	if !ok {
+		d.next.Report(err, level, extra)
+	}
+}
+
+// expire removes reports older than window and returns them, must
+// be called under lock.
+func (d *Dedup) expire(now time.Time) []*seen {
+	var expired []*seen
+	for key, s := range d.seen {
+		if now.Sub(s.reported) >= d.window {
+			delete(d.seen, key)
+			expired = append(expired, s)
+		}
+	}
+	return expired
+}
+
+// summary reports amount of suppressed duplicates of expired reports.
+func (d *Dedup) summary(expired []*seen) {
+	for _, s := range expired {
+		if s.suppressed == 0 {
+			continue
+		}
+		extra := make(map[string]interface{}, len(s.extra)+1)
+		for k, v := range s.extra {
+			extra[k] = v
+		}
+		extra["suppressed"] = s.suppressed
+		d.next.Report(s.err, s.level, extra)
+	}
+}
+
+// Flush reports suppressed duplicates and flushes next reporter.
+func (d *Dedup) Flush(timeout time.Duration) bool {
+	d.mu.Lock()
+	var pending []*seen
+	for _, s := range d.seen {
+		if s.suppressed > 0 {
+			pending = append(pending, s)
+		}
+		s.suppressed = 0
+	}
+	d.mu.Unlock()
+
+	d.summary(pending)
+	return d.next.Flush(timeout)
+}
@@ -0,0 +1,136 @@
+// Package reporter reports errors to monitoring. Reporters are
+// composed, e.g. errors are logged at once and sent to Sentry in
+// background with duplicates suppressed:
+//
+//	rep := reporter.Multi(
+//		reporter.NewLog(lg),
+//		reporter.NewDedup(reporter.NewAsync(reporter.NewSentry(sentry.CurrentHub()), 100, time.Second), time.Minute),
+//	)
+//
+// Reporters never exit the process, even on LevelFatal.
+package reporter
+
+import (
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	"go.uber.org/zap"
+)
+
+// Level is a severity of error, values match sentry.Level.
+type Level string
+
+// Levels of errors.
+const (
+	LevelDebug   Level = "debug"
+	LevelInfo    Level = "info"
+	LevelWarning Level = "warning"
+	LevelError   Level = "error"
+	LevelFatal   Level = "fatal"
+)
+
+// Reporter reports errors with extra details, e.g. ticker.
+type Reporter interface {
+	Report(err error, level Level, extra map[string]interface{})
+	// Flush waits until reported errors are sent, returns false
+	// if timeout is exceeded.
+	Flush(timeout time.Duration) bool
+}
+
+// Nop reports nothing.
+type Nop struct{}
+
+// Report does nothing.
+func (Nop) Report(error, Level, map[string]interface{}) {}
+
+// Flush returns true.
+func (Nop) Flush(time.Duration) bool { return true }
+
+// Log writes errors to zap logger.
+type Log struct {
+	lg *zap.Logger
+}
+
+// NewLog returns reporter writing to lg.
+func NewLog(lg *zap.Logger) *Log {
+	return &Log{lg: lg}
+}
+
+// Report writes err with level of logger, LevelFatal is logged as
+// error, as Log does not exit.
+func (l *Log) Report(err error, level Level, extra map[string]interface{}) {
+	fields := make([]zap.Field, 0, len(extra)+1)
+	fields = append(fields, zap.Error(err))
+	for k, v := range extra {
+		fields = append(fields, zap.Any(k, v))
+	}
+
+	switch level {
+	case LevelDebug:
+		l.lg.Debug("", fields...)
+	case LevelInfo:
+		l.lg.Info("", fields...)
+	case LevelWarning:
+		l.lg.Warn("", fields...)
+	default:
+		l.lg.Error("", fields...)
+	}
+}
+
+// Flush syncs logger.
+func (l *Log) Flush(time.Duration) bool {
+	return l.lg.Sync() == nil
+}
+
+// Sentry sends errors to Sentry hub.
+type Sentry struct {
+	hub *sentry.Hub
+}
+
+// NewSentry returns reporter sending to hub, e.g. sentry.CurrentHub().
+// Hub sends events in background, but it is better used with Async,
+// as capturing collects stacktrace.
+func NewSentry(hub *sentry.Hub) *Sentry {
+	return &Sentry{hub: hub}
+}
+
+// Report captures err with extra details.
+func (s *Sentry) Report(err error, level Level, extra map[string]interface{}) {
+	s.hub.WithScope(func(scope *sentry.Scope) {
+		for k, v := range extra {
+			scope.SetExtra(k, v)
+		}
+		scope.SetLevel(sentry.Level(level))
+		s.hub.CaptureException(err)
+	})
+}
+
+// Flush waits for events to be sent to Sentry.
+func (s *Sentry) Flush(timeout time.Duration) bool {
+	return s.hub.Flush(timeout)
+}
+
+// multi reports to all of reporters.
+type multi []Reporter
+
+// Multi returns reporter reporting to all of reporters in order.
+func Multi(reporters ...Reporter) Reporter {
+	return multi(reporters)
+}
+
+func (m multi) Report(err error, level Level, extra map[string]interface{}) {
+	for _, r := range m {
+		r.Report(err, level, extra)
+	}
+}
+
+func (m multi) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	ok := true
+	for _, r := range m {
+		if !r.Flush(time.Until(deadline)) {
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,130 @@
+package reporter
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// recorder remembers reports.
+type recorder struct {
+	mu      sync.Mutex
+	reports []report
+	flushed int
+}
+
+func (r *recorder) Report(err error, level Level, extra map[string]interface{}) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.reports = append(r.reports, report{err: err, level: level, extra: extra})
+}
+
+func (r *recorder) Flush(time.Duration) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flushed++
+	return true
+}
+
+func (r *recorder) len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.reports)
+}
+
+func TestLog(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	l := NewLog(zap.New(core))
+
+	l.Report(errors.New("db down"), LevelWarning, map[string]interface{}{"ticker": "AMZN"})
+	l.Report(errors.New("exit"), LevelFatal, nil)
+
+	entries := logs.AllUntimed()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(entries))
+	}
+	if entries[0].Level != zap.WarnLevel || entries[0].ContextMap()["ticker"] != "AMZN" {
+		t.Errorf("wrong entry: %+v", entries[0])
+	}
+	// fatal is logged without exit
+	if entries[1].Level != zap.ErrorLevel {
+		t.Errorf("fatal must be logged as error, got %s", entries[1].Level)
+	}
+}
+
+func TestAsync(t *testing.T) {
+	next := &recorder{}
+	a := NewAsync(next, 2, time.Hour)
+
+	// reports are forwarded by interval, flush or maxBatch,
+	// the ones exceeding buffer are dropped
+	total := maxBatch + 10
+	for i := 0; i < total; i++ {
+		a.Report(errors.New("a"), LevelError, nil)
+	}
+	if !a.Flush(time.Second) {
+		t.Fatalf("flush timeout")
+	}
+	if n := next.len(); n == 0 || n+int(a.Dropped()) != total {
+		t.Errorf("expected %d forwarded or dropped reports, got %d and %d", total, n, a.Dropped())
+	}
+	if next.flushed != 1 {
+		t.Errorf("next reporter is not flushed")
+	}
+}
+
+func TestDedup(t *testing.T) {
+	next := &recorder{}
+	d := NewDedup(next, time.Minute)
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	d.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		d.Report(errors.New("timeout"), LevelError, map[string]interface{}{"ticker": "AMZN"})
+	}
+	d.Report(errors.New("timeout"), LevelWarning, nil)
+	d.Report(errors.New("other"), LevelError, nil)
+	if next.len() != 3 {
+		t.Fatalf("expected 3 distinct reports, got %d", next.len())
+	}
+
+	// after window suppressed duplicates are reported with count
+	now = now.Add(time.Minute)
+	d.Report(errors.New("timeout"), LevelError, nil)
+
+	cases := []struct {
+		err        string
+		suppressed interface{}
+	}{
+		{"timeout", 2},
+		{"timeout", nil},
+	}
+	got := next.reports[3:]
+	if len(got) != len(cases) {
+		t.Fatalf("expected summary and new report, got %d", len(got))
+	}
+	for caseNum, item := range cases {
+		if got[caseNum].err.Error() != item.err || got[caseNum].extra["suppressed"] != item.suppressed {
+			t.Errorf("[%d] wrong report: %v %v", caseNum, got[caseNum].err, got[caseNum].extra)
+		}
+	}
+	if got[0].extra["ticker"] != "AMZN" {
+		t.Errorf("summary must keep extra of the first report")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	m := Multi(a, Nop{}, b)
+	m.Report(errors.New("x"), LevelError, nil)
+	if !m.Flush(time.Second) {
+		t.Errorf("flush failed")
+	}
+	if a.len() != 1 || b.len() != 1 || a.flushed != 1 || b.flushed != 1 {
+		t.Errorf("reports must go to all reporters")
+	}
+}
@@ -0,0 +1,36 @@
+// Package httputil has helpers of HTTP middleware of stock proxy,
+// e.g. logging, metrics and tracing of requests.
+package httputil
+
+import "net/http"
+
+// StatusWriter remembers code and size of response written through
+// it. Code is 200 unless WriteHeader is called.
+type StatusWriter struct {
+	http.ResponseWriter
+	Code  int
+	Bytes int
+}
+
+// NewStatusWriter returns StatusWriter of response w.
+func NewStatusWriter(w http.ResponseWriter) *StatusWriter {
+	return &StatusWriter{ResponseWriter: w, Code: http.StatusOK}
+}
+
+func (w *StatusWriter) WriteHeader(code int) {
+	w.Code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *StatusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.Bytes += n
+	return n, err
+}
+
+// Flush sends buffered data of streamed responses, e.g. ndjson.
+func (w *StatusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,25 @@
+package httputil
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestStatusWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := NewStatusWriter(rec)
+	w.Write([]byte("ok"))
+	if w.Code != http.StatusOK || w.Bytes != 2 {
+		t.Errorf("got %d %d, expected 200 2", w.Code, w.Bytes)
+	}
+
+	rec = httptest.NewRecorder()
+	w = NewStatusWriter(rec)
+	w.WriteHeader(http.StatusNotFound)
+	w.Write([]byte("{}\n"))
+	w.Flush()
+	if w.Code != http.StatusNotFound || rec.Code != http.StatusNotFound || w.Bytes != 3 || !rec.Flushed {
+		t.Errorf("wrong response %d %d, flushed %v", w.Code, w.Bytes, rec.Flushed)
+	}
+}
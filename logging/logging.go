@@ -0,0 +1,146 @@
+// Package logging logs HTTP requests and carries logger with request
+// ID in context of request, so that all log lines of a request can be
+// found by its X-Request-ID.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/adnilote/stock-proxy/internal/httputil"
+	"github.com/adnilote/stock-proxy/redact"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// HeaderRequestID is header of request ID, it is taken from request
+// or generated and returned in response.
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestID is max length of request ID accepted from client.
+const maxRequestID = 64
+
+type ctxKey int
+
+const (
+	loggerKey ctxKey = iota
+	requestIDKey
+	entryKey
+)
+
+// entry is access log line, which may be annotated by handler.
+type entry struct {
+	mu     sync.Mutex
+	fields []zap.Field
+}
+
+// WithLogger returns context carrying lg.
+func WithLogger(ctx context.Context, lg *zap.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, lg)
+}
+
+// FromContext returns logger of ctx, or lg if there is none.
+func FromContext(ctx context.Context, lg *zap.Logger) *zap.Logger {
+	if ctxLg, ok := ctx.Value(loggerKey).(*zap.Logger); ok {
+		return ctxLg
+	}
+	return lg
+}
+
+// RequestID returns ID of request in ctx, or empty string.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// Annotate adds fields to access log line of request in ctx, e.g. time
+// the request waited in queue. Fields added after request finished
+// are ignored.
+func Annotate(ctx context.Context, fields ...zap.Field) {
+	e, ok := ctx.Value(entryKey).(*entry)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	e.fields = append(e.fields, fields...)
+	e.mu.Unlock()
+}
+
+// Handler logs access line of requests to h and puts logger with
+// request ID into context of request.
+func Handler(lg *zap.Logger, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		reqLg := lg.With(zap.String("request_id", id))
+		if sc := trace.SpanContextFromContext(r.Context()); sc.IsValid() {
+			reqLg = reqLg.With(zap.String("trace_id", sc.TraceID().String()))
+		}
+		e := &entry{}
+		ctx := WithLogger(r.Context(), reqLg)
+		ctx = context.WithValue(ctx, requestIDKey, id)
+		ctx = context.WithValue(ctx, entryKey, e)
+
+		lw := httputil.NewStatusWriter(w)
+		h(lw, r.WithContext(ctx))
+
+		e.mu.Lock()
+		fields := append([]zap.Field{
+			zap.String("method", r.Method),
+			zap.String("path", r.URL.Path),
+			zap.String("params", Params(r.URL.Query())),
+			zap.Int("status", lw.Code),
+			zap.Int("bytes", lw.Bytes),
+			zap.Duration("latency", time.Since(start)),
+		}, e.fields...)
+		// later annotations are ignored
+		e.fields = nil
+		e.mu.Unlock()
+		reqLg.Info("access", fields...)
+	}
+}
+
+// Params returns encoded query without secret params, e.g. API key,
+// see redact.IsSecretParam.
+func Params(query url.Values) string {
+	clean := url.Values{}
+	for k, v := range redact.Query(query) {
+		if !redact.IsSecretParam(k) {
+			clean[k] = v
+		}
+	}
+	return clean.Encode()
+}
+
+// validRequestID returns true if id may be taken from client.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestID {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns random ID of 16 hex characters.
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,66 @@
+package logging
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHandler(t *testing.T) {
+	core, logs := observer.New(zap.DebugLevel)
+	h := Handler(zap.New(core), func(w http.ResponseWriter, r *http.Request) {
+		FromContext(r.Context(), nil).Debug("in handler")
+		Annotate(r.Context(), zap.Duration("queue_wait", time.Second))
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("OK"))
+	})
+
+	cases := []struct {
+		header string
+		keep   bool
+	}{
+		{"abc-123", true},
+		{"", false},
+		{"bad id\n", false},
+	}
+	for caseNum, item := range cases {
+		logs.TakeAll()
+		r := httptest.NewRequest("GET", "/sync/?symbol=amzn&apikey=SECRET", nil)
+		if item.header != "" {
+			r.Header.Set(HeaderRequestID, item.header)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		id := w.Header().Get(HeaderRequestID)
+		if !validRequestID(id) || (id == item.header) != item.keep {
+			t.Errorf("[%d] wrong request id %q", caseNum, id)
+		}
+		entries := logs.AllUntimed()
+		if len(entries) != 2 {
+			t.Fatalf("[%d] expected 2 log lines, got %d", caseNum, len(entries))
+		}
+		for _, e := range entries {
+			if e.ContextMap()["request_id"] != id {
+				t.Errorf("[%d] log line %q without request id", caseNum, e.Message)
+			}
+		}
+		access := entries[1].ContextMap()
+		if access["params"] != "symbol=amzn" || access["status"] != int64(http.StatusAccepted) ||
+			access["bytes"] != int64(2) || access["queue_wait"] != time.Second {
+			t.Errorf("[%d] wrong access line: %v", caseNum, access)
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	query := url.Values{"APIKEY": {"x"}, "apikey": {"y"}, "function": {"FX_DAILY"}}
+	if params := Params(query); params != "function=FX_DAILY" {
+		t.Errorf("secret params are not removed: %s", params)
+	}
+}
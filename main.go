@@ -1,97 +1,279 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/adnilote/stock-proxy/config"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/logging"
+	"github.com/adnilote/stock-proxy/metrics"
 	"github.com/adnilote/stock-proxy/proxy"
+	"github.com/adnilote/stock-proxy/redact"
+	"github.com/adnilote/stock-proxy/tracing"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
 
-	"github.com/getsentry/sentry-go"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 	"go.uber.org/zap"
-	mgo "gopkg.in/mgo.v2"
 )
 
-const (
-	// DSN sentry error monitoring
-	DSN string = "https://91d94d4b63c0459cba56427529cc9a09@sentry.io/1519981"
-)
+// indexTimeout limits creation of mongoDB indexes on start.
+const indexTimeout = 5 * time.Minute
 
 var lg *zap.Logger
 
-var addr = flag.String("listen-address", ":8082",
-								"The address to listen on for HTTP requests.")
-var dbaddr = flag.String("mongo-address", "mongo:27017", // mongo or 127.0.0.1
-	"The address to connect to mongo.")
-
 // NewLogger initiates zap.logger, which send log to logs/filename
-// and stdout
-func NewLogger(outputPath []string) (*zap.Logger, error) {
+// and stdout with level, which may be changed at runtime. Format is
+// "json" for production or "console" for development.
+func NewLogger(outputPath []string, level zap.AtomicLevel, format string) (*zap.Logger, error) {
 	for _, path := range outputPath {
-		if path != "stdout" {
+		if path != "stdout" && path != "stderr" {
 			os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
 		}
 	}
 
 	cfg := zap.NewDevelopmentConfig()
+	if format == "json" {
+		cfg = zap.NewProductionConfig()
+	}
 	cfg.OutputPaths = outputPath
-	return cfg.Build()
+	cfg.Level = level
+	return cfg.Build(zap.WrapCore(redact.Core))
+}
+
+// proxyOptions returns options of proxy from cfg.
+func proxyOptions(cfg *config.Config, m *metrics.Metrics) proxy.Options {
+	return proxy.Options{
+		APIKeys:         cfg.APIKeys,
+		RequestLimit:    cfg.RequestLimit,
+		MaxQueue:        cfg.MaxQueue,
+		ShutdownTimeout: cfg.ShutdownTimeout,
+		DBTimeout:       cfg.MongoTimeout,
+		Compression:     proxy.Compression(cfg.Compression),
+		Metrics:         m,
+		Reporter:        rep,
+	}
+}
+
+// instrument wraps handler h of endpoint by tracing, access log
+// with request ID and metrics.
+func instrument(endpoint string, h http.HandlerFunc, m *metrics.Metrics) http.HandlerFunc {
+	return tracing.Handler(endpoint, logging.Handler(lg, m.Handler(endpoint, h)))
+}
+
+// reloadOnSignal reloads config on SIGHUP and applies log level,
+// limits and API keys. Other options require restart.
+func reloadOnSignal(loader *config.Loader, cfg *config.Config, level zap.AtomicLevel,
+	handler *proxy.Proxy, m *metrics.Metrics) {
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		newCfg, err := loader.Load()
+		if err != nil {
+			CaptureError(err, reporter.LevelError)
+			continue
+		}
+
+		if err := level.UnmarshalText([]byte(newCfg.LogLevel)); err != nil {
+			CaptureError(err, reporter.LevelError)
+		}
+		if err := handler.Reload(proxyOptions(newCfg, m)); err != nil {
+			CaptureError(err, reporter.LevelError)
+			continue
+		}
+		if newCfg.ListenAddress != cfg.ListenAddress || newCfg.MongoAddress != cfg.MongoAddress ||
+			newCfg.MongoTimeout != cfg.MongoTimeout || newCfg.MongoMaxPool != cfg.MongoMaxPool ||
+			newCfg.SentryDSN != cfg.SentryDSN || newCfg.LogFormat != cfg.LogFormat || newCfg.Backfill != cfg.Backfill ||
+			newCfg.BackfillPeriod != cfg.BackfillPeriod || newCfg.AdminToken != cfg.AdminToken ||
+			newCfg.LimitStore != cfg.LimitStore || newCfg.Retention != cfg.Retention ||
+			newCfg.RetentionPeriod != cfg.RetentionPeriod || newCfg.Compression != cfg.Compression {
+			lg.Warn("Changed addresses, mongo, sentry, log format, backfill, admin token, limit store, retention and compression options require restart")
+		}
+		lg.Info("Reload config", zap.String("log_level", newCfg.LogLevel))
+	}
+}
+
+// connect returns client of mongoDB of cfg.
+func connect(cfg *config.Config) (*mongo.Client, error) {
+	return mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://"+cfg.MongoAddress).
+		SetMaxPoolSize(uint64(cfg.MongoMaxPool)).
+		SetConnectTimeout(cfg.MongoTimeout).
+		SetServerSelectionTimeout(cfg.MongoTimeout))
+}
+
+// limitStore returns LimitStore of cfg, API key budget is shared
+// with other replicas by limit_store: mongo. Nil is memory of proxy.
+func limitStore(cfg *config.Config, db *mongo.Database) proxy.LimitStore {
+	if cfg.LimitStore == "mongo" {
+		return proxy.NewMongoLimitStore(db.Collection("api_calls"), db.Collection("leases"), cfg.MongoTimeout)
+	}
+	return nil
 }
 
 func main() {
-	flag.Parse()
+	// server is run without command, e.g. stock-proxy -config ...
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage(os.Stdout)
+		return
+	}
+	cmd, ok := commands[name]
+	if !ok {
+		usage(os.Stderr)
+		os.Exit(2)
+	}
+	cmd.run(args)
+}
+
+// runServe runs proxy server until SIGINT or SIGTERM.
+func runServe(args []string) {
+	// load config from file, environment and flags
+	loader := config.NewLoader(args)
+	cfg, err := loader.Load()
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatalf("config loading failed, error: %v.", err)
+	}
 
 	// init zap logger
-	var err error
+	level := zap.NewAtomicLevel()
+	level.UnmarshalText([]byte(cfg.LogLevel))
 	lg, err = NewLogger([]string{
 		"proxy.log",
 		"stdout",
-	})
+	}, level, cfg.LogFormat)
 	if err != nil {
-		CaptureError(err, sentry.LevelFatal)
 		log.Fatalf("zap.NewDevelopment() failed, error: %v.", err)
 	}
 
 	// init sentry for errors
-	ConfigureSentry(DSN)
+	rep = ConfigureSentry(cfg.SentryDSN, lg)
+
+	// export traces
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.TraceEndpoint, "stock-proxy")
+	if err != nil {
+		CaptureError(err, reporter.LevelFatal)
+	}
 
 	// register monitoring
-	reqLeft := prometheus.NewGauge(
-		prometheus.GaugeOpts{
-			Name: "requests_left"})
-	prometheus.MustRegister(reqLeft)
+	m := metrics.New()
+	if err := m.Register(prometheus.DefaultRegisterer); err != nil {
+		CaptureError(err, reporter.LevelFatal)
+	}
 
-	// connect to db
-	sess, err := mgo.Dial("mongodb://" + *dbaddr)
+	// connect to db, driver keeps pool of connections
+	client, err := connect(cfg)
 	if err != nil {
-		CaptureError(err, sentry.LevelFatal)
+		CaptureError(err, reporter.LevelFatal)
 	}
+	db := client.Database("av")
 
-	collection := sess.DB("av").C("timeseries")
+	// index builds of large collections take longer than operations
+	ctx, cancel := context.WithTimeout(context.Background(), indexTimeout)
+	if err := proxy.EnsureIndexes(ctx, db); err != nil {
+		CaptureError(err, reporter.LevelFatal)
+	}
+	cancel()
 
 	// get amount of records in db
-	n, err := collection.Count()
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.MongoTimeout)
+	n, err := db.Collection("timeseries").EstimatedDocumentCount(ctx)
+	cancel()
+	if err != nil {
+		CaptureError(err, reporter.LevelError)
+	}
+	lg.Info("Start db", zap.Int64("collection_count", n))
+
+	// handler, API key budget is shared with other replicas by
+	// limit_store: mongo
+	opts := proxyOptions(cfg, m)
+	opts.LimitStore = limitStore(cfg, db)
+	handler, err := proxy.NewProxy(db, lg, opts)
+	if err != nil {
+		CaptureError(err, reporter.LevelFatal)
+	}
+	go reloadOnSignal(loader, cfg, level, handler, m)
+	http.HandleFunc("/sync/", instrument("sync", handler.GetOHLCVSync, m))
+	http.HandleFunc("/async/", instrument("async", handler.GetOHLCVAsync, m))
+	http.HandleFunc("/history/", instrument("history", handler.GetHistory, m))
+	http.HandleFunc("/batch/", instrument("batch", handler.GetBatch, m))
+	if cfg.AdminToken != "" {
+		redact.SetSecrets(cfg.AdminToken)
+		http.HandleFunc("/admin/", instrument("admin", handler.Admin(cfg.AdminToken), m))
+	}
+
+	// backfill of gaps in stored history
+	targets, err := proxy.ParseBackfillTargets(cfg.Backfill)
 	if err != nil {
-		CaptureError(err, sentry.LevelError)
+		CaptureError(err, reporter.LevelFatal)
 	}
-	lg.Info("Start db", zap.Int("collection_count", n))
+	bf := proxy.NewBackfill(handler, calendar.New(), targets)
+	stopJobs := make(chan struct{})
+	go bf.Run(cfg.BackfillPeriod, stopJobs)
 
-	// handler
-	handler, err := proxy.NewProxy(collection, lg, reqLeft)
+	// compaction of stored history by retention rules
+	rules, err := proxy.ParseRetention(cfg.Retention)
 	if err != nil {
-		CaptureError(err, sentry.LevelFatal)
+		CaptureError(err, reporter.LevelFatal)
 	}
-	http.HandleFunc("/sync/", handler.GetOHLCVSync)
-	http.HandleFunc("/async/", handler.GetOHLCVAsync)
-	http.HandleFunc("/history/", handler.GetHistory)
-	http.Handle("/health", promhttp.Handler())
+	go proxy.NewRetention(handler, rules).Run(cfg.RetentionPeriod, stopJobs)
+	// responses stored by other compression, e.g. uncompressed ones
+	go handler.MigratePayloads(context.Background())
+	http.HandleFunc("/gaps/", instrument("gaps", bf.GetGaps, m))
+	http.HandleFunc("/healthz", handler.GetHealth)
+	http.HandleFunc("/readyz", handler.GetReady)
+	http.Handle("/metrics", promhttp.Handler())
 
-	lg.Info("starting server at :8082")
+	server := &http.Server{Addr: cfg.ListenAddress}
+	go func() {
+		lg.Info("starting server at " + cfg.ListenAddress)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			CaptureError(err, reporter.LevelFatal)
+		}
+	}()
+
+	// graceful shutdown
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	lg.Info("Shutdown", zap.Stringer("signal", <-sig))
+	close(stopJobs)
+
+	// stop accepting connections while proxy finishes queued tasks,
+	// blocked sync clients are answered by proxy
+	ctx, cancel = context.WithTimeout(context.Background(), cfg.ShutdownTimeout+time.Minute)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+	if err := handler.Close(); err != nil {
+		CaptureError(err, reporter.LevelError)
+	}
+	if err := <-shutdown; err != nil {
+		CaptureError(err, reporter.LevelError)
+	}
 
-	if http.ListenAndServe(*addr, nil) != nil { //192.168.1.254
-		CaptureError(err, sentry.LevelFatal)
+	if err := client.Disconnect(ctx); err != nil {
+		CaptureError(err, reporter.LevelError)
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		CaptureError(err, reporter.LevelError)
 	}
+	rep.Flush(5 * time.Second)
+	lg.Sync()
 }
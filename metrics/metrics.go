@@ -0,0 +1,222 @@
+// Package metrics defines Prometheus metrics of stock proxy pipeline:
+// client requests, queue, workers, Alpha Vantage calls, mongoDB
+// operations and API key budget.
+package metrics
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	"github.com/adnilote/stock-proxy/internal/httputil"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Ticker classes of requests, see TickerClass.
+const (
+	ClassEquity  = "equity"
+	ClassFX      = "fx"
+	ClassCrypto  = "crypto"
+	ClassSearch  = "search"
+	ClassUnknown = "unknown"
+)
+
+// Metrics of proxy. Zero value is not usable, see New.
+type Metrics struct {
+	// Requests counts client requests by endpoint, code, function
+	// and ticker class
+	Requests *prometheus.CounterVec
+	// RequestDuration is end-to-end latency of client requests
+	RequestDuration *prometheus.HistogramVec
+	// UpstreamDuration is latency of Alpha Vantage requests by
+	// function and code
+	UpstreamDuration *prometheus.HistogramVec
+	// QueueWait is time tasks wait for worker
+	QueueWait prometheus.Histogram
+	// QueueDepth is amount of queued tasks
+	QueueDepth prometheus.Gauge
+	// Workers is amount of running workers, WorkersBusy of those
+	// processing task
+	Workers     prometheus.Gauge
+	WorkersBusy prometheus.Gauge
+	// MongoDuration is latency of mongoDB operations by operation
+	// and result
+	MongoDuration *prometheus.HistogramVec
+	// Abandoned counts sync requests dropped or cancelled because
+	// client disconnected
+	Abandoned prometheus.Counter
+
+	budget *budgetCollector
+}
+
+// New returns unregistered metrics.
+func New() *Metrics {
+	return &Metrics{
+		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Client requests by endpoint, code, function and ticker class.",
+		}, []string{"endpoint", "code", "function", "ticker_class"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "End-to-end latency of client requests.",
+			Buckets: []float64{.005, .05, .5, 1, 5, 15, 30, 60, 120, 300},
+		}, []string{"endpoint", "function"}),
+		UpstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "upstream_request_duration_seconds",
+			Help:    "Latency of Alpha Vantage requests.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"function", "code"}),
+		QueueWait: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "queue_wait_seconds",
+			Help:    "Time tasks wait in queue for worker.",
+			Buckets: []float64{.01, .1, 1, 5, 15, 30, 60, 120, 300},
+		}),
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "queue_depth",
+			Help: "Amount of queued tasks.",
+		}),
+		Workers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "workers",
+			Help: "Amount of running workers.",
+		}),
+		WorkersBusy: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "workers_busy",
+			Help: "Amount of workers processing task.",
+		}),
+		MongoDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mongo_operation_duration_seconds",
+			Help:    "Latency of mongoDB operations.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"operation", "result"}),
+		Abandoned: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "requests_abandoned_total",
+			Help: "Sync requests dropped or cancelled as client disconnected.",
+		}),
+		budget: &budgetCollector{
+			left: prometheus.NewDesc("requests_left",
+				"Requests left in the current minute over all API keys.", nil, nil),
+			keyLeft: prometheus.NewDesc("api_key_requests_left",
+				"Requests left in the current minute by API key.", []string{"key"}, nil),
+		},
+	}
+}
+
+// Register registers all metrics in r.
+func (m *Metrics) Register(r prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.Requests, m.RequestDuration, m.UpstreamDuration, m.QueueWait,
+		m.QueueDepth, m.Workers, m.WorkersBusy, m.MongoDuration,
+		m.Abandoned, m.budget,
+	} {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetBudget sets source of API key budget, which is called on scrape.
+// It returns requests left by key, keys must not be secret.
+func (m *Metrics) SetBudget(source func() map[string]int) {
+	m.budget.mu.Lock()
+	defer m.budget.mu.Unlock()
+	m.budget.source = source
+}
+
+// ObserveMongo observes latency of mongoDB operation started at start.
+// Nil metrics observe nothing, so that stores may be used without them.
+func (m *Metrics) ObserveMongo(operation string, start time.Time, err error) {
+	if m == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	m.MongoDuration.WithLabelValues(operation, result).Observe(time.Since(start).Seconds())
+}
+
+// ObserveUpstream observes latency of Alpha Vantage request started
+// at start, code is 0 for failed request.
+func (m *Metrics) ObserveUpstream(function string, code int, start time.Time) {
+	m.UpstreamDuration.WithLabelValues(function, strconv.Itoa(code)).Observe(time.Since(start).Seconds())
+}
+
+// Handler counts requests of h and observes their latency. Labels
+// of function are limited to registered ones.
+func (m *Metrics) Handler(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := httputil.NewStatusWriter(w)
+		h(sw, r)
+
+		function, class := "", ClassUnknown
+		if name := r.URL.Query().Get(av.QueryFunction); name != "" {
+			function = "unknown"
+			if fn, ok := av.LookupFunction(name); ok {
+				function, class = fn.Name, TickerClass(fn)
+			}
+		}
+		m.Requests.WithLabelValues(endpoint, strconv.Itoa(sw.Code), function, class).Inc()
+		m.RequestDuration.WithLabelValues(endpoint, function).Observe(time.Since(start).Seconds())
+	}
+}
+
+// TickerClass returns class of tickers requested by fn, e.g.
+// ClassFX for FX_DAILY.
+func TickerClass(fn *av.Function) string {
+	switch fn.Shape {
+	case av.ShapeDigitalCurrency:
+		return ClassCrypto
+	case av.ShapeSearch:
+		return ClassSearch
+	case av.ShapeExchangeRate:
+		return ClassFX
+	}
+	for _, param := range fn.Required {
+		if param == av.QueryFromSymbol {
+			return ClassFX
+		}
+	}
+	return ClassEquity
+}
+
+// budgetCollector collects API key budget on scrape, as it recovers
+// with time without any event.
+type budgetCollector struct {
+	mu      sync.Mutex
+	source  func() map[string]int
+	left    *prometheus.Desc
+	keyLeft *prometheus.Desc
+}
+
+func (c *budgetCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.left
+	ch <- c.keyLeft
+}
+
+func (c *budgetCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	source := c.source
+	c.mu.Unlock()
+	if source == nil {
+		return
+	}
+
+	budget := source()
+	keys := make([]string, 0, len(budget))
+	for key := range budget {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	total := 0
+	for _, key := range keys {
+		total += budget[key]
+		ch <- prometheus.MustNewConstMetric(c.keyLeft, prometheus.GaugeValue, float64(budget[key]), key)
+	}
+	ch <- prometheus.MustNewConstMetric(c.left, prometheus.GaugeValue, float64(total))
+}
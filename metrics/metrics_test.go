@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTickerClass(t *testing.T) {
+	cases := []struct {
+		function string
+		class    string
+	}{
+		{"TIME_SERIES_INTRADAY", ClassEquity},
+		{"GLOBAL_QUOTE", ClassEquity},
+		{"FX_DAILY", ClassFX},
+		{"CURRENCY_EXCHANGE_RATE", ClassFX},
+		{"DIGITAL_CURRENCY_DAILY", ClassCrypto},
+		{"SYMBOL_SEARCH", ClassSearch},
+	}
+	for caseNum, item := range cases {
+		fn, _ := av.LookupFunction(item.function)
+		if class := TickerClass(fn); class != item.class {
+			t.Errorf("[%d] wrong class of %s: got %s, expected %s", caseNum, item.function, class, item.class)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	m := New()
+	h := m.Handler("sync", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("symbol") == "" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	})
+
+	cases := []struct {
+		url    string
+		labels []string
+	}{
+		{"/sync/?function=time_series_daily&symbol=amzn", []string{"sync", "200", "TIME_SERIES_DAILY", ClassEquity}},
+		{"/sync/?function=FX_DAILY", []string{"sync", "400", "FX_DAILY", ClassFX}},
+		// unknown functions do not add labels
+		{"/sync/?function=HACK_1&symbol=amzn", []string{"sync", "200", "unknown", ClassUnknown}},
+		{"/sync/?function=HACK_2&symbol=amzn", []string{"sync", "200", "unknown", ClassUnknown}},
+	}
+	for _, item := range cases {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", item.url, nil))
+	}
+	for caseNum, item := range cases[:2] {
+		if n := testutil.ToFloat64(m.Requests.WithLabelValues(item.labels...)); n != 1 {
+			t.Errorf("[%d] expected 1 request %v, got %v", caseNum, item.labels, n)
+		}
+	}
+	if n := testutil.ToFloat64(m.Requests.WithLabelValues(cases[2].labels...)); n != 2 {
+		t.Errorf("expected 2 unknown requests, got %v", n)
+	}
+}
+
+func TestBudget(t *testing.T) {
+	m := New()
+	reg := prometheus.NewRegistry()
+	if err := m.Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	if n := testutil.CollectAndCount(m.budget); n != 0 {
+		t.Errorf("expected no budget without source, got %d", n)
+	}
+
+	m.SetBudget(func() map[string]int { return map[string]int{"****AAAA": 2, "****BBBB": 3} })
+	if n := testutil.CollectAndCount(m.budget, "api_key_requests_left"); n != 2 {
+		t.Errorf("expected budget of 2 keys, got %d", n)
+	}
+	if n := testutil.CollectAndCount(m.budget, "requests_left"); n != 1 {
+		t.Errorf("expected total budget, got %d", n)
+	}
+}
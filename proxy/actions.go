@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/adnilote/stock-proxy/metrics"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// CorporateAction is a dividend or split of a stock on ex-date Time.
+type CorporateAction struct {
+	Ticker string    `json:"ticker" bson:"ticker"`
+	Time   time.Time `json:"time" bson:"time"`
+	// Dividend amount per share
+	Dividend float64 `json:"dividend" bson:"dividend"`
+	// Split coefficient, 1 if there was no split
+	Split float64 `json:"split" bson:"split"`
+	// PrevClose is close price of the trading day before Time
+	PrevClose float64 `json:"prev_close" bson:"prev_close"`
+}
+
+// factor returns price multiplier for bars before the action
+func (a *CorporateAction) factor() float64 {
+	f := 1.0
+	if a.Split != 0 {
+		f /= a.Split
+	}
+	if a.Dividend != 0 && a.PrevClose != 0 {
+		f *= 1 - a.Dividend/a.PrevClose
+	}
+	return f
+}
+
+// corporateActions returns dividends and splits found in values of
+// adjusted time series, values must be sorted by date. Close before
+// the first value is looked up by prevClose, dividends without close
+// of the day before are skipped, as their factor is unknown.
+func corporateActions(ticker string, values []*TimeSeriesAdjustedValue,
+	prevClose func(t time.Time) (float64, bool)) []CorporateAction {
+
+	actions := []CorporateAction{}
+	for i, v := range values {
+		if v.DividendAmount == 0 && v.SplitCoefficient == 1 {
+			continue
+		}
+		action := CorporateAction{
+			Ticker:   strings.ToUpper(ticker),
+			Time:     v.Time,
+			Dividend: v.DividendAmount,
+			Split:    v.SplitCoefficient,
+		}
+		if i > 0 {
+			action.PrevClose = values[i-1].Close
+		} else if close, ok := prevClose(v.Time); ok {
+			action.PrevClose = close
+		}
+		if action.Dividend != 0 && action.PrevClose == 0 {
+			continue
+		}
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// BackAdjust returns copy of unadjusted values (e.g. intraday bars)
+// adjusted for splits and dividends in actions, so that prices are
+// comparable to the latest ones. Volume is adjusted only for splits.
+func BackAdjust(values []*TimeSeriesValue, actions []CorporateAction) []*TimeSeriesValue {
+	actions = append([]CorporateAction{}, actions...)
+	sort.Slice(actions, func(i, j int) bool { return actions[i].Time.Before(actions[j].Time) })
+
+	adjusted := make([]*TimeSeriesValue, 0, len(values))
+	for _, v := range values {
+		price, volume := 1.0, 1.0
+		for i := len(actions) - 1; i >= 0 && v.Time.Before(actions[i].Time); i-- {
+			price *= actions[i].factor()
+			if actions[i].Split != 0 {
+				volume *= actions[i].Split
+			}
+		}
+		adjusted = append(adjusted, &TimeSeriesValue{
+			Time:   v.Time,
+			Open:   v.Open * price,
+			High:   v.High * price,
+			Low:    v.Low * price,
+			Close:  v.Close * price,
+			Volume: v.Volume * volume,
+		})
+	}
+	return adjusted
+}
+
+// ActionsDB is a store of corporate actions in mongoDB.
+type ActionsDB struct {
+	db      *mongo.Collection
+	metrics *metrics.Metrics
+	timeout time.Duration
+}
+
+// Add stores actions, replacing already stored ones of the same
+// ticker and date.
+func (a *ActionsDB) Add(ctx context.Context, actions []CorporateAction) error {
+	ctx, cancel := dbContext(ctx, a.timeout)
+	defer cancel()
+
+	start := time.Now()
+	for _, action := range actions {
+		action.Ticker = strings.ToUpper(action.Ticker)
+		_, err := a.db.ReplaceOne(ctx, bson.M{
+			"ticker": action.Ticker,
+			"time":   action.Time,
+		}, action, options.Replace().SetUpsert(true))
+		if err != nil {
+			a.metrics.ObserveMongo("add_actions", start, err)
+			return err
+		}
+	}
+	a.metrics.ObserveMongo("add_actions", start, nil)
+	return nil
+}
+
+// Get returns actions of ticker sorted by date.
+func (a *ActionsDB) Get(ctx context.Context, ticker string) ([]CorporateAction, error) {
+	ctx, cancel := dbContext(ctx, a.timeout)
+	defer cancel()
+
+	start := time.Now()
+	actions := []CorporateAction{}
+	cur, err := a.db.Find(ctx, bson.M{"ticker": strings.ToUpper(ticker)},
+		options.Find().SetSort(bson.D{{Key: "time", Value: 1}}))
+	if err == nil {
+		err = cur.All(ctx, &actions)
+	}
+	a.metrics.ObserveMongo("get_actions", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// TimeSeriesAdjustedValue is a piece of data for a given time about
+// stock prices of adjusted time series, i.e. TimeSeriesDailyAdjusted,
+// TimeSeriesWeeklyAdjusted and TimeSeriesMonthlyAdjusted.
+type TimeSeriesAdjustedValue struct {
+	TimeSeriesValue
+	AdjustedClose  float64
+	DividendAmount float64
+	// SplitCoefficient is 1 if there was no split, weekly and
+	// monthly series have no split coefficient at all.
+	SplitCoefficient float64
+}
+
+// sortTimeSeriesAdjustedValuesByDate allows TimeSeriesAdjustedValue
+// slices to be sorted by date in ascending order
+type sortTimeSeriesAdjustedValuesByDate []*TimeSeriesAdjustedValue
+
+func (b sortTimeSeriesAdjustedValuesByDate) Len() int { return len(b) }
+func (b sortTimeSeriesAdjustedValuesByDate) Less(i, j int) bool {
+	return b[i].Time.Before(b[j].Time)
+}
+func (b sortTimeSeriesAdjustedValuesByDate) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+
+// isAdjusted returns true if t has adjusted close, dividends and splits
+func (t TimeSeries) isAdjusted() bool {
+	switch t {
+	case TimeSeriesDailyAdjusted, TimeSeriesWeeklyAdjusted, TimeSeriesMonthlyAdjusted:
+		return true
+	}
+	return false
+}
+
+// parseTimeSeriesAdjustedData will parse csv data of adjusted time
+// series from a reader
+func parseTimeSeriesAdjustedData(r io.Reader) ([]*TimeSeriesAdjustedValue, error) {
+
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true // optimization
+	reader.LazyQuotes = true
+	reader.TrailingComma = true
+	reader.TrimLeadingSpace = true
+	reader.FieldsPerRecord = -1
+
+	// strip header
+	if _, err := reader.Read(); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	values := make([]*TimeSeriesAdjustedValue, 0, 64)
+
+	for {
+		record, err := reader.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+		value, err := parseTimeSeriesAdjustedRecord(record)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	// sort values by date
+	sort.Sort(sortTimeSeriesAdjustedValuesByDate(values))
+
+	return values, nil
+}
+
+// parseTimeSeriesAdjustedRecord will parse an individual csv record
+// of adjusted time series
+func parseTimeSeriesAdjustedRecord(s []string) (*TimeSeriesAdjustedValue, error) {
+	// these are the expected columns in the csv record
+	const (
+		timestamp = iota
+		open
+		high
+		low
+		close
+		adjustedClose
+		volume
+		dividendAmount
+		splitCoefficient
+	)
+
+	if len(s) < splitCoefficient {
+		return nil, errors.Errorf("expected at least %d columns, got %d", splitCoefficient, len(s))
+	}
+
+	// reuse parseTimeSeriesRecord for the columns it knows
+	value, err := parseTimeSeriesRecord([]string{
+		s[timestamp], s[open], s[high], s[low], s[close], s[volume],
+	})
+	if err != nil {
+		return nil, err
+	}
+	adjusted := &TimeSeriesAdjustedValue{
+		TimeSeriesValue:  *value,
+		SplitCoefficient: 1,
+	}
+
+	f, err := parseFloat(s[adjustedClose])
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing adjusted close %s", s[adjustedClose])
+	}
+	adjusted.AdjustedClose = f
+
+	f, err = parseFloat(s[dividendAmount])
+	if err != nil {
+		return nil, errors.Wrapf(err, "error parsing dividend amount %s", s[dividendAmount])
+	}
+	adjusted.DividendAmount = f
+
+	if len(s) > splitCoefficient {
+		f, err = parseFloat(s[splitCoefficient])
+		if err != nil {
+			return nil, errors.Wrapf(err, "error parsing split coefficient %s", s[splitCoefficient])
+		}
+		adjusted.SplitCoefficient = f
+	}
+
+	return adjusted, nil
+}
+
+// parseTimeSeriesAdjustedJSON will parse json response of adjusted
+// time series, dataKey is the key of series in response,
+// e.g. "Time Series (Daily)".
+func parseTimeSeriesAdjustedJSON(body []byte, dataKey string) ([]*TimeSeriesAdjustedValue, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "error parsing response")
+	}
+	var series map[string]map[string]string
+	if err := json.Unmarshal(resp[dataKey], &series); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", dataKey)
+	}
+
+	values := make([]*TimeSeriesAdjustedValue, 0, len(series))
+	for date, fields := range series {
+		// strip numbering, i.e. "5. adjusted close" -> "adjusted close"
+		columns := map[string]string{}
+		for k, v := range fields {
+			if i := strings.Index(k, ". "); i >= 0 {
+				k = k[i+2:]
+			}
+			columns[k] = v
+		}
+
+		split := columns["split coefficient"]
+		if split == "" {
+			split = "1"
+		}
+		value, err := parseTimeSeriesAdjustedRecord([]string{
+			date,
+			columns["open"],
+			columns["high"],
+			columns["low"],
+			columns["close"],
+			columns["adjusted close"],
+			columns["volume"],
+			columns["dividend amount"],
+			split,
+		})
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	sort.Sort(sortTimeSeriesAdjustedValuesByDate(values))
+
+	return values, nil
+}
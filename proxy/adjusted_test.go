@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+const adjustedCSV = `timestamp,open,high,low,close,adjusted_close,volume,dividend_amount,split_coefficient
+2019-08-05,100.0,110.0,90.0,100.0,50.0,1000,0.0000,2.0
+2019-08-02,190.0,210.0,180.0,200.0,98.0,500,0.0000,1.0
+2019-08-01,180.0,200.0,170.0,200.0,97.0,400,4.0000,1.0
+2019-07-31,170.0,190.0,160.0,200.0,95.0,300,0.0000,1.0
+`
+
+const adjustedJSON = `{
+	"Meta Data": {"1. Information": "Weekly Adjusted Prices and Volumes"},
+	"Weekly Adjusted Time Series": {
+		"2019-08-02": {
+			"1. open": "1.0",
+			"2. high": "2.0",
+			"3. low": "0.5",
+			"4. close": "1.5",
+			"5. adjusted close": "1.4",
+			"6. volume": "100",
+			"7. dividend amount": "0.1000"
+		},
+		"2019-07-26": {
+			"1. open": "1.0",
+			"2. high": "2.0",
+			"3. low": "0.5",
+			"4. close": "1.5",
+			"5. adjusted close": "1.3",
+			"6. volume": "100",
+			"7. dividend amount": "0.0000"
+		}
+	}
+}`
+
+func TestParseTimeSeriesAdjusted(t *testing.T) {
+	values, err := parseTimeSeriesAdjustedData(strings.NewReader(adjustedCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 4 {
+		t.Fatalf("expected 4 values, got %d", len(values))
+	}
+	last := values[3]
+	if last.AdjustedClose != 50 || last.SplitCoefficient != 2 || last.Volume != 1000 {
+		t.Errorf("wrong last value: %+v", last)
+	}
+	if values[1].DividendAmount != 4 {
+		t.Errorf("wrong dividend: got %f, expected 4", values[1].DividendAmount)
+	}
+
+	values, err = parseTimeSeriesAdjustedJSON([]byte(adjustedJSON), "Weekly Adjusted Time Series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected 2 values, got %d", len(values))
+	}
+	if !values[0].Time.Before(values[1].Time) {
+		t.Errorf("values are not sorted by date")
+	}
+	if values[1].DividendAmount != 0.1 || values[1].SplitCoefficient != 1 || values[1].AdjustedClose != 1.4 {
+		t.Errorf("wrong last value: %+v", values[1])
+	}
+}
+
+func TestBackAdjust(t *testing.T) {
+	values, err := parseTimeSeriesAdjustedData(strings.NewReader(adjustedCSV))
+	if err != nil {
+		t.Fatal(err)
+	}
+	actions := corporateActions("amzn", values, noClose)
+	if len(actions) != 2 {
+		t.Fatalf("expected 2 actions, got %d", len(actions))
+	}
+	if actions[0].PrevClose != 200 || actions[0].Ticker != "AMZN" {
+		t.Errorf("wrong action: %+v", actions[0])
+	}
+
+	at := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02 15:04:05", s)
+		return d
+	}
+	intraday := []*TimeSeriesValue{
+		{Time: at("2019-07-31 15:59:00"), Close: 200, Volume: 10},
+		{Time: at("2019-08-02 15:59:00"), Close: 200, Volume: 10},
+		{Time: at("2019-08-05 09:30:00"), Close: 100, Volume: 10},
+	}
+	cases := []struct {
+		close, volume float64
+	}{
+		{close: 200 * 0.98 / 2, volume: 20},
+		{close: 100, volume: 20},
+		{close: 100, volume: 10},
+	}
+
+	adjusted := BackAdjust(intraday, actions)
+	for i, cs := range cases {
+		if math.Abs(adjusted[i].Close-cs.close) > 1e-9 || adjusted[i].Volume != cs.volume {
+			t.Errorf("[%d] got close %f volume %f, expected %f %f",
+				i, adjusted[i].Close, adjusted[i].Volume, cs.close, cs.volume)
+		}
+	}
+	if intraday[0].Close != 200 {
+		t.Errorf("BackAdjust must not modify values")
+	}
+}
+
+// noClose is prevClose of ticker without stored daily bars
+func noClose(time.Time) (float64, bool) { return 0, false }
+
+// TestCorporateActionsPrevClose checks that close before the oldest
+// dividend is looked up, and the dividend is skipped if it is unknown.
+func TestCorporateActionsPrevClose(t *testing.T) {
+	const csv = `timestamp,open,high,low,close,adjusted_close,volume,dividend_amount,split_coefficient
+2019-08-05,100.0,110.0,90.0,100.0,50.0,1000,0.0000,2.0
+2019-08-01,180.0,200.0,170.0,200.0,97.0,400,4.0000,1.0
+`
+	values, err := parseTimeSeriesAdjustedData(strings.NewReader(csv))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actions := corporateActions("amzn", values, noClose)
+	if len(actions) != 1 || actions[0].Split != 2 {
+		t.Errorf("dividend without close before it must be skipped: %+v", actions)
+	}
+
+	var asked time.Time
+	prevClose := func(t time.Time) (float64, bool) {
+		asked = t
+		return 250, true
+	}
+	actions = corporateActions("amzn", values, prevClose)
+	if len(actions) != 2 || actions[0].PrevClose != 250 || !asked.Equal(values[0].Time) {
+		t.Fatalf("wrong actions %+v", actions)
+	}
+	if f := actions[0].factor(); math.Abs(f-(1-4.0/250)) > 1e-9 {
+		t.Errorf("wrong factor %f", f)
+	}
+}
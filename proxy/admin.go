@@ -0,0 +1,314 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/logging"
+	"go.uber.org/zap"
+)
+
+// adminPrefix is path of admin API.
+const adminPrefix = "/admin/"
+
+// TaskInfo describes queued or in-flight task in admin API.
+type TaskInfo struct {
+	ID       string `json:"id"`
+	Ticker   string `json:"ticker"`
+	Function string `json:"function"`
+	// URL of Alpha Vantage request without API key
+	URL      string  `json:"url"`
+	Age      float64 `json:"age_seconds"`
+	Client   string  `json:"client"`
+	Sync     bool    `json:"sync"`
+	Priority int     `json:"priority"`
+}
+
+// Tasks is a snapshot of queued and in-flight tasks. Queued tasks
+// are in order they go to workers.
+type Tasks struct {
+	Paused   bool       `json:"paused"`
+	Queued   []TaskInfo `json:"queued"`
+	InFlight []TaskInfo `json:"in_flight"`
+}
+
+// Tasks returns snapshot of queued and in-flight tasks.
+func (p *Proxy) Tasks() Tasks {
+	now := time.Now()
+	tasks := Tasks{
+		Paused:   p.queue.isPaused(),
+		Queued:   []TaskInfo{},
+		InFlight: []TaskInfo{},
+	}
+	p.queue.each(func(task *Task) {
+		tasks.Queued = append(tasks.Queued, p.taskInfo(task, now))
+	})
+
+	p.mu.Lock()
+	for _, task := range p.inflight {
+		tasks.InFlight = append(tasks.InFlight, p.taskInfo(task, now))
+	}
+	p.mu.Unlock()
+	// the oldest first
+	sort.Slice(tasks.InFlight, func(i, j int) bool { return tasks.InFlight[i].Age > tasks.InFlight[j].Age })
+	return tasks
+}
+
+// taskInfo describes task, must be called under lock of queue for
+// queued task, as its priority may change.
+func (p *Proxy) taskInfo(task *Task, now time.Time) TaskInfo {
+	return TaskInfo{
+		ID:       task.id,
+		Ticker:   task.key,
+		Function: task.fn.Name,
+		URL:      p.publicURL(task.query),
+		Age:      now.Sub(task.queued).Seconds(),
+		Client:   task.client,
+		Sync:     task.sendClient,
+		Priority: task.priority,
+	}
+}
+
+// publicURL returns URL of Alpha Vantage request without API key.
+func (p *Proxy) publicURL(query url.Values) string {
+	u, err := url.Parse(p.av.URLWithKey(query, ""))
+	if err != nil {
+		return ""
+	}
+	values := u.Query()
+	values.Del(av.QueryApiKey)
+	u.RawQuery = values.Encode()
+	return u.String()
+}
+
+// CancelTask cancels queued or in-flight task by ID. Sync client of
+// task is answered with error. Returns false if there is no such task.
+func (p *Proxy) CancelTask(id string) bool {
+	if task, ok := p.queue.take(id); ok {
+		p.cancelQueued(task)
+		return true
+	}
+
+	p.mu.Lock()
+	task, ok := p.inflight[id]
+	p.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// worker drops task and answers client, see abandon
+	atomic.StoreInt32(&task.cancelled, 1)
+	task.cancel()
+	return true
+}
+
+// cancelQueued answers client of task removed from queue. Sync
+// handler waits for out, as it can not remove the task.
+func (p *Proxy) cancelQueued(task *Task) {
+	task.wait.End()
+	atomic.StoreInt32(&task.cancelled, 1)
+	task.cancel()
+	p.abandon(task)
+	if task.sendClient {
+		task.out <- struct{}{}
+	}
+}
+
+// PrioritizeTask changes priority of queued task, tasks of higher
+// priority go to workers first. Returns false if task is not queued.
+func (p *Proxy) PrioritizeTask(id string, priority int) bool {
+	return p.queue.prioritize(id, priority)
+}
+
+// Pause stops dispatch of queued tasks to workers. Tasks are still
+// queued, in-flight ones are finished.
+func (p *Proxy) Pause() {
+	p.queue.pause()
+}
+
+// Resume continues dispatch of queued tasks after Pause.
+func (p *Proxy) Resume() {
+	p.queue.resume()
+}
+
+// Drain cancels all queued tasks, see CancelTask. Returns amount of
+// cancelled tasks.
+func (p *Proxy) Drain() int {
+	tasks := p.queue.drain()
+	for _, task := range tasks {
+		p.cancelQueued(task)
+	}
+	return len(tasks)
+}
+
+// Storage is storage used by stored history.
+type Storage struct {
+	Bytes     int64         `json:"bytes"`
+	Responses int           `json:"responses"`
+	Tickers   []StorageSize `json:"tickers"`
+}
+
+// Storage returns storage size of history per ticker, the largest
+// first.
+func (p *Proxy) Storage(ctx context.Context) (Storage, error) {
+	sizes, err := p.db.Sizes(ctx)
+	if err != nil {
+		return Storage{}, err
+	}
+	storage := Storage{Tickers: sizes}
+	for _, size := range sizes {
+		storage.Bytes += size.Bytes
+		storage.Responses += size.Responses
+	}
+	return storage, nil
+}
+
+// Admin returns handler of admin API, authorized by header
+// "Authorization: Bearer <token>". Empty token denies all requests.
+//
+//	GET  /admin/tasks                        queued and in-flight tasks
+//	POST /admin/tasks/<id>/cancel            cancel task, or DELETE /admin/tasks/<id>
+//	POST /admin/tasks/<id>/priority?value=N  change priority of queued task
+//	POST /admin/pause                        pause dispatch to workers
+//	POST /admin/resume                       resume dispatch to workers
+//	POST /admin/drain                        cancel all queued tasks
+//	GET  /admin/storage                      storage size per ticker
+func (p *Proxy) Admin(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeError(w, errUnauthorized)
+			return
+		}
+		lg := logging.FromContext(r.Context(), p.lg)
+
+		path := strings.Trim(strings.TrimPrefix(r.URL.Path, adminPrefix), "/")
+		parts := strings.Split(path, "/")
+		switch {
+		case path == "tasks":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			writeJSON(w, p.Tasks())
+
+		case len(parts) == 2 && parts[0] == "tasks" && r.Method == http.MethodDelete,
+			len(parts) == 3 && parts[0] == "tasks" && parts[2] == "cancel":
+			if r.Method != http.MethodDelete && !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			if !p.CancelTask(parts[1]) {
+				writeError(w, taskNotFound(parts[1]))
+				return
+			}
+			lg.Info("Admin cancelled task", zap.String("task_id", parts[1]))
+			writeJSON(w, map[string]string{"id": parts[1], "status": "cancelled"})
+
+		case len(parts) == 3 && parts[0] == "tasks" && parts[2] == "priority":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			priority, err := strconv.Atoi(r.URL.Query().Get("value"))
+			if err != nil {
+				writeError(w, &APIError{
+					Status:  http.StatusBadRequest,
+					Code:    CodeInvalidParam,
+					Field:   "value",
+					Message: "Integer priority required",
+				})
+				return
+			}
+			if !p.PrioritizeTask(parts[1], priority) {
+				writeError(w, taskNotFound(parts[1]))
+				return
+			}
+			lg.Info("Admin prioritized task", zap.String("task_id", parts[1]), zap.Int("priority", priority))
+			writeJSON(w, map[string]interface{}{"id": parts[1], "priority": priority})
+
+		case path == "pause", path == "resume":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			if path == "pause" {
+				p.Pause()
+			} else {
+				p.Resume()
+			}
+			lg.Info("Admin " + path + "d dispatch")
+			writeJSON(w, map[string]bool{"paused": p.queue.isPaused()})
+
+		case path == "drain":
+			if !allowMethod(w, r, http.MethodPost) {
+				return
+			}
+			n := p.Drain()
+			lg.Info("Admin drained queue", zap.Int("cancelled", n))
+			writeJSON(w, map[string]int{"cancelled": n})
+
+		case path == "storage":
+			if !allowMethod(w, r, http.MethodGet) {
+				return
+			}
+			storage, err := p.Storage(r.Context())
+			if err != nil {
+				writeError(w, errInternal)
+				p.rep.Report(err, reporter.LevelError, nil)
+				return
+			}
+			writeJSON(w, storage)
+
+		default:
+			writeError(w, &APIError{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: "Unknown admin endpoint " + r.URL.Path,
+			})
+		}
+	}
+}
+
+// authorized returns true if request has bearer token.
+func authorized(r *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	got := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) == 1
+}
+
+// allowMethod writes error unless request has method.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeError(w, &APIError{
+		Status:  http.StatusMethodNotAllowed,
+		Code:    CodeMethod,
+		Message: "Use " + method,
+	})
+	return false
+}
+
+func taskNotFound(id string) *APIError {
+	return &APIError{
+		Status:  http.StatusNotFound,
+		Code:    CodeNotFound,
+		Message: "No queued or in-flight task " + id,
+	}
+}
+
+// writeJSON sends v as JSON, which is not cached.
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(v)
+}
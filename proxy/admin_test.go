@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	"github.com/adnilote/stock-proxy/metrics"
+	"go.uber.org/zap"
+)
+
+func TestQueuePriority(t *testing.T) {
+	q := newQueue(10, nil)
+	for i, priority := range []int{0, 0, 5, 1} {
+		task := newTestTask(string('a' + rune(i)))
+		task.id, task.priority = task.key, priority
+		q.push(task, false)
+	}
+	if !q.prioritize("b", 3) {
+		t.Fatal("queued task must be prioritized")
+	}
+	if q.prioritize("x", 1) {
+		t.Error("unknown task must not be prioritized")
+	}
+	if task, ok := q.take("d"); !ok || task.key != "d" {
+		t.Errorf("queued task must be taken: %v", task)
+	}
+
+	got := ""
+	for q.len() > 0 {
+		task, _ := q.pop()
+		got += task.key
+	}
+	if got != "cba" {
+		t.Errorf("wrong order of tasks: got %s, expected cba", got)
+	}
+}
+
+func TestQueuePause(t *testing.T) {
+	q := newQueue(10, nil)
+	q.push(newTestTask("a"), false)
+	q.pause()
+
+	popped := make(chan struct{})
+	go func() {
+		q.pop()
+		close(popped)
+	}()
+	select {
+	case <-popped:
+		t.Fatal("paused queue must not give tasks")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q.resume()
+	select {
+	case <-popped:
+	case <-time.After(time.Second):
+		t.Fatal("resumed queue must give tasks")
+	}
+
+	// shutdown is not blocked by pause
+	q.push(newTestTask("b"), false)
+	q.pause()
+	q.close()
+	if task, ok := q.pop(); !ok || task.key != "b" {
+		t.Errorf("closed paused queue must give tasks: %v", task)
+	}
+}
+
+// newAdminProxy returns proxy without workers, so that tasks stay
+// queued.
+func newAdminProxy() *Proxy {
+	return &Proxy{
+		av:      av.NewAvClient("SECRETKEY0123456"),
+		lg:      zap.NewNop(),
+		metrics: metrics.New(),
+		queue:   newQueue(10, nil),
+		breaker: newBreaker(),
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	const token = "admin-token-0123456789"
+	p := newAdminProxy()
+	for _, symbol := range []string{"amzn", "msft", "aapl"} {
+		query := url.Values{"function": {"GLOBAL_QUOTE"}, "symbol": {symbol}}
+		task, apiErr := p.newTask(context.Background(), nil, query, false)
+		if apiErr != nil {
+			t.Fatal(apiErr)
+		}
+		task.client = "127.0.0.1:5000"
+		p.enqueue(task, false)
+	}
+	admin := p.Admin(token)
+
+	cases := []struct {
+		method string
+		path   string
+		token  string
+		code   int
+	}{
+		{http.MethodGet, "/admin/tasks", "", http.StatusUnauthorized},
+		{http.MethodGet, "/admin/tasks", "wrong", http.StatusUnauthorized},
+		{http.MethodPost, "/admin/tasks", token, http.StatusMethodNotAllowed},
+		{http.MethodGet, "/admin/pause", token, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/admin/unknown", token, http.StatusNotFound},
+		{http.MethodPost, "/admin/tasks/100/cancel", token, http.StatusNotFound},
+		{http.MethodPost, "/admin/tasks/1/priority?value=high", token, http.StatusBadRequest},
+		{http.MethodPost, "/admin/tasks/3/priority?value=1", token, http.StatusOK},
+		{http.MethodPost, "/admin/tasks/2/cancel", token, http.StatusOK},
+		{http.MethodPost, "/admin/pause", token, http.StatusOK},
+		{http.MethodGet, "/admin/tasks", token, http.StatusOK},
+	}
+	var w *httptest.ResponseRecorder
+	for caseNum, item := range cases {
+		r := httptest.NewRequest(item.method, item.path, nil)
+		if item.token != "" {
+			r.Header.Set("Authorization", "Bearer "+item.token)
+		}
+		w = httptest.NewRecorder()
+		admin(w, r)
+		if w.Code != item.code {
+			t.Errorf("[%d] %s %s: got %d, expected %d: %s", caseNum, item.method, item.path, w.Code, item.code, w.Body)
+		}
+	}
+
+	// the last case lists tasks
+	var tasks Tasks
+	if err := json.Unmarshal(w.Body.Bytes(), &tasks); err != nil {
+		t.Fatal(err)
+	}
+	if !tasks.Paused || len(tasks.Queued) != 2 || len(tasks.InFlight) != 0 {
+		t.Fatalf("wrong tasks: %+v", tasks)
+	}
+	first := tasks.Queued[0]
+	if first.ID != "3" || first.Ticker != "QUOTE:AAPL" || first.Priority != 1 || first.Client != "127.0.0.1:5000" {
+		t.Errorf("prioritized task must go first: %+v", first)
+	}
+	if strings.Contains(first.URL, "apikey") || !strings.Contains(first.URL, "symbol=aapl") {
+		t.Errorf("wrong url of task: %s", first.URL)
+	}
+
+	if n := p.Drain(); n != 2 || p.queue.len() != 0 {
+		t.Errorf("drain must cancel queued tasks: %d", n)
+	}
+}
+
+// TestCancelSync checks that sync client of cancelled task gets error.
+func TestCancelSync(t *testing.T) {
+	p := newAdminProxy()
+	query := url.Values{"function": {"GLOBAL_QUOTE"}, "symbol": {"amzn"}}
+	w := httptest.NewRecorder()
+	task, apiErr := p.newTask(context.Background(), w, query, true)
+	if apiErr != nil {
+		t.Fatal(apiErr)
+	}
+	p.enqueue(task, false)
+
+	done := make(chan struct{})
+	go func() {
+		<-task.out
+		close(done)
+	}()
+	if !p.CancelTask(task.id) {
+		t.Fatal("queued task must be cancelled")
+	}
+	<-done
+
+	var got APIError
+	json.Unmarshal(w.Body.Bytes(), &got)
+	if w.Code != http.StatusServiceUnavailable || got.Code != CodeCancelled {
+		t.Errorf("wrong answer of cancelled task: %d %s", w.Code, w.Body)
+	}
+	if task.ctx.Err() == nil {
+		t.Error("context of cancelled task must be cancelled")
+	}
+}
@@ -0,0 +1,341 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.uber.org/zap"
+)
+
+const (
+	// intradayLookback limits gap detection of intraday series, since
+	// Alpha Vantage returns only recent intraday bars even with
+	// outputsize=full
+	intradayLookback = 7 * 24 * time.Hour
+	// backfillRetry is the minimal period between fetches of a target
+	backfillRetry = time.Hour
+)
+
+// Calendar tells when market is open, used by Backfill to detect gaps,
+// see trading-calendar package. Times are wall clock of the exchange,
+// as in Alpha Vantage responses.
+type Calendar interface {
+	// Session returns open and close of regular session on day,
+	// ok is false if market is closed all day.
+	Session(day time.Time) (open, close time.Time, ok bool)
+}
+
+// BackfillTarget is a time series of a ticker checked for gaps.
+type BackfillTarget struct {
+	Symbol   string
+	Function string
+	// Interval is required for TIME_SERIES_INTRADAY only
+	Interval string
+}
+
+func (t BackfillTarget) String() string {
+	s := strings.ToUpper(t.Symbol) + ":" + t.Function
+	if t.Interval != "" {
+		s += ":" + t.Interval
+	}
+	return s
+}
+
+func (t BackfillTarget) query() url.Values {
+	query := url.Values{}
+	query.Set(av.QueryFunction, t.Function)
+	query.Set(av.QuerySymbol, t.Symbol)
+	if t.Interval != "" {
+		query.Set(av.QueryInterval, t.Interval)
+	}
+	return query
+}
+
+// step returns duration between bars, 0 for daily series
+func (t BackfillTarget) step() time.Duration {
+	d, _ := time.ParseDuration(strings.TrimSuffix(t.Interval, "in"))
+	return d
+}
+
+// ParseBackfillTargets parses comma separated targets in format
+// symbol:function[:interval], e.g. "amzn:TIME_SERIES_DAILY,msft:TIME_SERIES_INTRADAY:5min".
+// Only daily and intraday series are supported.
+func ParseBackfillTargets(s string) ([]BackfillTarget, error) {
+	targets := []BackfillTarget{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.Split(item, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return nil, fmt.Errorf("invalid backfill target %q", item)
+		}
+		t := BackfillTarget{
+			Symbol:   parts[0],
+			Function: strings.ToUpper(parts[1]),
+		}
+		if len(parts) == 3 {
+			t.Interval = parts[2]
+		}
+
+		ts, ok := parseTimeSeries(t.Function)
+		if !ok || (ts != timeSeriesIntraday && ts != TimeSeriesDaily && ts != TimeSeriesDailyAdjusted) {
+			return nil, fmt.Errorf("backfill of %s is not supported", t.Function)
+		}
+		if apiErr := validateQuery(t.query()); apiErr != nil {
+			return nil, fmt.Errorf("invalid backfill target %q: %s", item, apiErr)
+		}
+		targets = append(targets, t)
+	}
+	return targets, nil
+}
+
+// Gap is a range of missing bars.
+type Gap struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Missing int       `json:"missing"`
+}
+
+// GapStatus is the result of gap detection of a BackfillTarget.
+type GapStatus struct {
+	Symbol    string     `json:"symbol"`
+	Function  string     `json:"function"`
+	Interval  string     `json:"interval,omitempty"`
+	Bars      int        `json:"bars"`
+	First     time.Time  `json:"first"`
+	Last      time.Time  `json:"last"`
+	Missing   int        `json:"missing"`
+	Gaps      []Gap      `json:"gaps"`
+	Checked   time.Time  `json:"checked"`
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// detectGaps returns ranges of bars missing in have, which are
+// expected by cal between days from and until (exclusive).
+// step is duration between intraday bars, 0 for daily series.
+func detectGaps(have map[time.Time]bool, step time.Duration, cal Calendar, from, until time.Time) []Gap {
+	gaps := []Gap{}
+	var gap *Gap
+
+	expect := func(t time.Time) {
+		if have[t] {
+			if gap != nil {
+				gaps = append(gaps, *gap)
+				gap = nil
+			}
+			return
+		}
+		if gap == nil {
+			gap = &Gap{From: t}
+		}
+		gap.To = t
+		gap.Missing++
+	}
+
+	y, m, d := from.Date()
+	for day := time.Date(y, m, d, 0, 0, 0, 0, from.Location()); day.Before(until); day = day.AddDate(0, 0, 1) {
+		open, close, ok := cal.Session(day)
+		if !ok {
+			continue
+		}
+		if step == 0 {
+			expect(day)
+			continue
+		}
+		for t := open.Add(step); !t.After(close); t = t.Add(step) {
+			if !t.Before(from) {
+				expect(t)
+			}
+		}
+	}
+	if gap != nil {
+		gaps = append(gaps, *gap)
+	}
+	return gaps
+}
+
+// Backfill periodically detects gaps in stored history of targets and
+// fetches them with outputsize=full when there is spare rate limit,
+// i.e. when no client task is queued.
+type Backfill struct {
+	p       *Proxy
+	cal     Calendar
+	targets []BackfillTarget
+	now     func() time.Time
+
+	mu     sync.Mutex
+	status map[string]*GapStatus
+}
+
+// NewBackfill returns backfill of targets stored by p.
+func NewBackfill(p *Proxy, cal Calendar, targets []BackfillTarget) *Backfill {
+	return &Backfill{
+		p:       p,
+		cal:     cal,
+		targets: targets,
+		now:     func() time.Time { return calendar.WallClock(time.Now()) },
+		status:  map[string]*GapStatus{},
+	}
+}
+
+// Run checks targets every period until stop is closed. Of proxies
+// sharing LimitStore only the leader checks, see Proxy.Leader.
+func (b *Backfill) Run(period time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		// lease outlives a missed tick, so that leader keeps it
+		if b.p.Leader("backfill", 2*period) {
+			b.Check()
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Check detects gaps of all targets and schedules a fetch of the first
+// target with gaps, if task queue is empty.
+func (b *Backfill) Check() {
+	scheduled := false
+	for _, t := range b.targets {
+		st := b.check(t)
+
+		b.mu.Lock()
+		if prev, ok := b.status[t.String()]; ok {
+			st.Scheduled = prev.Scheduled
+		}
+		b.status[t.String()] = st
+		if !scheduled && st.Missing > 0 && b.due(st) {
+			scheduled = b.schedule(t, st)
+		}
+		b.mu.Unlock()
+	}
+}
+
+// due returns true if target of st was not fetched recently
+func (b *Backfill) due(st *GapStatus) bool {
+	return st.Scheduled == nil || b.now().Sub(*st.Scheduled) > backfillRetry
+}
+
+// check detects gaps in stored bars of target t
+func (b *Backfill) check(t BackfillTarget) *GapStatus {
+	now := b.now()
+	st := &GapStatus{
+		Symbol:   strings.ToUpper(t.Symbol),
+		Function: t.Function,
+		Interval: t.Interval,
+		Gaps:     []Gap{},
+		Checked:  now,
+	}
+
+	query := t.query()
+	fn, _ := av.LookupFunction(t.Function)
+	item, err := b.p.db.Get(context.Background(), fn.Key(query))
+	if err != nil {
+		if err != mongo.ErrNoDocuments {
+			st.Error = err.Error()
+			b.p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": st.Symbol})
+		}
+		return st
+	}
+
+	// collect bars of all stored responses of the series
+	have := map[time.Time]bool{}
+	for _, v := range seriesBars(item, fn.DataKey(query)) {
+		have[v.Time] = true
+	}
+	st.Bars = len(have)
+	if st.Bars == 0 {
+		return st
+	}
+	for tm := range have {
+		if st.First.IsZero() || tm.Before(st.First) {
+			st.First = tm
+		}
+		if tm.After(st.Last) {
+			st.Last = tm
+		}
+	}
+
+	from := st.First
+	if t.step() != 0 && now.Add(-intradayLookback).After(from) {
+		from = now.Add(-intradayLookback)
+	}
+	y, m, d := now.Date()
+	until := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	st.Gaps = detectGaps(have, t.step(), b.cal, from, until)
+	for _, gap := range st.Gaps {
+		st.Missing += gap.Missing
+	}
+	return st
+}
+
+// schedule queues fetch of full series of t, if queue is empty.
+// Returns true if task was queued.
+func (b *Backfill) schedule(t BackfillTarget, st *GapStatus) bool {
+	if b.p.queue.len() > 0 {
+		return false
+	}
+
+	query := t.query()
+	query.Set(av.QueryOutputSize, "full")
+	task, apiErr := b.p.newTask(context.Background(), nil, query, false)
+	if apiErr != nil {
+		st.Error = apiErr.Error()
+		return false
+	}
+	task.client = "backfill"
+	if !b.p.try(task) {
+		return false
+	}
+
+	now := b.now()
+	st.Scheduled = &now
+	b.p.lg.Info("Schedule backfill", zap.String("target", t.String()), zap.Int("missing", st.Missing))
+	return true
+}
+
+// GetGaps returns gap status of backfill targets, filtered by symbol
+// if given.
+//
+// Example: http://127.0.0.1:8082/gaps/?symbol=amzn
+func (b *Backfill) GetGaps(w http.ResponseWriter, r *http.Request) {
+	symbol := strings.ToUpper(r.URL.Query().Get(av.QuerySymbol))
+
+	b.mu.Lock()
+	statuses := []*GapStatus{}
+	for _, t := range b.targets {
+		st, ok := b.status[t.String()]
+		if !ok || (symbol != "" && st.Symbol != symbol) {
+			continue
+		}
+		statuses = append(statuses, st)
+	}
+	body, err := json.Marshal(statuses)
+	b.mu.Unlock()
+
+	if err != nil {
+		writeError(w, errInternal)
+		b.p.rep.Report(err, reporter.LevelError, nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
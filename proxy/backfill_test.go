@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+)
+
+func TestParseBackfillTargets(t *testing.T) {
+	targets, err := ParseBackfillTargets("amzn:TIME_SERIES_DAILY, msft:time_series_intraday:5min")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 targets, got %d", len(targets))
+	}
+	if targets[1].String() != "MSFT:TIME_SERIES_INTRADAY:5min" {
+		t.Errorf("wrong target: %s", targets[1])
+	}
+	if targets[1].step() != 5*time.Minute || targets[0].step() != 0 {
+		t.Errorf("wrong step: %s, %s", targets[0].step(), targets[1].step())
+	}
+
+	for _, s := range []string{
+		"amzn",
+		"amzn:TIME_SERIES_INTRADAY",
+		"amzn:TIME_SERIES_INTRADAY:2min",
+		"amzn:TIME_SERIES_WEEKLY",
+		"amzn:GLOBAL_QUOTE",
+	} {
+		if _, err := ParseBackfillTargets(s); err == nil {
+			t.Errorf("expected error for %s", s)
+		}
+	}
+}
+
+func TestDetectGaps(t *testing.T) {
+	at := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02 15:04", s)
+		return d
+	}
+
+	// Thu 2019-08-01, Fri and Mon stored, Tue and Wed are missing
+	have := map[time.Time]bool{
+		at("2019-08-01 00:00"): true,
+		at("2019-08-02 00:00"): true,
+		at("2019-08-05 00:00"): true,
+	}
+	gaps := detectGaps(have, 0, calendar.New(), at("2019-08-01 00:00"), at("2019-08-08 00:00"))
+	if len(gaps) != 1 || gaps[0].Missing != 2 ||
+		!gaps[0].From.Equal(at("2019-08-06 00:00")) || !gaps[0].To.Equal(at("2019-08-07 00:00")) {
+		t.Errorf("wrong daily gaps: %+v", gaps)
+	}
+
+	// 30min bars of Mon 2019-08-05 without 11:00 and 11:30
+	have = map[time.Time]bool{}
+	for tm := at("2019-08-05 10:00"); !tm.After(at("2019-08-05 16:00")); tm = tm.Add(30 * time.Minute) {
+		if tm.Hour() != 11 {
+			have[tm] = true
+		}
+	}
+	gaps = detectGaps(have, 30*time.Minute, calendar.New(), at("2019-08-03 00:00"), at("2019-08-06 00:00"))
+	if len(gaps) != 1 || gaps[0].Missing != 2 || !gaps[0].From.Equal(at("2019-08-05 11:00")) {
+		t.Errorf("wrong intraday gaps: %+v", gaps)
+	}
+
+	// Independence Day is not missing, 2019-07-03 and 2019-07-05 are one gap
+	gaps = detectGaps(map[time.Time]bool{}, 0, calendar.New(), at("2019-07-03 00:00"), at("2019-07-06 00:00"))
+	if len(gaps) != 1 || gaps[0].Missing != 2 {
+		t.Errorf("wrong daily gaps around holiday: %+v", gaps)
+	}
+
+	// early close, hourly bars are expected till 13:00
+	have = map[time.Time]bool{
+		at("2019-07-03 10:30"): true,
+		at("2019-07-03 11:30"): true,
+		at("2019-07-03 12:30"): true,
+	}
+	gaps = detectGaps(have, time.Hour, calendar.New(), at("2019-07-03 00:00"), at("2019-07-04 00:00"))
+	if len(gaps) != 0 {
+		t.Errorf("wrong gaps of early close: %+v", gaps)
+	}
+}
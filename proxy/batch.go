@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+)
+
+// MaxBatch is max amount of symbols in batch request
+const MaxBatch = 100
+
+// BatchResult is result of a symbol of batch request. Data is json
+// response of Alpha Vantage, csv one is a json string.
+type BatchResult struct {
+	Symbol string `json:"symbol"`
+	Status int    `json:"status"`
+	// Source is "stored" for fresh stored responses, "upstream"
+	// for fetched ones
+	Source string          `json:"source,omitempty"`
+	Data   json.RawMessage `json:"data,omitempty"`
+	Error  *APIError       `json:"error,omitempty"`
+}
+
+// resultWriter keeps response of a batch task written by worker.
+type resultWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *resultWriter) Header() http.Header { return w.header }
+
+func (w *resultWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *resultWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.body.Write(b)
+}
+
+// result returns result of symbol by the kept response.
+func (w *resultWriter) result(symbol string) BatchResult {
+	if w.status == 0 {
+		// task is dropped, e.g. client disconnected
+		return BatchResult{Symbol: symbol, Status: errCancelled.Status, Error: errCancelled}
+	}
+	if w.status != http.StatusOK {
+		apiErr := &APIError{}
+		if err := json.Unmarshal(w.body.Bytes(), apiErr); err != nil || apiErr.Code == "" {
+			apiErr = errInternal
+		}
+		return BatchResult{Symbol: symbol, Status: w.status, Error: apiErr}
+	}
+	return BatchResult{Symbol: symbol, Status: http.StatusOK, Source: "upstream", Data: resultData(w.body.Bytes())}
+}
+
+// resultData returns json response as is, other ones as json string.
+func resultData(body []byte) json.RawMessage {
+	if json.Valid(body) {
+		return body
+	}
+	data, _ := json.Marshal(string(body))
+	return data
+}
+
+// batchSymbols returns unique symbols of comma separated "symbols" and
+// "symbol" params, in order of query.
+func batchSymbols(form url.Values) []string {
+	symbols := []string{}
+	seen := map[string]bool{}
+	params := append(append([]string{}, form["symbols"]...), form[av.QuerySymbol]...)
+	for _, param := range params {
+		for _, symbol := range strings.Split(param, ",") {
+			symbol = strings.TrimSpace(symbol)
+			if symbol == "" || seen[strings.ToUpper(symbol)] {
+				continue
+			}
+			seen[strings.ToUpper(symbol)] = true
+			symbols = append(symbols, symbol)
+		}
+	}
+	return symbols
+}
+
+// GetBatch returns responses of a function for many symbols in one
+// request. Fresh stored responses, see freshResponse, are sent at
+// once, the rest are queued like requests of /sync/. Results are sent
+// as multi-status json document when all are done, or as ndjson lines
+// as each is done if format=ndjson or Accept is application/x-ndjson.
+// Params other than symbols and format go to each query.
+//
+// Example: http://127.0.0.1:8082/batch/?function=TIME_SERIES_DAILY&symbols=amzn,msft,ibm
+func (p *Proxy) GetBatch(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeError(w, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidParam,
+			Message: err.Error(),
+		})
+		return
+	}
+	symbols := batchSymbols(r.Form)
+	if len(symbols) == 0 {
+		writeError(w, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeMissingParam,
+			Field:   "symbols",
+			Message: "symbols required",
+		})
+		return
+	}
+	if len(symbols) > MaxBatch {
+		writeError(w, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidParam,
+			Field:   "symbols",
+			Message: "at most " + strconv.Itoa(MaxBatch) + " symbols allowed",
+		})
+		return
+	}
+	ndjson := r.Form.Get("format") == "ndjson" || strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+
+	results := make([]BatchResult, len(symbols))
+	done := make(chan int, len(symbols))
+	for i, symbol := range symbols {
+		query := url.Values{}
+		for k, v := range r.Form {
+			if k != "symbols" && k != "format" {
+				query[k] = v
+			}
+		}
+		query.Set(av.QuerySymbol, symbol)
+
+		rw := &resultWriter{header: http.Header{}}
+		task, apiErr := p.newTask(r.Context(), rw, query, true)
+		if apiErr != nil {
+			results[i] = BatchResult{Symbol: symbol, Status: apiErr.Status, Error: apiErr}
+			done <- i
+			continue
+		}
+		task.client = r.RemoteAddr
+
+		if body, ok := p.freshResponse(task); ok {
+			results[i] = BatchResult{Symbol: symbol, Status: http.StatusOK, Source: "stored", Data: resultData(body)}
+			done <- i
+			continue
+		}
+		go func(i int, symbol string) {
+			p.sync(task)
+			results[i] = rw.result(symbol)
+			done <- i
+		}(i, symbol)
+	}
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		flusher, _ := w.(http.Flusher)
+		enc := json.NewEncoder(w)
+		for range symbols {
+			enc.Encode(results[<-done])
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return
+	}
+
+	for range symbols {
+		<-done
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusMultiStatus)
+	json.NewEncoder(w).Encode(struct {
+		Results []BatchResult `json:"results"`
+	}{results})
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestBatchSymbols(t *testing.T) {
+	form := url.Values{"symbols": {"amzn, msft,,AMZN"}, "symbol": {"ibm", "msft"}}
+	got := batchSymbols(form)
+	if len(got) != 3 || got[0] != "amzn" || got[1] != "msft" || got[2] != "ibm" {
+		t.Errorf("wrong symbols %v", got)
+	}
+}
+
+// TestBatch checks that results of queued tasks are collected into
+// multi-status response.
+func TestBatch(t *testing.T) {
+	p := newAdminProxy()
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/batch/?function=GLOBAL_QUOTE&symbols=amzn,msft,ibm", nil)
+	done := make(chan struct{})
+	go func() {
+		p.GetBatch(w, r)
+		close(done)
+	}()
+
+	// worker answers two tasks, the third one is cancelled
+	for i := 0; i < 2; i++ {
+		task, _ := p.queue.pop()
+		task.wait.End()
+		task.w.Write([]byte(`{"Global Quote": {"01. symbol": "` + task.key + `"}}`))
+		task.out <- struct{}{}
+	}
+	for p.Drain() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	<-done
+
+	var got struct {
+		Results []BatchResult `json:"results"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || w.Code != http.StatusMultiStatus {
+		t.Fatalf("wrong response %d %s: %v", w.Code, w.Body, err)
+	}
+	ok, cancelled := 0, 0
+	for i, res := range got.Results {
+		if res.Symbol != []string{"amzn", "msft", "ibm"}[i] {
+			t.Errorf("[%d] wrong order of results: %s", i, res.Symbol)
+		}
+		switch {
+		case res.Status == http.StatusOK && res.Source == "upstream" && len(res.Data) > 0:
+			ok++
+		case res.Status == http.StatusServiceUnavailable && res.Error != nil && res.Error.Code == CodeCancelled:
+			cancelled++
+		default:
+			t.Errorf("[%d] wrong result %+v", i, res)
+		}
+	}
+	if ok != 2 || cancelled != 1 {
+		t.Errorf("expected 2 answered and 1 cancelled results, got %d and %d", ok, cancelled)
+	}
+}
+
+func TestBatchNDJSON(t *testing.T) {
+	p := newAdminProxy()
+
+	// invalid queries are answered at once
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/batch/?function=TIME_SERIES_INTRADAY&symbols=amzn,msft&format=ndjson", nil)
+	p.GetBatch(w, r)
+	if w.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Errorf("wrong content type %s", w.Header().Get("Content-Type"))
+	}
+	lines := 0
+	scanner := bufio.NewScanner(w.Body)
+	for scanner.Scan() {
+		var res BatchResult
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			t.Fatalf("wrong line %s: %v", scanner.Bytes(), err)
+		}
+		if res.Status != http.StatusBadRequest || res.Error == nil || res.Error.Field != "interval" {
+			t.Errorf("wrong result %+v", res)
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Errorf("expected 2 lines, got %d", lines)
+	}
+
+	w = httptest.NewRecorder()
+	p.GetBatch(w, httptest.NewRequest(http.MethodGet, "/batch/?function=GLOBAL_QUOTE", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected error of missing symbols, got %d", w.Code)
+	}
+}
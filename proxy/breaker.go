@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// breakerFailures is amount of consecutive upstream failures,
+	// which opens circuit
+	breakerFailures = 5
+	// breakerCooldown is time circuit stays open before next try
+	breakerCooldown = time.Minute
+)
+
+// Circuit states of upstream.
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half_open"
+)
+
+// breaker stops requests to Alpha Vantage for breakerCooldown after
+// breakerFailures consecutive failures, so that queued tasks do not
+// spend API calls while upstream is down.
+type breaker struct {
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+}
+
+func newBreaker() *breaker {
+	return &breaker{now: time.Now}
+}
+
+// state returns circuit state of upstream.
+func (b *breaker) state() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.failures < breakerFailures:
+		return CircuitClosed
+	case b.now().Before(b.openUntil):
+		return CircuitOpen
+	default:
+		return CircuitHalfOpen
+	}
+}
+
+// wait blocks while circuit is open. Returns false if stop or cancel
+// is closed before.
+func (b *breaker) wait(stop, cancel <-chan struct{}) bool {
+	for {
+		b.mu.Lock()
+		d := b.openUntil.Sub(b.now())
+		b.mu.Unlock()
+		if d <= 0 {
+			return true
+		}
+
+		timer := time.NewTimer(d)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return false
+		case <-cancel:
+			timer.Stop()
+			return false
+		}
+	}
+}
+
+// success closes circuit.
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// failure counts failed request, circuit opens after
+// breakerFailures of them, half-open one opens again.
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures >= breakerFailures {
+		b.openUntil = b.now().Add(breakerCooldown)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// etag returns strong entity tag of content of parts.
+func etag(parts ...[]byte) string {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// notModified returns true if conditional request of header is
+// satisfied by response of tag and modified time, see RFC 7232:
+// If-None-Match wins over If-Modified-Since.
+func notModified(header http.Header, tag string, modified time.Time) bool {
+	if inm := header.Get("If-None-Match"); inm != "" {
+		for _, t := range strings.Split(inm, ",") {
+			// weak comparison, proxies may weaken tags
+			t = strings.TrimPrefix(strings.TrimSpace(t), "W/")
+			if t == "*" || t == tag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := header.Get("If-Modified-Since"); ims != "" && !modified.IsZero() {
+		t, err := http.ParseTime(ims)
+		return err == nil && !modified.Truncate(time.Second).After(t)
+	}
+	return false
+}
+
+// writeCacheable writes parts of response with ETag, Last-Modified
+// unless modified is zero, and Cache-Control: response may be reused
+// for maxAge, it is revalidated if maxAge is 0. Conditional request of
+// header is answered with 304 Not Modified.
+func writeCacheable(w http.ResponseWriter, header http.Header, contentType string, modified time.Time,
+	maxAge time.Duration, parts ...[]byte) {
+
+	tag := etag(parts...)
+	w.Header().Set("ETag", tag)
+	if !modified.IsZero() {
+		w.Header().Set("Last-Modified", modified.UTC().Format(http.TimeFormat))
+	}
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(maxAge/time.Second)))
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if notModified(header, tag, modified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, part := range parts {
+		w.Write(part)
+	}
+}
+
+// lastModified returns "Last Refreshed" of json response, the time of
+// its last bar. Bar of a day, e.g. daily one, changes until close of
+// the day, so its time is the close, and zero until then.
+func (p *Proxy) lastModified(body []byte, now time.Time) time.Time {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return time.Time{}
+	}
+	meta, err := parseMetaData(body)
+	if err != nil {
+		return time.Time{}
+	}
+	t := meta.LastRefreshed
+	// wall clock of metadata is kept by location of t
+	if h, m, s := t.Clock(); h != 0 || m != 0 || s != 0 {
+		return t
+	}
+	hours, ok := p.cal.Hours(t)
+	if !ok || hours.Close.After(now) {
+		return time.Time{}
+	}
+	return hours.Close
+}
+
+// closedMaxAge returns time until the next pre-market, while stored
+// responses of closed market do not change.
+func (p *Proxy) closedMaxAge(now time.Time) time.Duration {
+	hours, ok := p.cal.Hours(p.cal.NextOpen(now))
+	if !ok || !hours.PreOpen.After(now) {
+		return 0
+	}
+	return hours.PreOpen.Sub(now)
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+)
+
+func TestNotModified(t *testing.T) {
+	const tag = `"0123"`
+	modified := time.Date(2019, 8, 6, 20, 0, 0, 500, time.UTC)
+	cases := []struct {
+		header   http.Header
+		expected bool
+	}{
+		{http.Header{}, false},
+		{http.Header{"If-None-Match": {tag}}, true},
+		{http.Header{"If-None-Match": {`"x", W/"0123"`}}, true},
+		{http.Header{"If-None-Match": {"*"}}, true},
+		{http.Header{"If-None-Match": {`"x"`}}, false},
+		{http.Header{"If-Modified-Since": {"Tue, 06 Aug 2019 20:00:00 GMT"}}, true},
+		{http.Header{"If-Modified-Since": {"Tue, 06 Aug 2019 19:59:59 GMT"}}, false},
+		{http.Header{"If-Modified-Since": {"yesterday"}}, false},
+		// If-None-Match wins
+		{http.Header{"If-None-Match": {`"x"`}, "If-Modified-Since": {"Tue, 06 Aug 2019 20:00:00 GMT"}}, false},
+	}
+	for caseNum, item := range cases {
+		if got := notModified(item.header, tag, modified); got != item.expected {
+			t.Errorf("[%d] expected %v, got %v", caseNum, item.expected, got)
+		}
+	}
+	if notModified(http.Header{"If-Modified-Since": {"Tue, 06 Aug 2019 20:00:00 GMT"}}, tag, time.Time{}) {
+		t.Errorf("response without Last-Modified must be sent")
+	}
+}
+
+func TestWriteCacheable(t *testing.T) {
+	modified := time.Date(2019, 8, 6, 20, 0, 0, 0, time.UTC)
+	w := httptest.NewRecorder()
+	writeCacheable(w, http.Header{}, "application/json", modified, time.Hour, []byte("{}"), []byte("[]"))
+	tag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != "{}[]" || tag == "" ||
+		w.Header().Get("Last-Modified") != "Tue, 06 Aug 2019 20:00:00 GMT" ||
+		w.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("wrong response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	writeCacheable(w, http.Header{"If-None-Match": {tag}}, "application/json", time.Time{}, 0, []byte("{}"), []byte("[]"))
+	if w.Code != http.StatusNotModified || w.Body.Len() != 0 || w.Header().Get("ETag") != tag ||
+		w.Header().Get("Last-Modified") != "" || w.Header().Get("Cache-Control") != "public, no-cache" {
+		t.Errorf("wrong response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	writeCacheable(w, http.Header{"If-None-Match": {tag}}, "application/json", time.Time{}, 0, []byte("{}"))
+	if w.Code != http.StatusOK {
+		t.Errorf("changed response must be sent, got %d", w.Code)
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	p := &Proxy{cal: calendar.New()}
+	cases := []struct {
+		body     string
+		now      time.Time
+		expected time.Time
+	}{
+		{intradayResponse, time.Now(), calendar.Date(2019, 8, 6, 9, 32)},
+		// daily bar is final after close
+		{dailyResponse, calendar.Date(2019, 8, 7, 9, 0), calendar.Date(2019, 8, 6, 16, 0)},
+		{dailyResponse, calendar.Date(2019, 8, 6, 12, 0), time.Time{}},
+		{"timestamp,open\n", time.Now(), time.Time{}},
+	}
+	for caseNum, item := range cases {
+		if got := p.lastModified([]byte(item.body), item.now); !got.Equal(item.expected) {
+			t.Errorf("[%d] expected %v, got %v", caseNum, item.expected, got)
+		}
+	}
+}
+
+func TestClosedMaxAge(t *testing.T) {
+	p := &Proxy{cal: calendar.New()}
+	// Saturday till pre-market of Monday
+	now := calendar.Date(2019, 8, 10, 12, 0)
+	hours, _ := p.cal.Hours(calendar.Date(2019, 8, 12, 0, 0))
+	if got := p.closedMaxAge(now); got != hours.PreOpen.Sub(now) || got <= 36*time.Hour {
+		t.Errorf("wrong max age %v", got)
+	}
+}
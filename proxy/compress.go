@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// Compression is codec of stored responses.
+type Compression string
+
+// Compressions of stored responses. Codec of a payload is its BSON
+// binary subtype, so that responses stored uncompressed by old
+// versions are read as is.
+const (
+	CompressionNone   Compression = "none"
+	CompressionZstd   Compression = "zstd"
+	CompressionSnappy Compression = "snappy"
+)
+
+// Binary subtypes of stored payloads, user defined subtypes start
+// at 0x80.
+const (
+	subtypeRaw    byte = 0x00
+	subtypeZstd   byte = 0x80
+	subtypeSnappy byte = 0x81
+)
+
+// subtype returns binary subtype of payloads compressed by c.
+func (c Compression) subtype() (byte, bool) {
+	switch c {
+	case CompressionNone:
+		return subtypeRaw, true
+	case CompressionZstd:
+		return subtypeZstd, true
+	case CompressionSnappy:
+		return subtypeSnappy, true
+	}
+	return 0, false
+}
+
+// zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll, and are created once.
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+)
+
+func initZstd() {
+	zstdEncoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	zstdDecoder, _ = zstd.NewReader(nil)
+}
+
+// encodePayload returns response data compressed by c.
+func encodePayload(data []byte, c Compression) primitive.Binary {
+	switch c {
+	case CompressionZstd:
+		zstdOnce.Do(initZstd)
+		return primitive.Binary{Subtype: subtypeZstd, Data: zstdEncoder.EncodeAll(data, nil)}
+	case CompressionSnappy:
+		return primitive.Binary{Subtype: subtypeSnappy, Data: snappy.Encode(nil, data)}
+	}
+	return primitive.Binary{Subtype: subtypeRaw, Data: data}
+}
+
+// decodePayload returns response data of stored payload b.
+func decodePayload(b primitive.Binary) ([]byte, error) {
+	switch b.Subtype {
+	case subtypeRaw:
+		return b.Data, nil
+	case subtypeZstd:
+		zstdOnce.Do(initZstd)
+		data, err := zstdDecoder.DecodeAll(b.Data, nil)
+		return data, errors.Wrap(err, "decode zstd payload")
+	case subtypeSnappy:
+		data, err := snappy.Decode(nil, b.Data)
+		return data, errors.Wrap(err, "decode snappy payload")
+	}
+	return nil, errors.Errorf("unknown payload subtype 0x%x", b.Subtype)
+}
+
+// decodeItem replaces payloads of item by response data.
+func decodeItem(item *Item) error {
+	for i, b := range item.Ohlcv {
+		data, err := decodePayload(b)
+		if err != nil {
+			return errors.Wrapf(err, "response %d of %s", i, item.Ticker)
+		}
+		item.Ohlcv[i] = primitive.Binary{Subtype: subtypeRaw, Data: data}
+	}
+	return nil
+}
+
+// MigrateStats is the result of Migrate.
+type MigrateStats struct {
+	Records  int   `json:"records"`
+	Payloads int   `json:"payloads"`
+	Before   int64 `json:"before_bytes"`
+	After    int64 `json:"after_bytes"`
+}
+
+// Migrate recompresses stored payloads of other codecs by codec of
+// m, e.g. uncompressed ones of old versions. Records changed during
+// migration are skipped and migrated by the next run.
+func (m *MongoDB) Migrate(ctx context.Context) (MigrateStats, error) {
+	stats := MigrateStats{}
+	subtype, _ := m.compression.subtype()
+	err := m.each(ctx, func(item *Item) error {
+		ohlcv := make([]primitive.Binary, len(item.Ohlcv))
+		responses := make([][]byte, len(item.Ohlcv))
+		payloads := 0
+		var before, after int64
+		for i, b := range item.Ohlcv {
+			ohlcv[i] = b
+			data, err := decodePayload(b)
+			if err != nil {
+				return errors.Wrapf(err, "response %d of %s", i, item.Ticker)
+			}
+			responses[i] = data
+			if b.Subtype == subtype {
+				continue
+			}
+			ohlcv[i] = encodePayload(data, m.compression)
+			payloads++
+			before += int64(len(b.Data))
+			after += int64(len(ohlcv[i].Data))
+		}
+		if payloads == 0 {
+			return nil
+		}
+		// series of records of old versions are set as well
+		ok, err := m.replace(ctx, item, ohlcv, ohlcvSeries(responses))
+		if err != nil || !ok {
+			return err
+		}
+		stats.Records++
+		stats.Payloads += payloads
+		stats.Before += before
+		stats.After += after
+		return nil
+	})
+	return stats, err
+}
+
+// MigratePayloads recompresses stored responses by Options.Compression
+// in background, see MongoDB.Migrate. Of proxies sharing LimitStore
+// only the leader migrates.
+func (p *Proxy) MigratePayloads(ctx context.Context) {
+	if !p.Leader("migrate", time.Hour) {
+		return
+	}
+	stats, err := p.db.Migrate(ctx)
+	if err != nil {
+		p.rep.Report(err, reporter.LevelError, nil)
+	}
+	p.lg.Info("Migrate stored responses", zap.String("compression", string(p.db.compression)),
+		zap.Int("records", stats.Records), zap.Int("payloads", stats.Payloads),
+		zap.Int64("before_bytes", stats.Before), zap.Int64("after_bytes", stats.After))
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+var compressions = []Compression{CompressionNone, CompressionZstd, CompressionSnappy}
+
+// fullIntraday returns response of outputsize=full intraday series of
+// n bars.
+func fullIntraday(n int) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(`{"Meta Data": {"1. Information": "Intraday (1min) open, high, low, close prices and volume", ` +
+		`"2. Symbol": "AMZN", "3. Last Refreshed": "2019-08-06 16:00:00", "4. Interval": "1min", ` +
+		`"5. Output Size": "Full size", "6. Time Zone": "US/Eastern"}, "Time Series (1min)": {`)
+	start := time.Date(2019, 8, 6, 16, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		price := 1800 + float64(i%97)/10
+		fmt.Fprintf(buf, `"%s": {"1. open": "%.4f", "2. high": "%.4f", "3. low": "%.4f", "4. close": "%.4f", "5. volume": "%d"}`,
+			start.Add(-time.Duration(i)*time.Minute).Format("2006-01-02 15:04:05"),
+			price, price+0.5, price-0.5, price+0.1, 1000+i%500)
+	}
+	buf.WriteString("}}")
+	return buf.Bytes()
+}
+
+func TestPayload(t *testing.T) {
+	data := fullIntraday(100)
+	for caseNum, c := range compressions {
+		b := encodePayload(data, c)
+		if c != CompressionNone && len(b.Data) >= len(data) {
+			t.Errorf("[%d] %s payload is not compressed: %d bytes", caseNum, c, len(b.Data))
+		}
+		got, err := decodePayload(b)
+		if err != nil {
+			t.Errorf("[%d] %s: %v", caseNum, c, err)
+			continue
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("[%d] %s payload is changed", caseNum, c)
+		}
+	}
+
+	// uncompressed responses of old versions
+	item := &Item{Ticker: "AMZN", Ohlcv: []primitive.Binary{
+		{Subtype: 0x00, Data: data},
+		encodePayload(data, CompressionZstd),
+	}}
+	if err := decodeItem(item); err != nil {
+		t.Fatal(err)
+	}
+	for i, b := range item.Ohlcv {
+		if !bytes.Equal(b.Data, data) {
+			t.Errorf("response %d is not decoded", i)
+		}
+	}
+
+	if _, err := decodePayload(primitive.Binary{Subtype: 0x90, Data: data}); err == nil {
+		t.Errorf("expected error of unknown subtype")
+	}
+	if _, err := decodePayload(primitive.Binary{Subtype: subtypeZstd, Data: data}); err == nil {
+		t.Errorf("expected error of corrupted payload")
+	}
+}
+
+// BenchmarkEncodePayload measures write throughput of a full
+// intraday response by codec.
+func BenchmarkEncodePayload(b *testing.B) {
+	data := fullIntraday(5000)
+	for _, c := range compressions {
+		b.Run(string(c), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			var size int
+			for i := 0; i < b.N; i++ {
+				size = len(encodePayload(data, c).Data)
+			}
+			b.ReportMetric(float64(size)/float64(len(data)), "ratio")
+		})
+	}
+}
+
+// BenchmarkDecodePayload measures read throughput of a full intraday
+// response by codec.
+func BenchmarkDecodePayload(b *testing.B) {
+	data := fullIntraday(5000)
+	for _, c := range compressions {
+		payload := encodePayload(data, c)
+		b.Run(string(c), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				if _, err := decodePayload(payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
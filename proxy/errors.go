@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error codes of APIError.
+const (
+	CodeMissingParam    = "missing_param"
+	CodeInvalidParam    = "invalid_param"
+	CodeUnknownFunction = "unknown_function"
+	CodeQueueFull       = "queue_full"
+	CodeShuttingDown    = "shutting_down"
+	CodeNotFound        = "not_found"
+	CodeInternal        = "internal"
+	CodeCancelled       = "cancelled"
+	CodeUnauthorized    = "unauthorized"
+	CodeMethod          = "method_not_allowed"
+)
+
+// APIError is an error returned to client as JSON document, e.g.
+//
+//	{"code":"invalid_param","field":"interval","message":"...","allowed":["1min","5min"]}
+type APIError struct {
+	Status  int      `json:"-"`
+	Code    string   `json:"code"`
+	Field   string   `json:"field,omitempty"`
+	Message string   `json:"message"`
+	Allowed []string `json:"allowed,omitempty"`
+}
+
+func (e *APIError) Error() string {
+	if e.Field != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Code, e.Field, e.Message)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+var (
+	errQueueFull = &APIError{
+		Status:  http.StatusTooManyRequests,
+		Code:    CodeQueueFull,
+		Message: "Try later",
+	}
+	errShuttingDown = &APIError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeShuttingDown,
+		Message: "Server is shutting down, try later",
+	}
+	errCancelled = &APIError{
+		Status:  http.StatusServiceUnavailable,
+		Code:    CodeCancelled,
+		Message: "Request is cancelled by administrator, try later",
+	}
+	errUnauthorized = &APIError{
+		Status:  http.StatusUnauthorized,
+		Code:    CodeUnauthorized,
+		Message: "Bearer token required",
+	}
+	errInternal = &APIError{
+		Status:  http.StatusInternalServerError,
+		Code:    CodeInternal,
+		Message: "Internal server error",
+	}
+)
+
+// writeError sends err to client as JSON with err.Status code.
+func writeError(w http.ResponseWriter, err *APIError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(err.Status)
+	json.NewEncoder(w).Encode(err)
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pingTimeout limits mongoDB ping of readiness check
+const pingTimeout = 2 * time.Second
+
+// Check statuses, CheckWarn does not make proxy unready.
+const (
+	CheckOK   = "ok"
+	CheckWarn = "warn"
+	CheckFail = "fail"
+)
+
+// Check is a result of dependency check.
+type Check struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// Status is a health document, e.g.
+//
+//	{"status":"fail","checks":{"mongo":{"status":"fail","message":"no reachable servers"}}}
+type Status struct {
+	Status string           `json:"status"`
+	Checks map[string]Check `json:"checks,omitempty"`
+}
+
+// newStatus returns status with CheckFail if any of checks failed.
+func newStatus(checks map[string]Check) Status {
+	status := Status{Status: CheckOK, Checks: checks}
+	for _, check := range checks {
+		if check.Status == CheckFail {
+			status.Status = CheckFail
+		}
+	}
+	return status
+}
+
+// Ready checks mongoDB, queue saturation, upstream circuit and
+// API key budget.
+func (p *Proxy) Ready() Status {
+	checks := map[string]Check{}
+
+	if err := p.ping(); err != nil {
+		checks["mongo"] = Check{Status: CheckFail, Message: err.Error()}
+	} else {
+		checks["mongo"] = Check{Status: CheckOK}
+	}
+
+	queued, max := p.queue.size()
+	queue := Check{Status: CheckOK, Message: fmt.Sprintf("%d/%d queued", queued, max)}
+	switch {
+	case p.closing():
+		queue = Check{Status: CheckFail, Message: "shutting down"}
+	case queued >= max:
+		queue.Status = CheckFail
+	}
+	checks["queue"] = queue
+
+	switch state := p.breaker.state(); state {
+	case CircuitOpen:
+		checks["upstream"] = Check{Status: CheckFail, Message: "circuit " + state}
+	case CircuitHalfOpen:
+		checks["upstream"] = Check{Status: CheckWarn, Message: "circuit " + state}
+	default:
+		checks["upstream"] = Check{Status: CheckOK, Message: "circuit " + state}
+	}
+
+	// exhausted budget only delays requests
+	budget := Check{Status: CheckOK}
+	left := p.keys.left()
+	if left == 0 {
+		budget.Status = CheckWarn
+	}
+	budget.Message = fmt.Sprintf("%d requests left", left)
+	checks["api_keys"] = budget
+
+	return newStatus(checks)
+}
+
+// ping checks mongoDB within pingTimeout.
+func (p *Proxy) ping() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+	defer cancel()
+	return p.db.Ping(ctx)
+}
+
+// GetHealth is a liveness check, it returns ok while server serves.
+//
+// Example: http://127.0.0.1:8082/healthz
+func (p *Proxy) GetHealth(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, newStatus(nil))
+}
+
+// GetReady is a readiness check, it returns 503 if proxy can not
+// serve requests, see Ready.
+//
+// Example: http://127.0.0.1:8082/readyz
+func (p *Proxy) GetReady(w http.ResponseWriter, r *http.Request) {
+	writeStatus(w, p.Ready())
+}
+
+// writeStatus sends status as JSON, failed one with 503.
+func writeStatus(w http.ResponseWriter, status Status) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if status.Status == CheckFail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Date(2020, 1, 2, 10, 0, 0, 0, time.UTC)
+	b := newBreaker()
+	b.now = func() time.Time { return now }
+
+	for i := 0; i < breakerFailures-1; i++ {
+		b.failure()
+	}
+	if b.state() != CircuitClosed {
+		t.Fatalf("expected closed circuit, got %s", b.state())
+	}
+	b.failure()
+	if b.state() != CircuitOpen {
+		t.Fatalf("expected open circuit, got %s", b.state())
+	}
+
+	// open circuit waits for cooldown or stop
+	stop := make(chan struct{})
+	close(stop)
+	if b.wait(stop, nil) {
+		t.Errorf("wait must fail on stop while circuit is open")
+	}
+
+	now = now.Add(breakerCooldown)
+	if b.state() != CircuitHalfOpen {
+		t.Fatalf("expected half open circuit, got %s", b.state())
+	}
+	if !b.wait(nil, nil) {
+		t.Errorf("wait must pass half open circuit")
+	}
+
+	// failure of half open circuit opens it again
+	b.failure()
+	if b.state() != CircuitOpen {
+		t.Fatalf("expected open circuit, got %s", b.state())
+	}
+	b.success()
+	if b.state() != CircuitClosed {
+		t.Fatalf("expected closed circuit, got %s", b.state())
+	}
+}
+
+func TestWriteStatus(t *testing.T) {
+	cases := []struct {
+		checks map[string]Check
+		code   int
+		status string
+	}{
+		{nil, http.StatusOK, CheckOK},
+		{map[string]Check{"mongo": {Status: CheckOK}, "api_keys": {Status: CheckWarn}}, http.StatusOK, CheckOK},
+		{map[string]Check{"mongo": {Status: CheckFail}, "queue": {Status: CheckOK}}, http.StatusServiceUnavailable, CheckFail},
+	}
+	for caseNum, item := range cases {
+		w := httptest.NewRecorder()
+		writeStatus(w, newStatus(item.checks))
+
+		if w.Code != item.code {
+			t.Errorf("[%d] wrong code: got %d, expected %d", caseNum, w.Code, item.code)
+		}
+		status := Status{}
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Errorf("[%d] invalid json: %v", caseNum, err)
+			continue
+		}
+		if status.Status != item.status || len(status.Checks) != len(item.checks) {
+			t.Errorf("[%d] wrong status: %+v", caseNum, status)
+		}
+	}
+}
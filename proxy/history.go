@@ -0,0 +1,139 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// seriesBars returns bars of series of dataKey in stored json
+// responses of item, sorted by time. Bars of later responses replace
+// the same bars of earlier ones, bars rolled up by Retention only fill
+// missing days.
+func seriesBars(item *Item, dataKey string) []*TimeSeriesValue {
+	bars := map[time.Time]*TimeSeriesValue{}
+	rolled := map[time.Time]*TimeSeriesValue{}
+	for _, data := range item.Ohlcv {
+		if !bytes.HasPrefix(bytes.TrimSpace(data.Data), []byte("{")) {
+			continue
+		}
+		values, err := parseTimeSeriesJSON(data.Data, dataKey)
+		if err != nil {
+			// response of another function or interval
+			continue
+		}
+		target := bars
+		if meta, err := parseMetaData(data.Data); err == nil && meta.rolledUp() {
+			target = rolled
+		}
+		for _, v := range values {
+			target[v.Time] = v
+		}
+	}
+	for t, v := range rolled {
+		if _, ok := bars[t]; !ok {
+			bars[t] = v
+		}
+	}
+
+	values := make([]*TimeSeriesValue, 0, len(bars))
+	for _, v := range bars {
+		values = append(values, v)
+	}
+	sort.Sort(sortTimeSeriesValuesByDate(values))
+	return values
+}
+
+// Bars returns stored bars of time series of query, sorted by time.
+// It returns mongo.ErrNoDocuments if ticker has no history.
+func (p *Proxy) Bars(ctx context.Context, query url.Values) ([]*TimeSeriesValue, error) {
+	if apiErr := validateQuery(query); apiErr != nil {
+		return nil, apiErr
+	}
+	fn, _ := av.LookupFunction(query.Get(av.QueryFunction))
+	if fn.Shape != av.ShapeTimeSeries {
+		return nil, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidParam,
+			Field:   av.QueryFunction,
+			Message: fn.Name + " is not a time series",
+		}
+	}
+	item, err := p.db.Get(ctx, fn.Key(query))
+	if err != nil {
+		return nil, err
+	}
+	return seriesBars(item, fn.DataKey(query)), nil
+}
+
+// Bar is json of TimeSeriesValue, time of daily bars has no clock.
+type Bar struct {
+	Time   string  `json:"time"`
+	Open   float64 `json:"open"`
+	High   float64 `json:"high"`
+	Low    float64 `json:"low"`
+	Close  float64 `json:"close"`
+	Volume float64 `json:"volume"`
+}
+
+// NewBar returns Bar of v.
+func NewBar(v *TimeSeriesValue) Bar {
+	layout := "2006-01-02 15:04:05"
+	if v.Time.Hour() == 0 && v.Time.Minute() == 0 && v.Time.Second() == 0 {
+		layout = "2006-01-02"
+	}
+	return Bar{v.Time.Format(layout), v.Open, v.High, v.Low, v.Close, v.Volume}
+}
+
+// getAdjustedHistory returns stored bars of time series of query,
+// TIME_SERIES_DAILY by default, back-adjusted for stored dividends and
+// splits, as json array of Bar.
+func (p *Proxy) getAdjustedHistory(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	query.Del("adjusted")
+	if query.Get(av.QueryFunction) == "" {
+		query.Set(av.QueryFunction, TimeSeriesDaily.keyName())
+	}
+	values, err := p.Bars(r.Context(), query)
+	if err == nil {
+		fn, _ := av.LookupFunction(query.Get(av.QueryFunction))
+		values, err = p.AdjustHistory(r.Context(), fn.Key(query), values)
+	}
+	if err != nil {
+		if apiErr, ok := err.(*APIError); ok {
+			writeError(w, apiErr)
+			return
+		}
+		if err == mongo.ErrNoDocuments {
+			writeError(w, &APIError{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: "No history for " + strings.ToUpper(query.Get(av.QuerySymbol)),
+			})
+			return
+		}
+		writeError(w, errInternal)
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": query.Get(av.QuerySymbol)})
+		return
+	}
+
+	bars := make([]Bar, 0, len(values))
+	for _, v := range values {
+		bars = append(bars, NewBar(v))
+	}
+	body, err := json.Marshal(bars)
+	if err != nil {
+		writeError(w, errInternal)
+		return
+	}
+	writeCacheable(w, r.Header, "application/json", time.Time{}, 0, body)
+}
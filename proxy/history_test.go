@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const dailyAdjustedResponse = `{
+	"Meta Data": {
+		"1. Information": "Daily Time Series with Splits and Dividend Events",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-05",
+		"4. Output Size": "Compact",
+		"5. Time Zone": "US/Eastern"
+	},
+	"Time Series (Daily)": {
+		"2019-08-05": {"1. open": "100", "2. high": "110", "3. low": "90", "4. close": "100", "5. adjusted close": "100",
+			"6. volume": "1000", "7. dividend amount": "0.0000", "8. split coefficient": "2.0"},
+		"2019-08-02": {"1. open": "190", "2. high": "210", "3. low": "180", "4. close": "200", "5. adjusted close": "98",
+			"6. volume": "500", "7. dividend amount": "4.0000", "8. split coefficient": "1.0"}
+	}
+}`
+
+const prevDailyResponse = `{
+	"Meta Data": {
+		"1. Information": "Daily Prices (open, high, low, close) and Volumes",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-01",
+		"4. Output Size": "Compact",
+		"5. Time Zone": "US/Eastern"
+	},
+	"Time Series (Daily)": {
+		"2019-08-01": {"1. open": "180", "2. high": "200", "3. low": "170", "4. close": "200", "5. volume": "400"}
+	}
+}`
+
+const adjustIntradayResponse = `{
+	"Meta Data": {
+		"1. Information": "Intraday (1min) open, high, low, close prices and volume",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-05 09:32:00",
+		"4. Interval": "1min",
+		"5. Output Size": "Compact",
+		"6. Time Zone": "US/Eastern"
+	},
+	"Time Series (1min)": {
+		"2019-08-05 09:32:00": {"1. open": "100", "2. high": "100", "3. low": "100", "4. close": "100", "5. volume": "10"},
+		"2019-08-02 09:32:00": {"1. open": "200", "2. high": "200", "3. low": "200", "4. close": "200", "5. volume": "10"},
+		"2019-08-01 15:59:00": {"1. open": "200", "2. high": "200", "3. low": "200", "4. close": "200", "5. volume": "10"}
+	}
+}`
+
+// TestAdjustedHistory checks that intraday history is back-adjusted by
+// actions of imported daily adjusted response, close before its
+// oldest dividend is taken from stored daily bars.
+func TestAdjustedHistory(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	p, err := NewProxy(db, zap.NewNop(), Options{NoWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{prevDailyResponse, dailyAdjustedResponse, adjustIntradayResponse} {
+		if _, err := p.Import(ctx, []byte(body), nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actions, err := p.actions.Get(ctx, "AMZN")
+	if err != nil || len(actions) != 2 || actions[0].PrevClose != 200 {
+		t.Fatalf("wrong actions %+v: %v", actions, err)
+	}
+
+	w := httptest.NewRecorder()
+	p.GetHistory(w, httptest.NewRequest(http.MethodGet,
+		"/history/?function=TIME_SERIES_INTRADAY&interval=1min&symbol=amzn&adjusted=true", nil))
+	var bars []Bar
+	if err := json.Unmarshal(w.Body.Bytes(), &bars); err != nil || w.Code != http.StatusOK || len(bars) != 3 {
+		t.Fatalf("wrong response %d %s: %v", w.Code, w.Body, err)
+	}
+	// the first bar is before dividend and split, the second one
+	// before split only
+	expected := []struct{ close, volume float64 }{{200 * 0.98 / 2, 20}, {100, 20}, {100, 10}}
+	for i, bar := range bars {
+		if math.Abs(bar.Close-expected[i].close) > 1e-9 || bar.Volume != expected[i].volume {
+			t.Errorf("[%d] %s got %f %f, expected %+v", i, bar.Time, bar.Close, bar.Volume, expected[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	p.GetHistory(w, httptest.NewRequest(http.MethodGet, "/history/?function=GLOBAL_QUOTE&symbol=amzn&adjusted=true", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected error of not a time series, got %d", w.Code)
+	}
+}
+
+const weeklyAdjustedResponse = `{
+	"Meta Data": {
+		"1. Information": "Weekly Adjusted Prices and Volumes",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-09",
+		"4. Time Zone": "US/Eastern"
+	},
+	"Weekly Adjusted Time Series": {
+		"2019-08-09": {"1. open": "100", "2. high": "110", "3. low": "90", "4. close": "100", "5. adjusted close": "100",
+			"6. volume": "5000", "7. dividend amount": "4.0000"},
+		"2019-08-02": {"1. open": "190", "2. high": "210", "3. low": "180", "4. close": "200", "5. adjusted close": "98",
+			"6. volume": "2500", "7. dividend amount": "0.0000"}
+	}
+}`
+
+// TestWeeklyActions checks that dividend of weekly adjusted response,
+// dated by end of week, is not stored again besides the daily one.
+func TestWeeklyActions(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	p, err := NewProxy(db, zap.NewNop(), Options{NoWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{prevDailyResponse, dailyAdjustedResponse, weeklyAdjustedResponse} {
+		if _, err := p.Import(ctx, []byte(body), nil, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	actions, err := p.actions.Get(ctx, "AMZN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dividends := 0
+	for _, action := range actions {
+		if action.Dividend != 0 {
+			dividends++
+		}
+	}
+	if dividends != 1 || len(actions) != 2 {
+		t.Errorf("expected dividend and split of daily response, got %+v", actions)
+	}
+}
@@ -0,0 +1,410 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// ImportResult is outcome of import of a file.
+type ImportResult struct {
+	Query url.Values
+	// Bars is amount of bars in file, New of them were not stored
+	// and Duplicates were.
+	Bars       int
+	New        int
+	Duplicates int
+}
+
+// InferQuery returns series of a file by its name, e.g.
+// amzn_TIME_SERIES_INTRADAY_5min.csv, msft-daily-adjusted.json or
+// ibm_60min.csv. Unknown parts are left empty.
+func InferQuery(name string) url.Values {
+	base := filepath.Base(name)
+	base = strings.ToUpper(strings.TrimSuffix(base, filepath.Ext(base)))
+	query := url.Values{}
+
+	// adjusted names go first, they contain names of plain series
+	for _, ts := range []TimeSeries{
+		TimeSeriesDailyAdjusted, TimeSeriesWeeklyAdjusted, TimeSeriesMonthlyAdjusted,
+		TimeSeriesDaily, TimeSeriesWeekly, TimeSeriesMonthly, timeSeriesIntraday,
+	} {
+		if i := strings.Index(base, ts.keyName()); i >= 0 {
+			query.Set(av.QueryFunction, ts.keyName())
+			base = base[:i] + base[i+len(ts.keyName()):]
+			break
+		}
+	}
+
+	var period string
+	adjusted := false
+	tokens := strings.FieldsFunc(base, func(r rune) bool { return r == '_' || r == '-' || r == ' ' })
+	for _, token := range tokens {
+		switch token {
+		case "DAILY", "WEEKLY", "MONTHLY", "INTRADAY":
+			period = token
+			continue
+		case "ADJUSTED":
+			adjusted = true
+			continue
+		}
+		if validInterval(strings.ToLower(token)) {
+			query.Set(av.QueryInterval, strings.ToLower(token))
+			continue
+		}
+		if query.Get(av.QuerySymbol) == "" {
+			query.Set(av.QuerySymbol, token)
+		}
+	}
+
+	if query.Get(av.QueryFunction) == "" {
+		switch {
+		case period == "INTRADAY" || (period == "" && query.Get(av.QueryInterval) != ""):
+			query.Set(av.QueryFunction, timeSeriesIntraday.keyName())
+		case period != "":
+			function := "TIME_SERIES_" + period
+			if adjusted {
+				function += "_ADJUSTED"
+			}
+			query.Set(av.QueryFunction, function)
+		}
+	}
+	return query
+}
+
+// Import stores time series of a file, e.g. saved from Alpha Vantage,
+// without API calls. Json responses are described by their metadata,
+// csv data by hint, e.g. InferQuery of file name, and timestamps of
+// bars if function or interval is unknown. Only bars which are not
+// stored yet are added, nothing is stored if dryRun is true. Bars of
+// adjusted series are new unless stored by adjusted responses, and
+// dividends and splits are found in all bars of the file.
+func (p *Proxy) Import(ctx context.Context, body []byte, hint url.Values, dryRun bool) (*ImportResult, error) {
+	var imp *seriesImport
+	var err error
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		imp, err = importJSON(body)
+	} else {
+		imp, err = importCSV(body, hint)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	task, apiErr := p.newTask(ctx, nil, imp.query, false)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	defer task.cancel()
+	task.client = "import"
+
+	stored := map[time.Time]bool{}
+	item, err := p.db.Get(ctx, task.key)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	if err == nil {
+		for _, t := range storedTimes(item, task) {
+			stored[t] = true
+		}
+	}
+
+	res := &ImportResult{Query: imp.query, Bars: len(imp.times)}
+	for _, t := range imp.times {
+		if stored[t] {
+			res.Duplicates++
+		}
+	}
+	res.New = res.Bars - res.Duplicates
+	if res.New == 0 || dryRun {
+		return res, nil
+	}
+
+	full, err := imp.encode(nil)
+	if err != nil {
+		return nil, err
+	}
+	body, err = imp.encode(stored)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.storeActions(ctx, task, body, full, "application/json"); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// storedTimes returns times of stored bars of series of task. Daily
+// and daily adjusted series share data key, so bars of adjusted series
+// are looked up in adjusted responses only, as other ones have no
+// dividends and splits.
+func storedTimes(item *Item, task *Task) []time.Time {
+	dataKey := task.fn.DataKey(task.query)
+	times := []time.Time{}
+	ts, ok := parseTimeSeries(task.fn.Name)
+	if !ok || !ts.isAdjusted() {
+		for _, v := range seriesBars(item, dataKey) {
+			times = append(times, v.Time)
+		}
+		return times
+	}
+	for _, data := range item.Ohlcv {
+		if !bytes.HasPrefix(bytes.TrimSpace(data.Data), []byte("{")) {
+			continue
+		}
+		meta, err := parseMetaData(data.Data)
+		if err != nil {
+			continue
+		}
+		var resp map[string]json.RawMessage
+		if err := json.Unmarshal(data.Data, &resp); err != nil {
+			continue
+		}
+		if series, _, ok := seriesOf(resp, meta); !ok || series != ts {
+			continue
+		}
+		values, err := parseTimeSeriesJSON(data.Data, dataKey)
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			times = append(times, v.Time)
+		}
+	}
+	return times
+}
+
+// seriesImport is a parsed file of time series.
+type seriesImport struct {
+	query url.Values
+	times []time.Time
+	// encode returns json response without bars of skip
+	encode func(skip map[time.Time]bool) ([]byte, error)
+}
+
+// importJSON parses json response of time series.
+func importJSON(body []byte) (*seriesImport, error) {
+	meta, err := parseMetaData(body)
+	if err != nil {
+		return nil, err
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "error parsing response")
+	}
+	ts, dataKey, ok := seriesOf(resp, meta)
+	if !ok {
+		return nil, errors.New("unknown time series of response")
+	}
+	values, err := parseTimeSeriesJSON(body, dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	imp := &seriesImport{query: url.Values{}, times: make([]time.Time, 0, len(values))}
+	imp.query.Set(av.QueryFunction, ts.keyName())
+	imp.query.Set(av.QuerySymbol, meta.Symbol)
+	if meta.Interval != "" {
+		imp.query.Set(av.QueryInterval, meta.Interval)
+	}
+	for _, v := range values {
+		imp.times = append(imp.times, v.Time)
+	}
+	imp.encode = func(skip map[time.Time]bool) ([]byte, error) {
+		if len(skip) == 0 {
+			return body, nil
+		}
+		var bars map[string]json.RawMessage
+		if err := json.Unmarshal(resp[dataKey], &bars); err != nil {
+			return nil, err
+		}
+		for date := range bars {
+			t, err := parseDate(date, timeSeriesDateFormats...)
+			if err != nil {
+				return nil, err
+			}
+			if skip[t] {
+				delete(bars, date)
+			}
+		}
+		data, err := json.Marshal(bars)
+		if err != nil {
+			return nil, err
+		}
+		resp[dataKey] = data
+		return json.Marshal(resp)
+	}
+	return imp, nil
+}
+
+// importCSV parses csv data of time series of hint. Function and
+// interval are inferred from timestamps if hint has none.
+func importCSV(body []byte, hint url.Values) (*seriesImport, error) {
+	query := url.Values{}
+	for k, v := range hint {
+		query[k] = v
+	}
+	if query.Get(av.QuerySymbol) == "" {
+		return nil, errors.New("unknown symbol of csv data")
+	}
+
+	var ts TimeSeries
+	function := query.Get(av.QueryFunction)
+	if function != "" {
+		var ok bool
+		if ts, ok = parseTimeSeries(function); !ok {
+			return nil, errors.Errorf("%s is not a time series", function)
+		}
+	}
+
+	var values []*TimeSeriesAdjustedValue
+	if function != "" && ts.isAdjusted() {
+		var err error
+		if values, err = parseTimeSeriesAdjustedData(bytes.NewReader(body)); err != nil {
+			return nil, err
+		}
+	} else {
+		plain, err := parseTimeSeriesData(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		values = make([]*TimeSeriesAdjustedValue, 0, len(plain))
+		for _, v := range plain {
+			values = append(values, &TimeSeriesAdjustedValue{TimeSeriesValue: *v})
+		}
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no bars in csv data")
+	}
+
+	if function == "" {
+		ts = TimeSeriesDaily
+		if intraday(values) {
+			ts = timeSeriesIntraday
+		}
+		query.Set(av.QueryFunction, ts.keyName())
+	}
+	if ts == timeSeriesIntraday && query.Get(av.QueryInterval) == "" {
+		interval := barInterval(values)
+		if interval == "" {
+			return nil, errors.New("unknown interval of csv data")
+		}
+		query.Set(av.QueryInterval, interval)
+	}
+
+	// repeated rows of a bar are counted once
+	imp := &seriesImport{query: query, times: make([]time.Time, 0, len(values))}
+	for i, v := range values {
+		if i == 0 || !v.Time.Equal(values[i-1].Time) {
+			imp.times = append(imp.times, v.Time)
+		}
+	}
+	imp.encode = func(skip map[time.Time]bool) ([]byte, error) {
+		return encodeSeries(ts, query, values, skip)
+	}
+	return imp, nil
+}
+
+// intraday returns true if bars have time of day
+func intraday(values []*TimeSeriesAdjustedValue) bool {
+	for _, v := range values {
+		if h, m, s := v.Time.Clock(); h != 0 || m != 0 || s != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// barInterval returns interval of intraday bars by the shortest step
+// between them, it is empty if step is not an interval of Alpha
+// Vantage.
+func barInterval(values []*TimeSeriesAdjustedValue) string {
+	var step time.Duration
+	for i := 1; i < len(values); i++ {
+		d := values[i].Time.Sub(values[i-1].Time)
+		if d > 0 && (step == 0 || d < step) {
+			step = d
+		}
+	}
+	if step == 0 || step%time.Minute != 0 {
+		return ""
+	}
+	interval := strconv.Itoa(int(step/time.Minute)) + "min"
+	if !validInterval(interval) {
+		return ""
+	}
+	return interval
+}
+
+// encodeSeries returns bars of ts except ones of skip as json response
+// of Alpha Vantage.
+func encodeSeries(ts TimeSeries, query url.Values, values []*TimeSeriesAdjustedValue, skip map[time.Time]bool) ([]byte, error) {
+	fn, ok := av.LookupFunction(ts.keyName())
+	if !ok {
+		return nil, errors.Errorf("unknown function %s", ts.keyName())
+	}
+	layout := "2006-01-02"
+	if ts == timeSeriesIntraday {
+		layout = "2006-01-02 15:04:05"
+	}
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', -1, 64) }
+
+	series := map[string]map[string]string{}
+	var last time.Time
+	for _, v := range values {
+		if skip[v.Time] {
+			continue
+		}
+		bar := map[string]string{
+			"1. open":  format(v.Open),
+			"2. high":  format(v.High),
+			"3. low":   format(v.Low),
+			"4. close": format(v.Close),
+		}
+		if ts.isAdjusted() {
+			bar["5. adjusted close"] = format(v.AdjustedClose)
+			bar["6. volume"] = format(v.Volume)
+			bar["7. dividend amount"] = format(v.DividendAmount)
+			if ts == TimeSeriesDailyAdjusted {
+				bar["8. split coefficient"] = format(v.SplitCoefficient)
+			}
+		} else {
+			bar["5. volume"] = format(v.Volume)
+		}
+		series[v.Time.Format(layout)] = bar
+		if v.Time.After(last) {
+			last = v.Time
+		}
+	}
+	if len(series) == 0 {
+		return nil, errors.Errorf("no bars of %s", query.Get(av.QuerySymbol))
+	}
+
+	// seriesOf tells daily adjusted series by dividends in information
+	information := "Prices and Volumes imported from csv"
+	if ts.isAdjusted() {
+		information = "Adjusted Prices, Volumes, Dividend and Split Events imported from csv"
+	}
+	meta := map[string]string{
+		"1. Information":    information,
+		"2. Symbol":         query.Get(av.QuerySymbol),
+		"3. Last Refreshed": last.Format(layout),
+		"4. Time Zone":      "US/Eastern",
+	}
+	if ts == timeSeriesIntraday {
+		meta["5. Interval"] = query.Get(av.QueryInterval)
+	}
+	return json.Marshal(map[string]interface{}{
+		"Meta Data":       meta,
+		fn.DataKey(query): series,
+	})
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestInferQuery(t *testing.T) {
+	cases := []struct {
+		name     string
+		function string
+		symbol   string
+		interval string
+	}{
+		{"dumps/amzn_TIME_SERIES_INTRADAY_5min.csv", "TIME_SERIES_INTRADAY", "AMZN", "5min"},
+		{"msft-daily-adjusted.json", "TIME_SERIES_DAILY_ADJUSTED", "MSFT", ""},
+		{"IBM_TIME_SERIES_WEEKLY_ADJUSTED.csv", "TIME_SERIES_WEEKLY_ADJUSTED", "IBM", ""},
+		{"ibm_60min.csv", "TIME_SERIES_INTRADAY", "IBM", "60min"},
+		{"aapl.csv", "", "AAPL", ""},
+		{"monthly.csv", "TIME_SERIES_MONTHLY", "", ""},
+	}
+	for caseNum, item := range cases {
+		query := InferQuery(item.name)
+		if query.Get("function") != item.function || query.Get("symbol") != item.symbol ||
+			query.Get("interval") != item.interval {
+			t.Errorf("[%d] wrong query %v of %s", caseNum, query, item.name)
+		}
+	}
+}
+
+func TestImportCSV(t *testing.T) {
+	const intradayCSV = "timestamp,open,high,low,close,volume\n" +
+		"2019-08-06 09:40:00,2,3,1.5,2.5,20\n" +
+		"2019-08-06 09:35:00,1,2,0.5,1.5,10\n" +
+		"2019-08-06 09:35:00,1,2,0.5,1.5,10\n"
+	const dailyCSV = "timestamp,open,high,low,close,volume\n2019-08-06,1,2,0.5,1.5,10\n"
+
+	cases := []struct {
+		body     string
+		hint     url.Values
+		function string
+		interval string
+		bars     int
+		fail     bool
+	}{
+		{intradayCSV, url.Values{"symbol": {"AMZN"}}, "TIME_SERIES_INTRADAY", "5min", 2, false},
+		{intradayCSV, url.Values{"symbol": {"AMZN"}, "interval": {"1min"}}, "TIME_SERIES_INTRADAY", "1min", 2, false},
+		{dailyCSV, url.Values{"symbol": {"AMZN"}}, "TIME_SERIES_DAILY", "", 1, false},
+		{dailyCSV, url.Values{"symbol": {"AMZN"}, "function": {"TIME_SERIES_WEEKLY"}}, "TIME_SERIES_WEEKLY", "", 1, false},
+		{adjustedCSV, url.Values{"symbol": {"IBM"}, "function": {"TIME_SERIES_DAILY_ADJUSTED"}}, "TIME_SERIES_DAILY_ADJUSTED", "", 4, false},
+		// no symbol
+		{dailyCSV, url.Values{}, "", "", 0, true},
+		// not a time series
+		{dailyCSV, url.Values{"symbol": {"AMZN"}, "function": {"GLOBAL_QUOTE"}}, "", "", 0, true},
+		// daily bars of intraday series have no interval
+		{dailyCSV, url.Values{"symbol": {"AMZN"}, "function": {"TIME_SERIES_INTRADAY"}}, "", "", 0, true},
+		{"timestamp,open\n2019-08-06,1\n", url.Values{"symbol": {"AMZN"}}, "", "", 0, true},
+	}
+	for caseNum, item := range cases {
+		imp, err := importCSV([]byte(item.body), item.hint)
+		if (err != nil) != item.fail {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if imp.query.Get("function") != item.function || imp.query.Get("interval") != item.interval ||
+			len(imp.times) != item.bars {
+			t.Errorf("[%d] wrong import %v of %d bars", caseNum, imp.query, len(imp.times))
+			continue
+		}
+
+		// encoded response is imported as json of the same series
+		body, err := imp.encode(nil)
+		if err != nil {
+			t.Errorf("[%d] %v", caseNum, err)
+			continue
+		}
+		back, err := importJSON(body)
+		if err != nil {
+			t.Errorf("[%d] %v of %s", caseNum, err, body)
+			continue
+		}
+		if back.query.Encode() != imp.query.Encode() || len(back.times) != item.bars {
+			t.Errorf("[%d] got %v of %d bars from %s", caseNum, back.query, len(back.times), body)
+		}
+	}
+}
+
+func TestImportJSONSkip(t *testing.T) {
+	imp, err := importJSON([]byte(intradayResponse))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(imp.times) != 3 || imp.query.Get("interval") != "1min" || imp.query.Get("symbol") != "AMZN" {
+		t.Fatalf("wrong import %v of %d bars", imp.query, len(imp.times))
+	}
+
+	stored := time.Date(2019, 8, 5, 9, 32, 0, 0, time.UTC)
+	body, err := imp.encode(map[time.Time]bool{stored: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := parseTimeSeriesJSON(body, "Time Series (1min)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 {
+		t.Fatalf("expected 2 bars, got %d", len(values))
+	}
+	for _, v := range values {
+		if v.Time.Equal(stored) {
+			t.Errorf("stored bar %v is not skipped", v.Time)
+		}
+	}
+	if _, err := parseMetaData(body); err != nil {
+		t.Errorf("no metadata in %s: %v", body, err)
+	}
+}
+
+const plainDailyResponse = `{
+	"Meta Data": {
+		"1. Information": "Daily Prices (open, high, low, close) and Volumes",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-05",
+		"4. Output Size": "Compact",
+		"5. Time Zone": "US/Eastern"
+	},
+	"Time Series (Daily)": {
+		"2019-08-05": {"1. open": "100", "2. high": "110", "3. low": "90", "4. close": "100", "5. volume": "1000"},
+		"2019-08-02": {"1. open": "190", "2. high": "210", "3. low": "180", "4. close": "200", "5. volume": "500"},
+		"2019-08-01": {"1. open": "180", "2. high": "200", "3. low": "170", "4. close": "200", "5. volume": "400"}
+	}
+}`
+
+// TestImportAdjustedOverDaily checks that daily adjusted bars are not
+// skipped as duplicates of plain daily ones, so that their dividends
+// and splits are stored.
+func TestImportAdjustedOverDaily(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	p, err := NewProxy(db, zap.NewNop(), Options{NoWorkers: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.Import(ctx, []byte(plainDailyResponse), nil, false); err != nil {
+		t.Fatal(err)
+	}
+	res, err := p.Import(ctx, []byte(dailyAdjustedResponse), nil, false)
+	if err != nil || res.New != 2 || res.Duplicates != 0 {
+		t.Fatalf("adjusted bars must be new, got %+v: %v", res, err)
+	}
+
+	actions, err := p.actions.Get(ctx, "AMZN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []CorporateAction{
+		{Ticker: "AMZN", Time: time.Date(2019, 8, 2, 0, 0, 0, 0, time.UTC), Dividend: 4, Split: 1, PrevClose: 200},
+		{Ticker: "AMZN", Time: time.Date(2019, 8, 5, 0, 0, 0, 0, time.UTC), Split: 2, PrevClose: 200},
+	}
+	if len(actions) != len(expected) {
+		t.Fatalf("expected %d actions, got %+v", len(expected), actions)
+	}
+	for i := range actions {
+		if !actions[i].Time.Equal(expected[i].Time) || actions[i].Dividend != expected[i].Dividend ||
+			actions[i].Split != expected[i].Split || actions[i].PrevClose != expected[i].PrevClose {
+			t.Errorf("[%d] got %+v, expected %+v", i, actions[i], expected[i])
+		}
+	}
+
+	// the same adjusted bars are duplicates
+	res, err = p.Import(ctx, []byte(dailyAdjustedResponse), nil, true)
+	if err != nil || res.New != 0 {
+		t.Errorf("adjusted bars must be duplicates, got %+v: %v", res, err)
+	}
+}
@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/adnilote/stock-proxy/redact"
+)
+
+// storeRetry is delay of acquire after error of LimitStore.
+const storeRetry = 5 * time.Second
+
+// keyring hands out Alpha Vantage API keys, so that each key is used
+// at most limit times in any minute by all proxies sharing store.
+type keyring struct {
+	mu    sync.Mutex
+	keys  []string
+	limit int
+	next  int
+	// store keeps calls of keys, see LimitStore
+	store LimitStore
+	// report is called on errors of store
+	report func(error)
+	// updated is closed and replaced on update
+	updated chan struct{}
+}
+
+// newKeyring returns keyring of keys. Calls are kept in memory, if
+// store is nil.
+func newKeyring(keys []string, limit int, store LimitStore) *keyring {
+	if store == nil {
+		store = NewMemoryLimitStore()
+	}
+	return &keyring{
+		keys:    keys,
+		limit:   limit,
+		store:   store,
+		report:  func(error) {},
+		updated: make(chan struct{}),
+	}
+}
+
+// acquire waits until some key has budget left and returns it.
+// The call is accounted at the moment of return. Returns false if
+// stop or cancel is closed before any key is available.
+func (k *keyring) acquire(stop, cancel <-chan struct{}) (string, bool) {
+	for {
+		select {
+		case <-cancel:
+			return "", false
+		default:
+		}
+
+		k.mu.Lock()
+		now := time.Now()
+
+		// round robin over keys
+		wait := limitWindow
+		for i := 0; i < len(k.keys); i++ {
+			key := k.keys[(k.next+i)%len(k.keys)]
+			ok, free, err := k.store.Take(key, k.limit, now)
+			if err != nil {
+				// do not risk a ban while store is down
+				k.report(err)
+				wait = storeRetry
+				break
+			}
+			if ok {
+				k.next = (k.next + i + 1) % len(k.keys)
+				k.mu.Unlock()
+				return key, true
+			}
+			if d := free.Sub(now); d < wait {
+				wait = d
+			}
+		}
+		updated := k.updated
+		k.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-updated:
+			timer.Stop()
+		case <-stop:
+			timer.Stop()
+			return "", false
+		case <-cancel:
+			timer.Stop()
+			return "", false
+		}
+	}
+}
+
+// left returns amount of requests left in the current minute
+// over all keys.
+func (k *keyring) left() int {
+	left := 0
+	for _, n := range k.budget() {
+		left += n
+	}
+	return left
+}
+
+// budget returns requests left in the current minute by masked key.
+func (k *keyring) budget() map[string]int {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	now := time.Now()
+
+	budget := map[string]int{}
+	for _, key := range k.keys {
+		calls, err := k.store.Count(key, now)
+		if err != nil {
+			k.report(err)
+			calls = k.limit
+		}
+		left := k.limit - calls
+		if left < 0 {
+			left = 0
+		}
+		budget[redact.Mask(key)] += left
+	}
+	return budget
+}
+
+// update replaces keys and limit. Calls of kept keys are preserved
+// in store, so that reload does not exceed limit.
+func (k *keyring) update(keys []string, limit int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.keys, k.limit = keys, limit
+	k.next = 0
+	close(k.updated)
+	k.updated = make(chan struct{})
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyring(t *testing.T) {
+	k := newKeyring([]string{"a", "b"}, 2, nil)
+
+	got := map[string]int{}
+	for i := 0; i < 4; i++ {
+		key, _ := k.acquire(nil, nil)
+		got[key]++
+	}
+	if got["a"] != 2 || got["b"] != 2 {
+		t.Errorf("keys must be used evenly: %v", got)
+	}
+	if k.left() != 0 {
+		t.Errorf("must be 0 left, got %d", k.left())
+	}
+
+	// blocked acquire returns after update adds a key
+	done := make(chan string)
+	go func() {
+		key, _ := k.acquire(nil, nil)
+		done <- key
+	}()
+	time.Sleep(10 * time.Millisecond)
+	k.update([]string{"b", "c"}, 2)
+
+	select {
+	case key := <-done:
+		if key != "c" {
+			t.Errorf("expected new key c, got %s", key)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("acquire is not woken up by update")
+	}
+	// calls of b are kept
+	if k.left() != 1 {
+		t.Errorf("must be 1 left, got %d", k.left())
+	}
+
+	// blocked acquire returns after stop
+	k.acquire(nil, nil)
+	stop := make(chan struct{})
+	close(stop)
+	if _, ok := k.acquire(stop, nil); ok {
+		t.Errorf("acquire without budget must fail on stop")
+	}
+	// cancelled task gets no key, even if there is budget
+	k.update([]string{"d"}, 1)
+	if _, ok := k.acquire(nil, stop); ok {
+		t.Errorf("acquire must fail on cancel")
+	}
+	if k.left() != 1 {
+		t.Errorf("cancelled acquire must not spend budget")
+	}
+}
+
+func TestKeyringBudget(t *testing.T) {
+	k := newKeyring([]string{"7Z29L509PNF9IE24", "abc"}, 2, nil)
+	k.acquire(nil, nil)
+
+	budget := k.budget()
+	if budget["****IE24"] != 1 || budget["****"] != 2 || len(budget) != 2 {
+		t.Errorf("wrong budget: %v", budget)
+	}
+}
@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"sync"
+	"time"
+
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// limitWindow is window of API key limit, Alpha Vantage counts calls
+// per minute.
+const limitWindow = time.Minute
+
+// LimitStore keeps calls of API keys and leases of background jobs.
+// Proxy instances sharing a store together use each key at most limit
+// times in any minute, so that replicas are not banned.
+//
+// MemoryLimitStore serves a single instance, MongoLimitStore is shared
+// by replicas. Other shared stores, e.g. Redis sorted sets and SET NX
+// leases, implement the same interface. Instances must have synced
+// clocks, e.g. by NTP, as calls are timed by instance.
+type LimitStore interface {
+	// Take records call of key at now, if key has less than limit
+	// calls in the minute before now. Otherwise it returns false and
+	// time when the oldest call leaves the window.
+	Take(key string, limit int, now time.Time) (bool, time.Time, error)
+	// Count returns amount of calls of key in the minute before now.
+	Count(key string, now time.Time) (int, error)
+	// Lease acquires or renews lease of job name by owner until
+	// now+ttl. Returns true if owner holds the lease.
+	Lease(name, owner string, ttl time.Duration, now time.Time) (bool, error)
+}
+
+// MemoryLimitStore is a LimitStore in memory. It may be shared by
+// proxies of one process, e.g. in tests.
+type MemoryLimitStore struct {
+	mu sync.Mutex
+	// calls are times of calls by key in the last minute
+	calls  map[string][]time.Time
+	leases map[string]lease
+}
+
+type lease struct {
+	owner   string
+	expires time.Time
+}
+
+// NewMemoryLimitStore returns empty store.
+func NewMemoryLimitStore() *MemoryLimitStore {
+	return &MemoryLimitStore{
+		calls:  map[string][]time.Time{},
+		leases: map[string]lease{},
+	}
+}
+
+// prune drops calls of key older than a minute, must be called under
+// lock.
+func (s *MemoryLimitStore) prune(key string, now time.Time) []time.Time {
+	calls := s.calls[key]
+	i := 0
+	for i < len(calls) && now.Sub(calls[i]) >= limitWindow {
+		i++
+	}
+	s.calls[key] = calls[i:]
+	return calls[i:]
+}
+
+// Take records call of key, see LimitStore.
+func (s *MemoryLimitStore) Take(key string, limit int, now time.Time) (bool, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	calls := s.prune(key, now)
+	if len(calls) < limit {
+		s.calls[key] = append(calls, now)
+		return true, time.Time{}, nil
+	}
+	if len(calls) == 0 {
+		// zero limit, retry in a window
+		return false, now.Add(limitWindow), nil
+	}
+	return false, calls[0].Add(limitWindow), nil
+}
+
+// Count returns calls of key in the last minute, see LimitStore.
+func (s *MemoryLimitStore) Count(key string, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.prune(key, now)), nil
+}
+
+// Lease acquires or renews lease, see LimitStore.
+func (s *MemoryLimitStore) Lease(name, owner string, ttl time.Duration, now time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if l, ok := s.leases[name]; ok && l.owner != owner && now.Before(l.expires) {
+		return false, nil
+	}
+	s.leases[name] = lease{owner: owner, expires: now.Add(ttl)}
+	return true, nil
+}
+
+// MongoLimitStore is a LimitStore shared by proxy instances. Calls of
+// a key are kept in one document, which is updated atomically:
+//
+//	{"_id": "<sha256 of key>", "calls": [ISODate, ...]}
+//
+// Leases are documents {"_id": "<job>", "owner": "...", "expires": ISODate}.
+type MongoLimitStore struct {
+	calls   *mongo.Collection
+	leases  *mongo.Collection
+	timeout time.Duration
+}
+
+// NewMongoLimitStore returns store of calls and leases in collections,
+// operations are limited by timeout.
+func NewMongoLimitStore(calls, leases *mongo.Collection, timeout time.Duration) *MongoLimitStore {
+	return &MongoLimitStore{calls: calls, leases: leases, timeout: timeout}
+}
+
+// callsDoc is document of calls of API key.
+type callsDoc struct {
+	Calls []time.Time `bson:"calls"`
+}
+
+// Take records call of key, see LimitStore.
+func (s *MongoLimitStore) Take(key string, limit int, now time.Time) (bool, time.Time, error) {
+	ctx, cancel := dbContext(context.Background(), s.timeout)
+	defer cancel()
+	id := keyID(key)
+
+	// drop calls out of window, document is created if missing
+	_, err := s.calls.UpdateOne(ctx, bson.M{"_id": id},
+		bson.M{"$pull": bson.M{"calls": bson.M{"$lte": now.Add(-limitWindow)}}},
+		options.Update().SetUpsert(true))
+	if err != nil {
+		return false, time.Time{}, errors.Wrap(err, "prune api calls")
+	}
+
+	// push matches only while there are less than limit calls
+	if limit > 0 {
+		res, err := s.calls.UpdateOne(ctx,
+			bson.M{"_id": id, "calls." + strconv.Itoa(limit-1): bson.M{"$exists": false}},
+			bson.M{"$push": bson.M{"calls": now}})
+		if err != nil {
+			return false, time.Time{}, errors.Wrap(err, "take api call")
+		}
+		if res.MatchedCount == 1 {
+			return true, time.Time{}, nil
+		}
+	}
+
+	// key is spent, the oldest call frees budget
+	var doc callsDoc
+	if err := s.calls.FindOne(ctx, bson.M{"_id": id}).Decode(&doc); err != nil {
+		return false, time.Time{}, errors.Wrap(err, "get api calls")
+	}
+	free := now.Add(limitWindow)
+	for _, call := range doc.Calls {
+		if t := call.Add(limitWindow); t.Before(free) {
+			free = t
+		}
+	}
+	return false, free, nil
+}
+
+// Count returns calls of key in the last minute, see LimitStore.
+func (s *MongoLimitStore) Count(key string, now time.Time) (int, error) {
+	ctx, cancel := dbContext(context.Background(), s.timeout)
+	defer cancel()
+
+	var doc callsDoc
+	err := s.calls.FindOne(ctx, bson.M{"_id": keyID(key)}).Decode(&doc)
+	if err == mongo.ErrNoDocuments {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "get api calls")
+	}
+	n := 0
+	for _, call := range doc.Calls {
+		if now.Sub(call) < limitWindow {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Lease acquires or renews lease, see LimitStore. Lease held by other
+// owner does not match the query, so upsert fails on duplicate _id.
+func (s *MongoLimitStore) Lease(name, owner string, ttl time.Duration, now time.Time) (bool, error) {
+	ctx, cancel := dbContext(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.leases.UpdateOne(ctx,
+		bson.M{"_id": name, "$or": []bson.M{{"owner": owner}, {"expires": bson.M{"$lte": now}}}},
+		bson.M{"$set": bson.M{"owner": owner, "expires": now.Add(ttl)}},
+		options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, "lease "+name)
+	}
+	return true, nil
+}
+
+// Leader returns true if proxy holds lease of background job for
+// ttl, so that only one of proxies sharing LimitStore runs the job.
+// Leader renews lease by calling Leader again before ttl passes.
+func (p *Proxy) Leader(job string, ttl time.Duration) bool {
+	ok, err := p.keys.store.Lease(job, p.instance, ttl, time.Now())
+	if err != nil {
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"job": job})
+		return false
+	}
+	return ok
+}
+
+// keyID identifies API key in shared store without storing the key.
+func keyID(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:16])
+}
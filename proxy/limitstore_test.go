@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+func TestMemoryLimitStore(t *testing.T) {
+	s := NewMemoryLimitStore()
+	start := time.Now()
+
+	cases := []struct {
+		at   time.Duration
+		ok   bool
+		free time.Duration
+	}{
+		{0, true, 0},
+		{10 * time.Second, true, 0},
+		{20 * time.Second, false, time.Minute},
+		{time.Minute, true, 0},
+		{time.Minute + 5*time.Second, false, 70 * time.Second},
+	}
+	for caseNum, item := range cases {
+		ok, free, _ := s.Take("a", 2, start.Add(item.at))
+		if ok != item.ok {
+			t.Errorf("[%d] got %v, expected %v", caseNum, ok, item.ok)
+		}
+		if !ok && !free.Equal(start.Add(item.free)) {
+			t.Errorf("[%d] wrong free time %s", caseNum, free.Sub(start))
+		}
+	}
+	if n, _ := s.Count("a", start.Add(time.Minute+5*time.Second)); n != 2 {
+		t.Errorf("must be 2 calls, got %d", n)
+	}
+}
+
+func TestLease(t *testing.T) {
+	s := NewMemoryLimitStore()
+	start := time.Now()
+
+	cases := []struct {
+		owner string
+		at    time.Duration
+		ok    bool
+	}{
+		{"a", 0, true},
+		{"b", time.Second, false},
+		// leader renews lease
+		{"a", 5 * time.Second, true},
+		{"b", 12 * time.Second, false},
+		// lease of failed leader expires
+		{"b", 16 * time.Second, true},
+		{"a", 17 * time.Second, false},
+	}
+	for caseNum, item := range cases {
+		ok, _ := s.Lease("backfill", item.owner, 10*time.Second, start.Add(item.at))
+		if ok != item.ok {
+			t.Errorf("[%d] lease by %s: got %v, expected %v", caseNum, item.owner, ok, item.ok)
+		}
+	}
+}
+
+// upstream sends requests of av-client to server instead of Alpha
+// Vantage.
+type upstream struct {
+	server *httptest.Server
+}
+
+func (u upstream) RoundTrip(r *http.Request) (*http.Response, error) {
+	target, _ := url.Parse(u.server.URL)
+	r.URL.Scheme, r.URL.Host = target.Scheme, target.Host
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// offlineDB returns database of unreachable mongoDB, operations fail
+// at once.
+func offlineDB(t *testing.T) *mongo.Database {
+	client, err := mongo.Connect(context.Background(), options.Client().
+		ApplyURI("mongodb://127.0.0.1:1").
+		SetServerSelectionTimeout(10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Disconnect(context.Background()) })
+	return client.Database("av")
+}
+
+// TestSharedLimit checks that proxies sharing store together send
+// each key to Alpha Vantage at most limit times, and that lease of
+// background job passes to other proxy when leader stops renewing it.
+func TestSharedLimit(t *testing.T) {
+	var mu sync.Mutex
+	calls := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls[r.URL.Query().Get("apikey")]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"Global Quote": {"01. symbol": "` + r.URL.Query().Get("symbol") + `"}}`))
+	}))
+	defer server.Close()
+
+	store := NewMemoryLimitStore()
+	db := offlineDB(t)
+	proxies := []*Proxy{}
+	for _, instance := range []string{"one", "two"} {
+		p, err := NewProxy(db, zap.NewNop(), Options{
+			APIKeys:         []string{"a", "b"},
+			RequestLimit:    3,
+			LimitStore:      store,
+			Instance:        instance,
+			ShutdownTimeout: time.Second,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		p.av.Conn.Transport = upstream{server}
+		defer p.Close()
+		proxies = append(proxies, p)
+	}
+
+	// clients give up on tasks left without budget
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	answered := 0
+	var wg sync.WaitGroup
+	for _, p := range proxies {
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(p *Proxy, i int) {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				r := httptest.NewRequest(http.MethodGet, "/sync/?function=GLOBAL_QUOTE&symbol=s"+strconv.Itoa(i), nil)
+				p.GetOHLCVSync(w, r.WithContext(ctx))
+				if strings.Contains(w.Body.String(), "Global Quote") {
+					mu.Lock()
+					answered++
+					mu.Unlock()
+				}
+			}(p, i)
+		}
+	}
+	wg.Wait()
+
+	mu.Lock()
+	if calls["a"] != 3 || calls["b"] != 3 || len(calls) != 2 {
+		t.Errorf("keys must be sent 3 times by all proxies: %v", calls)
+	}
+	if answered != 6 {
+		t.Errorf("expected 6 answered requests, got %d", answered)
+	}
+	mu.Unlock()
+	for _, p := range proxies {
+		if p.keys.left() != 0 {
+			t.Errorf("proxy %s must see spent budget, got %d left", p.instance, p.keys.left())
+		}
+	}
+
+	// one leader of background jobs
+	const ttl = 50 * time.Millisecond
+	if !proxies[0].Leader("backfill", ttl) || proxies[1].Leader("backfill", ttl) {
+		t.Fatalf("expected leader one")
+	}
+	// leader renews lease
+	time.Sleep(ttl / 2)
+	if !proxies[0].Leader("backfill", ttl) || proxies[1].Leader("backfill", ttl) {
+		t.Fatalf("leader one must renew lease")
+	}
+	// lease of stopped leader expires
+	time.Sleep(ttl + 10*time.Millisecond)
+	if !proxies[1].Leader("backfill", ttl) || proxies[0].Leader("backfill", ttl) {
+		t.Errorf("lease must pass to two after it expired")
+	}
+}
@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.uber.org/zap"
+)
+
+// closedMarketResponse returns stored intraday response of task, if
+// market is closed and the response was refreshed after the last
+// regular close, so that fetching it again would return the same bars.
+func (p *Proxy) closedMarketResponse(task *Task) ([]byte, bool) {
+	ts, ok := parseTimeSeries(task.fn.Name)
+	if !ok || ts != timeSeriesIntraday {
+		return nil, false
+	}
+	if task.query.Get(av.QueryDataType) == "csv" {
+		return nil, false
+	}
+	now := time.Now()
+	if p.cal.SessionAt(now) != calendar.Closed {
+		return nil, false
+	}
+	lastClose := p.cal.LastClose(now)
+
+	item, err := p.db.Get(task.ctx, task.key)
+	if err != nil {
+		return nil, false
+	}
+
+	full := task.query.Get(av.QueryOutputSize) == "full"
+	// the latest responses are in the end
+	for i := len(item.Ohlcv) - 1; i >= 0; i-- {
+		data := item.Ohlcv[i].Data
+		if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			continue
+		}
+		meta, err := parseMetaData(data)
+		if err != nil || meta.Interval != task.query.Get(av.QueryInterval) {
+			continue
+		}
+		if full && !strings.HasPrefix(meta.OutputSize, "Full") {
+			continue
+		}
+		if meta.LastRefreshed.Before(lastClose) {
+			// older responses are not fresher
+			return nil, false
+		}
+		task.lg.Debug("Market is closed, send stored response", zap.String("ticker", task.key))
+		return data, true
+	}
+	return nil, false
+}
+
+// freshResponse returns stored response of task which fetching again
+// would not change: intraday one, see closedMarketResponse, or one of
+// daily and longer series refreshed on the day of the last close
+// while market is closed.
+func (p *Proxy) freshResponse(task *Task) ([]byte, bool) {
+	if body, ok := p.closedMarketResponse(task); ok {
+		return body, true
+	}
+	ts, ok := parseTimeSeries(task.fn.Name)
+	if !ok || ts == timeSeriesIntraday {
+		return nil, false
+	}
+	if task.query.Get(av.QueryDataType) == "csv" {
+		return nil, false
+	}
+	now := time.Now()
+	if p.cal.SessionAt(now) != calendar.Closed {
+		return nil, false
+	}
+	y, m, d := p.cal.LastClose(now).Date()
+	lastDay := time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+
+	item, err := p.db.Get(task.ctx, task.key)
+	if err != nil {
+		return nil, false
+	}
+
+	full := task.query.Get(av.QueryOutputSize) == "full"
+	// the latest responses are in the end
+	for i := len(item.Ohlcv) - 1; i >= 0; i-- {
+		data := item.Ohlcv[i].Data
+		if !bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")) {
+			continue
+		}
+		meta, err := parseMetaData(data)
+		if err != nil || meta.rolledUp() {
+			// bars rolled up by Retention are not a response
+			// of Alpha Vantage
+			continue
+		}
+		var resp map[string]json.RawMessage
+		if err := json.Unmarshal(data, &resp); err != nil {
+			continue
+		}
+		if series, _, ok := seriesOf(resp, meta); !ok || series != ts {
+			continue
+		}
+		if full && !strings.HasPrefix(meta.OutputSize, "Full") {
+			continue
+		}
+		y, m, d := meta.LastRefreshed.Date()
+		if time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Before(lastDay) {
+			// older responses are not fresher
+			return nil, false
+		}
+		task.lg.Debug("Market is closed, send stored response", zap.String("ticker", task.key))
+		return data, true
+	}
+	return nil, false
+}
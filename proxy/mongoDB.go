@@ -1,10 +1,31 @@
 package proxy
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"strings"
+	"time"
 
-	mgo "gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
+	"github.com/adnilote/stock-proxy/metrics"
+	"github.com/adnilote/stock-proxy/tracing"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Collections of proxy in its database.
+const (
+	collTimeseries = "timeseries"
+	collActions    = "corporate_actions"
+	collPending    = "pending_tasks"
 )
 
 // OHLCV
@@ -19,55 +40,368 @@ type OHLCV struct {
 
 // Item struct is a document in mongoDB
 type Item struct {
-	ID     bson.ObjectId `json:"id" bson:"_id"`
-	Ticker string        `json:"ticker" bson:"ticker"`
-	Ohlcv  []bson.Binary `json:"ohlcv" bson:"ohlcv"`
+	ID     primitive.ObjectID `json:"id" bson:"_id,omitempty"`
+	Ticker string             `json:"ticker" bson:"ticker"`
+	Ohlcv  []primitive.Binary `json:"ohlcv" bson:"ohlcv"`
+	// Updated is time of the last change, records of old versions
+	// have none
+	Updated time.Time `json:"updated" bson:"updated,omitempty"`
+	// Series describe json responses of time series in Ohlcv, other
+	// responses have none
+	Series []Series `json:"series,omitempty" bson:"series,omitempty"`
+}
+
+// Series describes stored json response of time series, records are
+// indexed by function, interval and time of the last bar, see indexes.
+type Series struct {
+	Function  string    `json:"function" bson:"function"`
+	Interval  string    `json:"interval,omitempty" bson:"interval,omitempty"`
+	Timestamp time.Time `json:"timestamp" bson:"timestamp"`
+}
+
+// responseSeries returns Series of json response of time series.
+func responseSeries(body []byte) (Series, bool) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return Series{}, false
+	}
+	meta, err := parseMetaData(body)
+	if err != nil {
+		return Series{}, false
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return Series{}, false
+	}
+	ts, _, ok := seriesOf(resp, meta)
+	if !ok {
+		return Series{}, false
+	}
+	return Series{Function: ts.keyName(), Interval: meta.Interval, Timestamp: meta.LastRefreshed}, true
+}
+
+// ohlcvSeries returns Series of responses.
+func ohlcvSeries(responses [][]byte) []Series {
+	series := []Series{}
+	for _, body := range responses {
+		if s, ok := responseSeries(body); ok {
+			series = append(series, s)
+		}
+	}
+	return series
 }
 
 // MongoDB instance of mongoDB, which can
 // add and get documents to db
 type MongoDB struct {
-	db *mgo.Collection
+	db      *mongo.Collection
+	metrics *metrics.Metrics
+	// timeout of operations, see dbContext
+	timeout time.Duration
+	// compression of added responses, see encodePayload
+	compression Compression
 }
 
-// Add adds val by key to db
-func (m *MongoDB) Add(key string, val []byte) error {
-	key = strings.ToUpper(key)
-	record := bson.M{
-		"ticker": key,
+// dbContext returns ctx limited by timeout of db operation, zero
+// timeout means no limit.
+func dbContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
 	}
-	err := m.db.Find(record).One(&Item{})
+	return context.WithTimeout(ctx, timeout)
+}
 
+// Add adds val by key to db, ctx carries trace of the operation
+func (m *MongoDB) Add(ctx context.Context, key string, val []byte) error {
+	ctx, span := tracing.Tracer().Start(ctx, "mongo.add", trace.WithAttributes(
+		attribute.String("ticker", strings.ToUpper(key)), attribute.Int("size", len(val))))
+	defer span.End()
+
+	start := time.Now()
+	err := m.add(ctx, key, val)
+	m.metrics.ObserveMongo("add", start, err)
 	if err != nil {
-		// create new record in db
-		err := m.db.Insert(bson.M{
-			"ticker": key,
-			"ohlcv": []bson.Binary{
-				bson.Binary{Kind: 0x00, Data: val},
-			},
-		})
-		if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// add pushes val to record of key, record is created by upsert if
+// missing. Unique index on ticker makes concurrent upserts of a new key
+// create one record, the losing upsert fails on duplicate key and is
+// retried as update.
+func (m *MongoDB) add(ctx context.Context, key string, val []byte) error {
+	ctx, cancel := dbContext(ctx, m.timeout)
+	defer cancel()
+
+	record := bson.M{"ticker": strings.ToUpper(key)}
+	push := bson.M{"ohlcv": encodePayload(val, m.compression)}
+	if series, ok := responseSeries(val); ok {
+		push["series"] = series
+	}
+	change := bson.M{
+		"$push": push,
+		"$set":  bson.M{"updated": time.Now()},
+	}
+	_, err := m.db.UpdateOne(ctx, record, change, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		_, err = m.db.UpdateOne(ctx, record, change)
+	}
+	return err
+}
+
+// Get return record from db by key with decompressed responses,
+// mongo.ErrNoDocuments if there is none.
+func (m *MongoDB) Get(ctx context.Context, key string) (*Item, error) {
+	ctx, cancel := dbContext(ctx, m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	item := Item{}
+	err := m.db.FindOne(ctx, bson.M{"ticker": strings.ToUpper(key)}).Decode(&item)
+	m.metrics.ObserveMongo("get", start, err)
+	if err != nil {
+		return nil, err
+	}
+	if err := decodeItem(&item); err != nil {
+		return nil, err
+	}
+	return &item, nil
+}
+
+// Each calls fn with every record of db with decompressed responses,
+// until fn returns error.
+func (m *MongoDB) Each(ctx context.Context, fn func(item *Item) error) error {
+	return m.each(ctx, func(item *Item) error {
+		if err := decodeItem(item); err != nil {
 			return err
 		}
-		return nil
-	}
+		return fn(item)
+	})
+}
 
-	// Add ohlcv to db
-	change := bson.M{"$push": bson.M{"ohlcv": bson.Binary{Kind: 0x00, Data: val}}}
-	err = m.db.Update(record, change)
+// each calls fn with every record of db as stored.
+func (m *MongoDB) each(ctx context.Context, fn func(item *Item) error) error {
+	cur, err := m.db.Find(ctx, bson.M{})
 	if err != nil {
 		return err
 	}
+	defer cur.Close(ctx)
+	for cur.Next(ctx) {
+		item := Item{}
+		if err := cur.Decode(&item); err != nil {
+			return err
+		}
+		if err := fn(&item); err != nil {
+			return err
+		}
+	}
+	return cur.Err()
+}
 
-	return nil
+// Replace sets responses of record item to ohlcv, which are
+// compressed, unless responses were added since item was read.
+// Returns true if record is replaced.
+func (m *MongoDB) Replace(ctx context.Context, item *Item, ohlcv []primitive.Binary) (bool, error) {
+	stored := make([]primitive.Binary, len(ohlcv))
+	responses := make([][]byte, len(ohlcv))
+	for i, b := range ohlcv {
+		stored[i] = encodePayload(b.Data, m.compression)
+		responses[i] = b.Data
+	}
+	return m.replace(ctx, item, stored, ohlcvSeries(responses))
 }
 
-// Get return record from db by key
-func (m *MongoDB) Get(key string) (*Item, error) {
-	item := Item{}
-	err := m.db.Find(bson.M{"ticker": strings.ToUpper(key)}).One(&item)
+// replace sets responses of record item to stored ohlcv and their
+// series, see Replace.
+func (m *MongoDB) replace(ctx context.Context, item *Item, ohlcv []primitive.Binary, series []Series) (bool, error) {
+	ctx, cancel := dbContext(ctx, m.timeout)
+	defer cancel()
+
+	start := time.Now()
+	res, err := m.db.UpdateOne(ctx,
+		bson.M{"_id": item.ID, "ohlcv": bson.M{"$size": len(item.Ohlcv)}},
+		bson.M{"$set": bson.M{"ohlcv": ohlcv, "series": series, "updated": time.Now()}})
+	m.metrics.ObserveMongo("replace", start, err)
+	if err != nil {
+		return false, err
+	}
+	return res.MatchedCount == 1, nil
+}
+
+// StorageSize is storage used by record of a ticker.
+type StorageSize struct {
+	Ticker    string `json:"ticker" bson:"ticker"`
+	Responses int    `json:"responses" bson:"responses"`
+	Bytes     int64  `json:"bytes" bson:"bytes"`
+}
+
+// Sizes returns storage size of records, the largest first. Size is
+// BSON size of record, which requires MongoDB 4.4.
+func (m *MongoDB) Sizes(ctx context.Context) ([]StorageSize, error) {
+	ctx, cancel := dbContext(ctx, m.timeout)
+	defer cancel()
+
+	cur, err := m.db.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$project", Value: bson.D{
+			{Key: "ticker", Value: 1},
+			{Key: "responses", Value: bson.D{{Key: "$size", Value: "$ohlcv"}}},
+			{Key: "bytes", Value: bson.D{{Key: "$bsonSize", Value: "$$ROOT"}}},
+		}}},
+		{{Key: "$sort", Value: bson.D{{Key: "bytes", Value: -1}}}},
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &item, nil
+	sizes := []StorageSize{}
+	if err := cur.All(ctx, &sizes); err != nil {
+		return nil, err
+	}
+	return sizes, nil
+}
+
+// Ping checks connection to db
+func (m *MongoDB) Ping(ctx context.Context) error {
+	return m.db.Database().Client().Ping(ctx, readpref.Primary())
+}
+
+// Error codes of index creation, when index of the same name or keys
+// exists with other options.
+const (
+	codeIndexOptionsConflict  = 85
+	codeIndexKeySpecsConflict = 86
+)
+
+// indexes are created by EnsureIndexes, by collection. Ticker of
+// stored responses is av.Function.Key: the bare symbol for all time
+// series of it, and prefixed by function family for others, e.g.
+// "QUOTE:AMZN". It is unique, so that MongoDB.Add upserts one record.
+// Time series of a ticker are found by function, interval and time of
+// the last bar of Item.Series. Records changed since a time, e.g. by
+// incremental backup, are found by updated.
+var indexes = map[string][]mongo.IndexModel{
+	collTimeseries: {
+		{
+			Keys:    bson.D{{Key: "ticker", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{Keys: bson.D{
+			{Key: "ticker", Value: 1},
+			{Key: "series.function", Value: 1},
+			{Key: "series.interval", Value: 1},
+			{Key: "series.timestamp", Value: 1},
+		}},
+		{Keys: bson.D{{Key: "updated", Value: 1}}},
+	},
+	collActions: {
+		{
+			Keys:    bson.D{{Key: "ticker", Value: 1}, {Key: "time", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	},
+	collPending: {
+		{Keys: bson.D{{Key: "created", Value: 1}}},
+	},
+}
+
+// EnsureIndexes creates indexes of proxy collections in db. Existing
+// indexes with other options, e.g. not unique ones of old versions,
+// are recreated. Records of the same ticker, which old versions could
+// create, are merged before unique index is built.
+func EnsureIndexes(ctx context.Context, db *mongo.Database) error {
+	unique, err := hasUniqueIndex(ctx, db.Collection(collTimeseries), "ticker_1")
+	if err != nil {
+		return errors.Wrap(err, "list indexes of "+collTimeseries)
+	}
+	if !unique {
+		if err := mergeDuplicates(ctx, db.Collection(collTimeseries)); err != nil {
+			return errors.Wrap(err, "merge duplicate tickers")
+		}
+	}
+	for coll, models := range indexes {
+		view := db.Collection(coll).Indexes()
+		_, err := view.CreateMany(ctx, models)
+		if isIndexConflict(err) {
+			for _, model := range models {
+				view.DropOne(ctx, indexName(model.Keys.(bson.D)))
+			}
+			_, err = view.CreateMany(ctx, models)
+		}
+		if err != nil {
+			return errors.Wrap(err, "create indexes of "+coll)
+		}
+	}
+	return nil
+}
+
+// hasUniqueIndex returns true if coll has unique index of name.
+func hasUniqueIndex(ctx context.Context, coll *mongo.Collection, name string) (bool, error) {
+	specs, err := coll.Indexes().ListSpecifications(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, spec := range specs {
+		if spec.Name == name && spec.Unique != nil && *spec.Unique {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// isIndexConflict returns true if err is caused by existing index with
+// other options.
+func isIndexConflict(err error) bool {
+	se, ok := err.(mongo.ServerError)
+	return ok && (se.HasErrorCode(codeIndexOptionsConflict) || se.HasErrorCode(codeIndexKeySpecsConflict))
+}
+
+// indexName returns default name of index by keys, e.g. "ticker_1".
+func indexName(keys bson.D) string {
+	parts := make([]string, 0, 2*len(keys))
+	for _, k := range keys {
+		parts = append(parts, k.Key, fmt.Sprint(k.Value))
+	}
+	return strings.Join(parts, "_")
+}
+
+// mergeDuplicates pushes responses of records of the same ticker to
+// the oldest record and removes the others.
+func mergeDuplicates(ctx context.Context, coll *mongo.Collection) error {
+	cur, err := coll.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$ticker"},
+			{Key: "ids", Value: bson.D{{Key: "$push", Value: "$_id"}}},
+		}}},
+		{{Key: "$match", Value: bson.D{{Key: "ids.1", Value: bson.D{{Key: "$exists", Value: true}}}}}},
+	})
+	if err != nil {
+		return err
+	}
+	var dups []struct {
+		IDs []primitive.ObjectID `bson:"ids"`
+	}
+	if err := cur.All(ctx, &dups); err != nil {
+		return err
+	}
+
+	for _, dup := range dups {
+		for _, id := range dup.IDs[1:] {
+			var item Item
+			if err := coll.FindOne(ctx, bson.M{"_id": id}).Decode(&item); err != nil {
+				return err
+			}
+			_, err := coll.UpdateOne(ctx, bson.M{"_id": dup.IDs[0]},
+				bson.M{"$push": bson.M{
+					"ohlcv":  bson.M{"$each": item.Ohlcv},
+					"series": bson.M{"$each": item.Series},
+				}})
+			if err != nil {
+				return err
+			}
+			if _, err := coll.DeleteOne(ctx, bson.M{"_id": id}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/adnilote/stock-proxy/metrics"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// testDB returns empty database of mongoDB at STOCK_PROXY_TEST_MONGO,
+// e.g. mongodb://mongo:27017, which is dropped after test. Test is
+// skipped if variable is not set.
+func testDB(t *testing.T) *mongo.Database {
+	uri := os.Getenv("STOCK_PROXY_TEST_MONGO")
+	if uri == "" {
+		t.Skip("STOCK_PROXY_TEST_MONGO is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := client.Database("av_test_" + strconv.FormatInt(time.Now().UnixNano(), 36))
+	t.Cleanup(func() {
+		db.Drop(context.Background())
+		client.Disconnect(context.Background())
+	})
+	return db
+}
+
+// TestAddConcurrent checks that concurrent Add of a new ticker store
+// all responses in one record.
+func TestAddConcurrent(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if err := EnsureIndexes(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	m := &MongoDB{db: db.Collection(collTimeseries), metrics: metrics.New(), timeout: 10 * time.Second}
+
+	const workers, adds = 20, 10
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < adds; j++ {
+				if err := m.Add(ctx, "amzn", []byte(strconv.Itoa(i*adds+j))); err != nil {
+					t.Errorf("[%d] add failed: %v", i, err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	n, err := m.db.CountDocuments(ctx, bson.M{"ticker": "AMZN"})
+	if err != nil || n != 1 {
+		t.Fatalf("expected one record, got %d: %v", n, err)
+	}
+	item, err := m.Get(ctx, "amzn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[string]bool{}
+	for _, data := range item.Ohlcv {
+		seen[string(data.Data)] = true
+	}
+	if len(item.Ohlcv) != workers*adds || len(seen) != workers*adds {
+		t.Errorf("expected %d responses, got %d", workers*adds, len(item.Ohlcv))
+	}
+}
+
+// TestEnsureIndexesMerge checks that records of the same ticker and
+// not unique index of old versions are migrated.
+func TestEnsureIndexesMerge(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	coll := db.Collection(collTimeseries)
+	coll.Indexes().CreateOne(ctx, mongo.IndexModel{Keys: bson.D{{Key: "ticker", Value: 1}}})
+	for _, data := range []string{"a", "b", "c"} {
+		coll.InsertOne(ctx, bson.M{"ticker": "AMZN", "ohlcv": []primitive.Binary{{Data: []byte(data)}}})
+	}
+
+	if err := EnsureIndexes(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	unique, err := hasUniqueIndex(ctx, coll, "ticker_1")
+	if err != nil || !unique {
+		t.Errorf("ticker index must be unique: %v", err)
+	}
+	var item Item
+	if err := coll.FindOne(ctx, bson.M{"ticker": "AMZN"}).Decode(&item); err != nil {
+		t.Fatal(err)
+	}
+	got := ""
+	for _, data := range item.Ohlcv {
+		got += string(data.Data)
+	}
+	if got != "abc" {
+		t.Errorf("responses must be merged in order: got %s", got)
+	}
+}
+
+// TestMigrate checks that uncompressed responses of old versions are
+// compressed and read back unchanged.
+func TestMigrate(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	coll := db.Collection(collTimeseries)
+	data := fullIntraday(100)
+	coll.InsertOne(ctx, bson.M{"ticker": "AMZN", "ohlcv": []primitive.Binary{{Data: data}}})
+
+	m := &MongoDB{db: coll, metrics: metrics.New(), timeout: 10 * time.Second, compression: CompressionZstd}
+	if err := m.Add(ctx, "amzn", data); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := m.Migrate(ctx)
+	if err != nil || stats.Records != 1 || stats.Payloads != 1 || stats.After >= stats.Before {
+		t.Errorf("wrong migration %+v: %v", stats, err)
+	}
+
+	var stored Item
+	if err := coll.FindOne(ctx, bson.M{"ticker": "AMZN"}).Decode(&stored); err != nil {
+		t.Fatal(err)
+	}
+	item, err := m.Get(ctx, "amzn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range item.Ohlcv {
+		if stored.Ohlcv[i].Subtype != subtypeZstd || !bytes.Equal(item.Ohlcv[i].Data, data) {
+			t.Errorf("[%d] response is not migrated", i)
+		}
+	}
+}
+
+func TestResponseSeries(t *testing.T) {
+	cases := []struct {
+		body     string
+		ok       bool
+		expected Series
+	}{
+		{intradayResponse, true, Series{Function: "TIME_SERIES_INTRADAY", Interval: "1min",
+			Timestamp: calendar.Date(2019, 8, 6, 9, 32)}},
+		{dailyAdjustedResponse, true, Series{Function: "TIME_SERIES_DAILY_ADJUSTED",
+			Timestamp: calendar.Date(2019, 8, 5, 0, 0)}},
+		{`{"Global Quote": {"01. symbol": "AMZN"}}`, false, Series{}},
+		{"timestamp,open,high,low,close,volume\n", false, Series{}},
+	}
+	for caseNum, item := range cases {
+		got, ok := responseSeries([]byte(item.body))
+		if ok != item.ok || got.Function != item.expected.Function || got.Interval != item.expected.Interval ||
+			!got.Timestamp.Equal(item.expected.Timestamp) {
+			t.Errorf("[%d] got %+v %v, expected %+v", caseNum, got, ok, item.expected)
+		}
+	}
+}
+
+// TestSeriesIndex checks that time series of a ticker are found by
+// function, interval and time of the last bar.
+func TestSeriesIndex(t *testing.T) {
+	db := testDB(t)
+	ctx := context.Background()
+	if err := EnsureIndexes(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	m := &MongoDB{db: db.Collection(collTimeseries), metrics: metrics.New(), timeout: 10 * time.Second}
+	for _, body := range []string{intradayResponse, dailyResponse, "timestamp,open\n"} {
+		if err := m.Add(ctx, "amzn", []byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filter := bson.M{"ticker": "AMZN", "series": bson.M{"$elemMatch": bson.M{
+		"function":  "TIME_SERIES_INTRADAY",
+		"interval":  "1min",
+		"timestamp": bson.M{"$gte": calendar.Date(2019, 8, 6, 0, 0)},
+	}}}
+	var plan bson.M
+	err := db.RunCommand(ctx, bson.D{
+		{Key: "explain", Value: bson.D{{Key: "find", Value: collTimeseries}, {Key: "filter", Value: filter}}},
+	}).Decode(&plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if winning := fmt.Sprint(plan["queryPlanner"]); !strings.Contains(winning, "ticker_1_series.function_1") {
+		t.Errorf("query must use series index: %s", winning)
+	}
+	if n, err := m.db.CountDocuments(ctx, filter); err != nil || n != 1 {
+		t.Errorf("expected record of intraday series, got %d: %v", n, err)
+	}
+	item, err := m.Get(ctx, "amzn")
+	if err != nil || len(item.Series) != 2 || item.Series[1].Function != "TIME_SERIES_DAILY" {
+		t.Errorf("expected series of json responses, got %+v: %v", item, err)
+	}
+}
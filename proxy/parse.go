@@ -1,9 +1,14 @@
 package proxy
 
 import (
+	"encoding/json"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	av "github.com/adnilote/stock-proxy/av-client"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
 	"github.com/pkg/errors"
 )
 
@@ -35,3 +40,72 @@ func parseDate(v string, dateFormat ...string) (time.Time, error) {
 	}
 	return time.Time{}, errors.Errorf("applicable date format not found for date %s", v)
 }
+
+// checkResponse checks that Alpha Vantage response holds the payload
+// of function fn, rather than "Error Message" or throttling "Note".
+// Only JSON responses are checked.
+func checkResponse(body []byte, contentType string, fn *av.Function, query url.Values) error {
+	if !strings.Contains(contentType, "json") {
+		return nil
+	}
+
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return errors.Wrap(err, "error parsing response")
+	}
+	for _, key := range []string{"Error Message", "Note", "Information"} {
+		if msg, ok := resp[key]; ok {
+			return errors.Errorf("%s: %s", key, msg)
+		}
+	}
+	if _, ok := resp[fn.DataKey(query)]; !ok {
+		return errors.Errorf("no %q in %s response", fn.DataKey(query), fn.Name)
+	}
+	return nil
+}
+
+// MetaData is "Meta Data" of Alpha Vantage time series response.
+type MetaData struct {
+	Information   string
+	Symbol        string
+	LastRefreshed time.Time
+	Interval      string
+	OutputSize    string
+	TimeZone      string
+}
+
+// parseMetaData parses "Meta Data" of json response.
+func parseMetaData(body []byte) (*MetaData, error) {
+	var resp struct {
+		MetaData map[string]string `json:"Meta Data"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "error parsing response")
+	}
+	if resp.MetaData == nil {
+		return nil, errors.New("no Meta Data in response")
+	}
+
+	// strip numbering, i.e. "3. Last Refreshed" -> "Last Refreshed"
+	fields := map[string]string{}
+	for k, v := range resp.MetaData {
+		if i := strings.Index(k, ". "); i >= 0 {
+			k = k[i+2:]
+		}
+		fields[k] = v
+	}
+
+	meta := &MetaData{
+		Information: fields["Information"],
+		Symbol:      fields["Symbol"],
+		Interval:    fields["Interval"],
+		OutputSize:  fields["Output Size"],
+		TimeZone:    fields["Time Zone"],
+	}
+	t, err := calendar.ParseTime(fields["Last Refreshed"], meta.TimeZone)
+	if err != nil {
+		return nil, errors.Wrap(err, "error parsing Last Refreshed")
+	}
+	meta.LastRefreshed = t
+	return meta, nil
+}
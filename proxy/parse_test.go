@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+)
+
+const intradayJSON = `{
+	"Meta Data": {
+		"1. Information": "Intraday (1min) open, high, low, close prices and volume",
+		"2. Symbol": "amzn",
+		"3. Last Refreshed": "2019-08-05 16:00:00",
+		"4. Interval": "1min",
+		"5. Output Size": "Compact",
+		"6. Time Zone": "US/Eastern"
+	},
+	"Time Series (1min)": {
+		"2019-08-05 16:00:00": {
+			"1. open": "1765.6000",
+			"2. high": "1766.0000",
+			"3. low": "1764.0000",
+			"4. close": "1765.1300",
+			"5. volume": "178232"
+		}
+	}
+}`
+
+func TestParseMetaData(t *testing.T) {
+	meta, err := parseMetaData([]byte(intradayJSON))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Symbol != "amzn" || meta.Interval != "1min" || meta.OutputSize != "Compact" {
+		t.Errorf("wrong meta data: %+v", meta)
+	}
+	if !meta.LastRefreshed.Equal(time.Date(2019, time.August, 5, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong Last Refreshed: %s", meta.LastRefreshed.UTC())
+	}
+
+	if _, err := parseMetaData([]byte(`{"Error Message": "Invalid API call"}`)); err == nil {
+		t.Errorf("expected error")
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	fn, _ := av.LookupFunction("TIME_SERIES_INTRADAY")
+	query := url.Values{av.QueryInterval: {"1min"}}
+
+	if err := checkResponse([]byte(intradayJSON), "application/json", fn, query); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if err := checkResponse([]byte(intradayJSON), "application/json", fn, url.Values{av.QueryInterval: {"5min"}}); err == nil {
+		t.Errorf("expected error for another interval")
+	}
+	note := `{"Note": "Thank you for using Alpha Vantage! Our standard API call frequency is 5 calls per minute"}`
+	if err := checkResponse([]byte(note), "application/json", fn, query); err == nil {
+		t.Errorf("expected error for Note")
+	}
+	if err := checkResponse([]byte("timestamp,open"), "application/x-download", fn, query); err != nil {
+		t.Errorf("unexpected error for csv: %s", err)
+	}
+}
@@ -4,124 +4,539 @@ package proxy
 
 // history not duplicate
 import (
+	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	av "github.com/adnilote/stock-proxy/av-client"
-	"github.com/prometheus/client_golang/prometheus"
-
-	"github.com/getsentry/sentry-go"
-
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/logging"
+	"github.com/adnilote/stock-proxy/metrics"
+	"github.com/adnilote/stock-proxy/redact"
+	"github.com/adnilote/stock-proxy/tracing"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/pkg/errors"
+
+	"go.mongodb.org/mongo-driver/mongo"
 	"go.uber.org/zap"
-	mgo "gopkg.in/mgo.v2"
-)
-
-var (
-// MaxQueue = os.Getenv("MAX_QUEUE")
 )
 
 const (
-	// REQLIMIT amount of request per minute
+	// REQLIMIT default amount of request per minute per API key
 	REQLIMIT int = 5
-	// APIKey for Alpha Vantage
+	// APIKey default key for Alpha Vantage
 	APIKey string = "7Z29L509PNF9IE24"
-	// MaxQueue = max amount of tasks in queque
+	// MaxQueue default max amount of tasks in queque
 	MaxQueue int = 10
+	// ShutdownTimeout default time for Close to finish queued tasks
+	ShutdownTimeout = 30 * time.Second
+	// DBTimeout default timeout of mongoDB operations
+	DBTimeout = 10 * time.Second
 )
 
-// Proxy which limits clients request by REQLIMIT
+// Options configure Proxy, zero values are replaced by defaults.
+type Options struct {
+	// APIKeys for Alpha Vantage, default is APIKey
+	APIKeys []string
+	// RequestLimit is amount of requests per minute per API key,
+	// default is REQLIMIT
+	RequestLimit int
+	// MaxQueue is max amount of tasks in queue, default is MaxQueue
+	MaxQueue int
+	// ShutdownTimeout is time for Close to finish queued tasks,
+	// default is ShutdownTimeout
+	ShutdownTimeout time.Duration
+	// DBTimeout limits mongoDB operations, default is DBTimeout
+	DBTimeout time.Duration
+
+	// Metrics of proxy, default is unregistered metrics.New()
+	Metrics *metrics.Metrics
+	// Reporter of errors, default logs them by logger of proxy
+	Reporter reporter.Reporter
+
+	// LimitStore shares API key calls and job leases with other
+	// instances, default keeps them in memory of this instance
+	LimitStore LimitStore
+	// Instance identifies proxy in leases of LimitStore, default is
+	// host name and process ID
+	Instance string
+	// Compression of stored responses, default is zstd
+	Compression Compression
+	// NoWorkers proxy neither starts workers nor restores pending
+	// tasks, it serves one-off commands, e.g. Fetch
+	NoWorkers bool
+}
+
+func (o Options) withDefaults() Options {
+	if len(o.APIKeys) == 0 {
+		o.APIKeys = []string{APIKey}
+	}
+	if o.RequestLimit == 0 {
+		o.RequestLimit = REQLIMIT
+	}
+	if o.MaxQueue == 0 {
+		o.MaxQueue = MaxQueue
+	}
+	if o.ShutdownTimeout == 0 {
+		o.ShutdownTimeout = ShutdownTimeout
+	}
+	if o.DBTimeout == 0 {
+		o.DBTimeout = DBTimeout
+	}
+	if o.Metrics == nil {
+		o.Metrics = metrics.New()
+	}
+	if o.Compression == "" {
+		o.Compression = CompressionZstd
+	}
+	if o.Instance == "" {
+		host, _ := os.Hostname()
+		o.Instance = host + ":" + strconv.Itoa(os.Getpid())
+	}
+	return o
+}
+
+func (o Options) validate() error {
+	for _, key := range o.APIKeys {
+		if key == "" {
+			return errors.New("empty API key")
+		}
+	}
+	if o.RequestLimit < 0 {
+		return errors.Errorf("invalid request limit %d", o.RequestLimit)
+	}
+	if o.MaxQueue < 0 {
+		return errors.Errorf("invalid max queue %d", o.MaxQueue)
+	}
+	if o.ShutdownTimeout < 0 {
+		return errors.Errorf("invalid shutdown timeout %s", o.ShutdownTimeout)
+	}
+	if o.DBTimeout < 0 {
+		return errors.Errorf("invalid db timeout %s", o.DBTimeout)
+	}
+	if _, ok := o.Compression.subtype(); !ok {
+		return errors.Errorf("invalid compression %q", o.Compression)
+	}
+	return nil
+}
+
+// Proxy which limits clients request by RequestLimit per API key
 type Proxy struct {
-	db *MongoDB
-	av *av.AvClient
+	db      *MongoDB
+	actions *ActionsDB
+	av      *av.AvClient
+	cal     *calendar.Calendar
 
 	lg      *zap.Logger
-	reqLeft prometheus.Gauge
-	tasks   chan *Task
+	metrics *metrics.Metrics
+	rep     reporter.Reporter
+	queue   *queue
+	keys    *keyring
+	breaker *breaker
+	pending *PendingDB
+
+	// stop is closed when Close timeout is exceeded
+	stop      chan struct{}
+	wg        sync.WaitGroup
+	timeout   time.Duration
+	persisted int64
+	// lastID is ID of the last created task
+	lastID uint64
+	// instance identifies proxy in leases of LimitStore
+	instance string
+
+	mu sync.Mutex
+	// workers is amount of running workers, wantWorkers is
+	// the amount required by options
+	workers     int
+	wantWorkers int
+	// inflight are tasks taken by workers, by task ID
+	inflight map[string]*Task
 }
 
 // Task is a request from client, which is sent to workers.
 type Task struct {
-	w      http.ResponseWriter
-	url    string
-	ticker string
-	out    chan struct{}
+	w http.ResponseWriter
+	// ctx is cancelled when sync client disconnects or by cancel
+	ctx   context.Context
+	url   string
+	fn    *av.Function
+	query url.Values
+	// key by which response is stored, see av.Function.Key
+	key string
+	out chan struct{}
+	// queued is time task is pushed to queue
+	queued time.Time
+	// wait is span of waiting in queue, ended by worker
+	wait trace.Span
+	// lg is logger of request, see logging.Handler
+	lg *zap.Logger
 	// snedClient true - will write response to w
 	sendClient bool
+	// header of sync client request, e.g. If-None-Match
+	header http.Header
+
+	// id identifies task in admin API
+	id string
+	// client is address of client or origin of task, e.g. backfill
+	client string
+	// priority of task in queue, higher goes first
+	priority int
+	// cancel cancels ctx, cancelled is 1 if task is cancelled by admin
+	cancel    context.CancelFunc
+	cancelled int32
 }
 
-// NewProxy return proxy instance. Required mongoDB collection db
+// NewProxy return proxy instance. Required mongoDB database db
 // and zap logger.
-func NewProxy(db *mgo.Collection, lg *zap.Logger, reqLeftAr ...prometheus.Gauge) (*Proxy, error) {
-	var reqLeft prometheus.Gauge
-	if len(reqLeftAr) == 1 {
-		reqLeft = reqLeftAr[0]
+func NewProxy(db *mongo.Database, lg *zap.Logger, opts Options) (*Proxy, error) {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return nil, err
 	}
+	if opts.Reporter == nil {
+		opts.Reporter = reporter.NewLog(lg)
+	}
+	redact.SetSecrets(opts.APIKeys...)
 
 	p := &Proxy{
-		db:      &MongoDB{db: db},
-		av:      av.NewAvClient(APIKey),
+		db:      &MongoDB{db: db.Collection(collTimeseries), metrics: opts.Metrics, timeout: opts.DBTimeout},
+		actions: &ActionsDB{db: db.Collection(collActions), metrics: opts.Metrics, timeout: opts.DBTimeout},
+		av:      av.NewAvClient(opts.APIKeys[0]),
+		cal:     calendar.New(),
 		lg:      lg,
-		reqLeft: reqLeft,
-	}
-
-	p.tasks = make(chan *Task, MaxQueue)
-
-	for i := 0; i < REQLIMIT; i++ {
-		go func() {
-			for {
-				select {
-				case task := <-p.tasks:
-					p.getOHLCV(task.w, task.url, task.ticker, task.sendClient)
-					if task.sendClient {
-						task.out <- struct{}{}
-					}
-					time.Sleep(time.Minute)
-				}
-			}
-		}()
+		metrics: opts.Metrics,
+		rep:     opts.Reporter,
+		queue:   newQueue(opts.MaxQueue, opts.Metrics.QueueDepth),
+		keys:    newKeyring(opts.APIKeys, opts.RequestLimit, opts.LimitStore),
+		breaker: newBreaker(),
+		pending: &PendingDB{db: db.Collection(collPending), timeout: opts.DBTimeout},
+		stop:    make(chan struct{}),
+		timeout: opts.ShutdownTimeout,
+	}
+	p.instance = opts.Instance
+	p.db.compression = opts.Compression
+	p.keys.report = func(err error) { p.rep.Report(err, reporter.LevelError, nil) }
+	p.metrics.SetBudget(p.keys.budget)
+	if opts.NoWorkers {
+		return p, nil
 	}
+	p.resize(opts.RequestLimit * len(opts.APIKeys))
+
+	// tasks persisted by Close of the previous run
+	p.restore()
 
 	return p, nil
 }
 
-func (p *Proxy) getOHLCV(w http.ResponseWriter, url, ticker string, sendClient bool) {
+// Reload applies new limits and API keys. Queued tasks are kept.
+func (p *Proxy) Reload(opts Options) error {
+	opts = opts.withDefaults()
+	if err := opts.validate(); err != nil {
+		return err
+	}
+
+	redact.SetSecrets(opts.APIKeys...)
+	p.keys.update(opts.APIKeys, opts.RequestLimit)
+	p.queue.setMax(opts.MaxQueue)
+	p.resize(opts.RequestLimit * len(opts.APIKeys))
+	p.mu.Lock()
+	p.timeout = opts.ShutdownTimeout
+	p.mu.Unlock()
+	p.lg.Info("Reload proxy options",
+		zap.Int("api_keys", len(opts.APIKeys)),
+		zap.Int("request_limit", opts.RequestLimit),
+		zap.Int("max_queue", opts.MaxQueue))
+	return nil
+}
+
+// resize starts or stops workers, so that n of them are running.
+// Workers stop after finishing current task.
+func (p *Proxy) resize(n int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.wantWorkers = n
+	for ; p.workers < n; p.workers++ {
+		p.wg.Add(1)
+		p.metrics.Workers.Inc()
+		go p.worker()
+	}
+}
+
+// retire returns true if worker must stop, as there are too many.
+func (p *Proxy) retire() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.workers > p.wantWorkers {
+		p.workers--
+		p.metrics.Workers.Dec()
+		return true
+	}
+	return false
+}
+
+// worker sends queued tasks to Alpha Vantage within API keys limits,
+// until queue is closed and empty.
+func (p *Proxy) worker() {
+	defer p.wg.Done()
+	for {
+		task, ok := p.queue.pop()
+		if !ok {
+			p.metrics.Workers.Dec()
+			return
+		}
+		wait := time.Since(task.queued)
+		p.metrics.QueueWait.Observe(wait.Seconds())
+		logging.Annotate(task.ctx, zap.Duration("queue_wait", wait))
+		task.wait.End()
+
+		p.metrics.WorkersBusy.Inc()
+		p.track(task, true)
+		p.process(task)
+		p.track(task, false)
+		p.metrics.WorkersBusy.Dec()
+
+		if p.retire() {
+			return
+		}
+	}
+}
+
+// process sends task to Alpha Vantage, when upstream is up and
+// API key budget is left.
+func (p *Proxy) process(task *Task) {
+	ctx, span := tracing.Tracer().Start(task.ctx, "worker.process", trace.WithAttributes(
+		attribute.String("ticker", task.key),
+		attribute.String("function", task.fn.Name)))
+	defer span.End()
+
+	// wait while upstream is down, then for API key budget
+	var key string
+	ok := p.breaker.wait(p.stop, task.ctx.Done())
+	if ok {
+		key, ok = p.keys.acquire(p.stop, task.ctx.Done())
+	}
+	if !ok {
+		if task.ctx.Err() != nil {
+			// client disconnected or admin cancelled task, do not
+			// spend API call
+			p.abandon(task)
+			if task.sendClient {
+				task.out <- struct{}{}
+			}
+		} else {
+			// Close timeout exceeded
+			p.persist(task)
+		}
+		return
+	}
+
+	task.url = p.av.URLWithKey(task.query, key)
+	p.getOHLCV(ctx, task)
+	if task.sendClient {
+		task.out <- struct{}{}
+	}
+}
 
-	// send request to server
-	resp, err := p.av.Conn.Get(url)
+// getOHLCV sends task to Alpha Vantage, stores response and writes
+// it to sync client. Request is cancelled with ctx.
+func (p *Proxy) getOHLCV(ctx context.Context, task *Task) {
+	w, ticker, sendClient := task.w, task.key, task.sendClient
 
+	// send request to server, cancelled if client disconnects
+	req, err := http.NewRequest(http.MethodGet, task.url, nil)
 	if err != nil {
 		if sendClient {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeError(w, errInternal)
 		}
-		CaptureError(err, sentry.LevelError, p.lg) //map[string]interface{}{"counter": p.counter.Rate()}
+		p.rep.Report(err, reporter.LevelError, nil)
 		return
 	}
-	// read response
-	defer resp.Body.Close()
-	respBody, err := ioutil.ReadAll(resp.Body)
+	respBody, contentType, err := p.fetch(ctx, task, req)
+
 	if err != nil {
+		if ctx.Err() != nil {
+			p.abandon(task)
+			return
+		}
 		if sendClient {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeError(w, errInternal)
+		}
+		p.rep.Report(err, reporter.LevelError, nil) //map[string]interface{}{"counter": p.counter.Rate()}
+		return
+	}
+
+	// response is stored, even if client disconnects
+	p.store(tracing.Detach(ctx), task, respBody, contentType)
+
+	// send response to client, unless it disconnected. Response
+	// fetched before admin cancelled task is still sent.
+	if sendClient && (ctx.Err() == nil || atomic.LoadInt32(&task.cancelled) == 1) {
+		writeCacheable(w, task.header, contentType, p.lastModified(respBody, time.Now()), 0, respBody)
+		task.lg.Debug("send ticker to client", zap.String("ticker", ticker)) //zap.Int("counter", int(p.counter.Rate()))
+	}
+
+}
+
+// store adds response of task to db, unless Alpha Vantage returned an
+// error. It returns error of response or db.
+func (p *Proxy) store(ctx context.Context, task *Task, body []byte, contentType string) error {
+	return p.storeActions(ctx, task, body, body, contentType)
+}
+
+// storeActions stores body like store, dividends and splits are found
+// in full, e.g. response of import including bars stored before, as
+// close before an action is taken from the bar before it.
+func (p *Proxy) storeActions(ctx context.Context, task *Task, body, full []byte, contentType string) error {
+	err := checkResponse(body, contentType, task.fn, task.query)
+	if err != nil {
+		task.lg.Warn("Skip writing response to db", zap.Error(err), zap.String("ticker", task.key))
+		return err
+	}
+	err = p.db.Add(ctx, task.key, body)
+	if err != nil {
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": task.key})
+	}
+	task.lg.Debug("Write response to db", zap.String("ticker", task.key))
+	p.addActions(ctx, task, full, contentType)
+	return err
+}
+
+// Fetch sends query to Alpha Vantage bypassing queue, waits for API
+// key budget shared by LimitStore, and stores the response. It returns
+// the response and its content type.
+func (p *Proxy) Fetch(ctx context.Context, query url.Values) ([]byte, string, error) {
+	task, apiErr := p.newTask(ctx, nil, query, false)
+	if apiErr != nil {
+		return nil, "", apiErr
+	}
+	defer task.cancel()
+	task.client = "fetch"
+
+	ok := p.breaker.wait(p.stop, task.ctx.Done())
+	var key string
+	if ok {
+		key, ok = p.keys.acquire(p.stop, task.ctx.Done())
+	}
+	if !ok {
+		return nil, "", task.ctx.Err()
+	}
+	req, err := http.NewRequest(http.MethodGet, p.av.URLWithKey(task.query, key), nil)
+	if err != nil {
+		return nil, "", redact.Error(err)
+	}
+	body, contentType, err := p.fetch(task.ctx, task, req)
+	if err != nil {
+		return nil, "", err
+	}
+	return body, contentType, p.store(tracing.Detach(task.ctx), task, body, contentType)
+}
+
+// fetch sends req to Alpha Vantage and reads response. Failures of
+// upstream open circuit breaker.
+func (p *Proxy) fetch(ctx context.Context, task *Task, req *http.Request) ([]byte, string, error) {
+	ctx, span := tracing.Tracer().Start(ctx, "alphavantage.request", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("function", task.fn.Name)))
+	defer span.End()
+
+	start := time.Now()
+	resp, err := p.av.Conn.Do(req.WithContext(ctx))
+	if err != nil {
+		// url.Error holds URL with API key
+		err = redact.Error(err)
+		p.metrics.ObserveUpstream(task.fn.Name, 0, start)
+		span.SetStatus(codes.Error, err.Error())
+		if ctx.Err() == nil {
+			p.breaker.failure()
 		}
-		CaptureError(err, sentry.LevelError, p.lg)
+		return nil, "", err
+	}
+	p.metrics.ObserveUpstream(task.fn.Name, resp.StatusCode, start)
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+	if resp.StatusCode >= http.StatusInternalServerError {
+		span.SetStatus(codes.Error, resp.Status)
+		p.breaker.failure()
+	} else {
+		p.breaker.success()
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
+
+// addActions stores dividends and splits found in response of daily
+// adjusted time series. Weekly and monthly ones date actions by the
+// end of period, so the same action would be stored twice.
+func (p *Proxy) addActions(ctx context.Context, task *Task, body []byte, contentType string) {
+	ts, ok := parseTimeSeries(task.fn.Name)
+	if !ok || ts != TimeSeriesDailyAdjusted {
 		return
 	}
 
-	// add record to db
-	err = p.db.Add(ticker, respBody)
+	var values []*TimeSeriesAdjustedValue
+	var err error
+	if strings.Contains(contentType, "json") {
+		values, err = parseTimeSeriesAdjustedJSON(body, task.fn.DataKey(task.query))
+	} else {
+		values, err = parseTimeSeriesAdjustedData(bytes.NewReader(body))
+	}
 	if err != nil {
-		CaptureError(err, sentry.LevelError, p.lg, map[string]interface{}{"ticker": ticker})
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": task.key})
+		return
 	}
-	p.lg.Debug("Write response to db", zap.String("ticker", ticker))
 
-	// send response to client
-	if sendClient {
-		w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
-		w.Write(respBody)
-		p.lg.Debug("send ticker to client", zap.String("ticker", ticker)) //zap.Int("counter", int(p.counter.Rate()))
+	prevClose := func(t time.Time) (float64, bool) { return p.storedClose(ctx, task.key, t) }
+	err = p.actions.Add(ctx, corporateActions(task.key, values, prevClose))
+	if err != nil {
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": task.key})
 	}
+}
+
+// storedClose returns close of the last stored daily bar of ticker
+// before t.
+func (p *Proxy) storedClose(ctx context.Context, ticker string, t time.Time) (float64, bool) {
+	item, err := p.db.Get(ctx, ticker)
+	if err != nil {
+		return 0, false
+	}
+	daily, _ := av.LookupFunction(TimeSeriesDaily.keyName())
+	bars := seriesBars(item, daily.DataKey(url.Values{}))
+	for i := len(bars) - 1; i >= 0; i-- {
+		if bars[i].Time.Before(t) {
+			return bars[i].Close, true
+		}
+	}
+	return 0, false
+}
 
+// AdjustHistory back-adjusts unadjusted values of ticker, e.g. intraday
+// bars, for stored dividends and splits. Actions are stored from
+// responses of TIME_SERIES_DAILY_ADJUSTED.
+func (p *Proxy) AdjustHistory(ctx context.Context, ticker string, values []*TimeSeriesValue) ([]*TimeSeriesValue, error) {
+	actions, err := p.actions.Get(ctx, ticker)
+	if err != nil {
+		return nil, err
+	}
+	return BackAdjust(values, actions), nil
 }
 
 // GetOHLCVSync sends ohlcv in minute syncroniously,
@@ -131,35 +546,132 @@ func (p *Proxy) getOHLCV(w http.ResponseWriter, url, ticker string, sendClient b
 func (p *Proxy) GetOHLCVSync(w http.ResponseWriter, r *http.Request) {
 
 	// validate query params and prepare query to go to server
-	path, err := p.av.URL(r.URL.Query())
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	task, apiErr := p.newTask(r.Context(), w, r.URL.Query(), true)
+	if apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
+	task.client = r.RemoteAddr
+	task.header = r.Header
 
-	// send to workers
-	task := Task{
-		w:          w,
-		url:        path,
-		ticker:     r.URL.Query().Get(av.QuerySymbol),
-		out:        make(chan struct{}),
-		sendClient: true,
+	// intraday bars do not change while market is closed
+	if body, ok := p.closedMarketResponse(task); ok {
+		now := time.Now()
+		writeCacheable(w, r.Header, "application/json", p.lastModified(body, now), p.closedMaxAge(now), body)
+		return
+	}
+
+	p.sync(task)
+}
+
+// sync queues task of sync client and waits until it is answered,
+// cancelled or dropped.
+func (p *Proxy) sync(task *Task) {
+	// send to workers, blocks if exceed limit
+	if !p.enqueue(task, true) {
+		if task.ctx.Err() != nil {
+			p.abandon(task)
+			return
+		}
+		writeError(task.w, errShuttingDown)
+		return
 	}
-	// blocks if exceed limit
-	p.tasks <- &task
 
 	// wait for request to finish
-	<-task.out
+	select {
+	case <-task.out:
+	case <-task.ctx.Done():
+		// drop task if no worker took it, otherwise worker
+		// cancels it and answers
+		if p.queue.remove(task) {
+			task.wait.End()
+			p.abandon(task)
+			return
+		}
+		<-task.out
+	}
+}
+
+// abandon counts task of disconnected client, which is dropped
+// before Alpha Vantage answered. Sync client of task cancelled by
+// admin is answered with error instead.
+func (p *Proxy) abandon(task *Task) {
+	if atomic.LoadInt32(&task.cancelled) == 1 {
+		if task.sendClient {
+			writeError(task.w, errCancelled)
+		}
+		task.lg.Info("Drop task cancelled by admin", zap.String("ticker", task.key), zap.String("task_id", task.id))
+		return
+	}
+	p.metrics.Abandoned.Inc()
+	task.lg.Debug("Drop task of disconnected client", zap.String("ticker", task.key))
+}
+
+// track adds task taken by worker to in-flight tasks, or removes it
+// when done.
+func (p *Proxy) track(task *Task, inflight bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if inflight {
+		if p.inflight == nil {
+			p.inflight = make(map[string]*Task)
+		}
+		p.inflight[task.id] = task
+	} else {
+		delete(p.inflight, task.id)
+	}
+}
+
+// newTask validates query params and prepares task to go to server.
+// Task is cancelled with ctx.
+func (p *Proxy) newTask(ctx context.Context, w http.ResponseWriter, query url.Values, sendClient bool) (*Task, *APIError) {
+	if apiErr := validateQuery(query); apiErr != nil {
+		return nil, apiErr
+	}
+	if _, err := p.av.URL(query); err != nil {
+		return nil, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidParam,
+			Message: err.Error(),
+		}
+	}
+	fn, _ := av.LookupFunction(query.Get(av.QueryFunction))
+
+	// url with API key is set by worker, ctx may be cancelled by admin
+	ctx, cancel := context.WithCancel(ctx)
+	return &Task{
+		id:         strconv.FormatUint(atomic.AddUint64(&p.lastID, 1), 10),
+		w:          w,
+		ctx:        ctx,
+		cancel:     cancel,
+		lg:         logging.FromContext(ctx, p.lg),
+		fn:         fn,
+		query:      query,
+		key:        fn.Key(query),
+		out:        make(chan struct{}),
+		sendClient: sendClient,
+	}, nil
 }
 
 // try returns true if task queque is not full
 func (p *Proxy) try(task *Task) bool {
-	select {
-	case p.tasks <- task:
-		return true
-	default:
+	return p.enqueue(task, false)
+}
+
+// enqueue pushes task to queue, see queue.push. Span of waiting in
+// queue lasts until worker pops the task.
+func (p *Proxy) enqueue(task *Task, block bool) bool {
+	ctx, span := tracing.Tracer().Start(task.ctx, "queue.push",
+		trace.WithAttributes(attribute.String("ticker", task.key), attribute.Bool("block", block)))
+	defer span.End()
+
+	_, task.wait = tracing.Tracer().Start(ctx, "queue.wait")
+	if !p.queue.push(task, block) {
+		task.wait.End()
+		span.SetStatus(codes.Error, "task is not queued")
 		return false
 	}
+	return true
 }
 
 // GetOHLCVAsync immediately returns response, if limit not exceeded,
@@ -167,58 +679,94 @@ func (p *Proxy) try(task *Task) bool {
 //
 // Example: http://127.0.0.1:8082/async/?function=TIME_SERIES_INTRADAY&interval=1min&outputsize=compact&symbol=amzn
 func (p *Proxy) GetOHLCVAsync(w http.ResponseWriter, r *http.Request) {
-	path, err := p.av.URL(r.URL.Query())
-	if err != nil {
-		http.Error(w, "Bad Request", http.StatusBadRequest)
+	// async task is not cancelled with request, but is traced
+	task, apiErr := p.newTask(tracing.Detach(r.Context()), w, r.URL.Query(), false)
+	if apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
+	task.client = r.RemoteAddr
 
-	// send to request workers
-	task := Task{
-		w:          w,
-		url:        path,
-		ticker:     r.URL.Query().Get(av.QuerySymbol),
-		out:        make(chan struct{}),
-		sendClient: false,
+	// intraday bars do not change while market is closed
+	if _, ok := p.closedMarketResponse(task); ok {
+		w.Write([]byte("OK"))
+		return
 	}
-	if !p.try(&task) {
-		http.Error(w, "Try later", http.StatusTooManyRequests)
+
+	// send to request workers
+	if !p.try(task) {
+		if p.closing() {
+			writeError(w, errShuttingDown)
+			return
+		}
+		writeError(w, errQueueFull)
 		return
 	}
 
 	w.Write([]byte("OK"))
 }
 
-// GetHistory returns requests by ticker
+// GetHistory returns requests by ticker. For functions not keyed
+// by symbol, such as FX_DAILY, function and its params are required.
+// With adjusted=true it returns bars of a time series back-adjusted
+// for dividends and splits, see getAdjustedHistory.
 //
 // Example: http://192.168.99.100:8082/history/?symbol=amzn
+// Example: http://192.168.99.100:8082/history/?function=FX_DAILY&from_symbol=EUR&to_symbol=USD
+// Example: http://192.168.99.100:8082/history/?function=TIME_SERIES_INTRADAY&interval=1min&symbol=amzn&adjusted=true
 func (p *Proxy) GetHistory(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("adjusted") == "true" {
+		p.getAdjustedHistory(w, r)
+		return
+	}
 
-	ticker := r.URL.Query().Get(av.QuerySymbol)
+	ticker := historyKey(r.URL.Query())
 	if ticker == "" {
-		http.Error(w, "ticker required", http.StatusBadRequest)
+		writeError(w, &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeMissingParam,
+			Field:   av.QuerySymbol,
+			Message: "ticker required",
+		})
 		return
 	}
 
 	// Get record from db
-	item, err := p.db.Get(ticker)
+	item, err := p.db.Get(r.Context(), ticker)
 	if err != nil {
-		if err == mgo.ErrNotFound {
-			w.WriteHeader(http.StatusNotFound)
-			w.Write([]byte("No history for " + ticker))
+		if err == mongo.ErrNoDocuments {
+			writeError(w, &APIError{
+				Status:  http.StatusNotFound,
+				Code:    CodeNotFound,
+				Message: "No history for " + ticker,
+			})
 			p.lg.Info("Return no history", zap.Error(err), zap.String("ticker", ticker))
 		} else {
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			writeError(w, errInternal)
 			// p.lg.Error("Return err to client", zap.Error(err), zap.String("ticker", ticker))
-			CaptureError(err, sentry.LevelError, p.lg, map[string]interface{}{"ticker": ticker})
+			p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": ticker})
 		}
 		return
 	}
 
-	// Send history to client
-	w.Header().Set("Content-Type", "application/json")
+	// Send history to client, unless it has the same
+	parts := make([][]byte, 0, len(item.Ohlcv))
 	for _, i := range item.Ohlcv {
-		w.Write(i.Data)
+		parts = append(parts, i.Data)
+	}
+	writeCacheable(w, r.Header, "application/json", item.Updated, 0, parts...)
+}
+
+// historyKey returns key of stored history requested by query.
+func historyKey(query url.Values) string {
+	fn, ok := av.LookupFunction(query.Get(av.QueryFunction))
+	if !ok {
+		return strings.ToUpper(query.Get(av.QuerySymbol))
+	}
+	for _, param := range fn.Required {
+		if param != av.QueryInterval && query.Get(param) == "" {
+			return ""
+		}
 	}
-	w.WriteHeader(http.StatusOK)
+	return fn.Key(query)
 }
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/metrics"
+	"github.com/adnilote/stock-proxy/redact"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// errorRecorder remembers reported errors.
+type errorRecorder struct {
+	errs []error
+}
+
+func (r *errorRecorder) Report(err error, level reporter.Level, extra map[string]interface{}) {
+	r.errs = append(r.errs, err)
+}
+
+func (r *errorRecorder) Flush(time.Duration) bool { return true }
+
+// TestUpstreamErrorRedacted checks that API key does not leak to
+// reporter, logs and client, when upstream request fails.
+func TestUpstreamErrorRedacted(t *testing.T) {
+	const key = "SECRETKEY0123456"
+	redact.SetSecrets(key)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	obs, logs := observer.New(zap.DebugLevel)
+	rec := &errorRecorder{}
+	p := &Proxy{
+		av:      av.NewAvClient(key),
+		lg:      zap.New(redact.Core(obs)),
+		rep:     rec,
+		metrics: metrics.New(),
+		breaker: newBreaker(),
+	}
+
+	fn, _ := av.LookupFunction("GLOBAL_QUOTE")
+	w := httptest.NewRecorder()
+	task := &Task{
+		w:          w,
+		ctx:        context.Background(),
+		url:        server.URL + "/query?function=GLOBAL_QUOTE&symbol=amzn&apikey=" + key,
+		fn:         fn,
+		key:        "AMZN",
+		lg:         p.lg,
+		sendClient: true,
+	}
+	p.getOHLCV(task.ctx, task)
+	task.lg.Error("upstream failed", zap.String("url", task.url))
+
+	if len(rec.errs) != 1 {
+		t.Fatalf("expected reported error, got %d", len(rec.errs))
+	}
+	if msg := rec.errs[0].Error(); strings.Contains(msg, key) || !strings.Contains(msg, "apikey=REDACTED") {
+		t.Errorf("key leaks to reporter: %s", msg)
+	}
+	for _, e := range logs.AllUntimed() {
+		for _, v := range e.ContextMap() {
+			if strings.Contains(e.Message, key) || strings.Contains(fmt.Sprint(v), key) {
+				t.Errorf("key leaks to log: %s %v", e.Message, v)
+			}
+		}
+	}
+	if w.Code != http.StatusInternalServerError || strings.Contains(w.Body.String(), key) {
+		t.Errorf("wrong response to client: %d %s", w.Code, w.Body.String())
+	}
+}
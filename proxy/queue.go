@@ -0,0 +1,237 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// queue is a FIFO of tasks waiting for workers, tasks of higher
+// priority go first. Unlike channel, its max size can be changed
+// without dropping queued tasks.
+type queue struct {
+	mu    sync.Mutex
+	cond  *sync.Cond
+	tasks []*Task
+	max   int
+	// closed queue accepts no tasks
+	closed bool
+	// paused queue gives no tasks to workers until resume
+	paused bool
+	// depth is optional gauge of amount of queued tasks
+	depth prometheus.Gauge
+}
+
+func newQueue(max int, depth prometheus.Gauge) *queue {
+	q := &queue{max: max, depth: depth}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// push adds task after queued tasks of the same or higher priority.
+// If queue is full, push waits
+// for free space if block is true, otherwise returns false.
+// Closed queue and cancelled task return false.
+func (q *queue) push(task *Task, block bool) bool {
+	if block {
+		// wake up on cancel of task
+		pushed := make(chan struct{})
+		defer close(pushed)
+		go func() {
+			select {
+			case <-task.ctx.Done():
+				q.mu.Lock()
+				q.cond.Broadcast()
+				q.mu.Unlock()
+			case <-pushed:
+			}
+		}()
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) >= q.max && !q.closed && task.ctx.Err() == nil {
+		if !block {
+			return false
+		}
+		q.cond.Wait()
+	}
+	if q.closed || task.ctx.Err() != nil {
+		return false
+	}
+	task.queued = time.Now()
+	q.insert(task)
+	q.changed()
+	return true
+}
+
+// insert puts task after tasks of the same or higher priority, must
+// be called under lock.
+func (q *queue) insert(task *Task) {
+	i := len(q.tasks)
+	for i > 0 && q.tasks[i-1].priority < task.priority {
+		i--
+	}
+	q.tasks = append(q.tasks, nil)
+	copy(q.tasks[i+1:], q.tasks[i:])
+	q.tasks[i] = task
+}
+
+// pop waits for a task and removes it from queue. Returns false
+// if queue is closed and empty. Paused queue gives no tasks unless it
+// is closed, so that shutdown is not blocked.
+func (q *queue) pop() (*Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.tasks) == 0 || (q.paused && !q.closed) {
+		if q.closed {
+			return nil, false
+		}
+		q.cond.Wait()
+	}
+	task := q.tasks[0]
+	q.tasks[0] = nil
+	q.tasks = q.tasks[1:]
+	q.changed()
+	return task, true
+}
+
+// remove removes queued task. Returns false if task is not queued,
+// e.g. it is taken by worker.
+func (q *queue) remove(task *Task) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, t := range q.tasks {
+		if t == task {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			q.changed()
+			return true
+		}
+	}
+	return false
+}
+
+// take removes queued task by ID and returns it. Returns false if
+// task is not queued.
+func (q *queue) take(id string) (*Task, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.tasks {
+		if t.id == id {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			q.changed()
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// prioritize changes priority of queued task and moves it behind
+// tasks of the same or higher priority. Returns false if task is not
+// queued.
+func (q *queue) prioritize(id string, priority int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, t := range q.tasks {
+		if t.id == id {
+			q.tasks = append(q.tasks[:i], q.tasks[i+1:]...)
+			t.priority = priority
+			q.insert(t)
+			return true
+		}
+	}
+	return false
+}
+
+// each calls fn for queued tasks in order they are popped. Queue is
+// locked during the call, so fn must not call queue.
+func (q *queue) each(fn func(task *Task)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, t := range q.tasks {
+		fn(t)
+	}
+}
+
+// pause stops giving tasks to workers, queued tasks are kept.
+func (q *queue) pause() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = true
+}
+
+// resume continues giving tasks to workers after pause.
+func (q *queue) resume() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.paused = false
+	q.cond.Broadcast()
+}
+
+// isPaused returns true if queue is paused.
+func (q *queue) isPaused() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.paused
+}
+
+// close stops accepting tasks, queued ones are still popped.
+func (q *queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// isClosed returns true if queue is closed.
+func (q *queue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.closed
+}
+
+// drain removes and returns all queued tasks.
+func (q *queue) drain() []*Task {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := q.tasks
+	q.tasks = nil
+	q.changed()
+	return tasks
+}
+
+// changed wakes up waiting push and pop after change of tasks,
+// must be called under lock.
+func (q *queue) changed() {
+	if q.depth != nil {
+		q.depth.Set(float64(len(q.tasks)))
+	}
+	q.cond.Broadcast()
+}
+
+// len returns amount of queued tasks.
+func (q *queue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks)
+}
+
+// size returns amount of queued tasks and max size of queue.
+func (q *queue) size() (int, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.tasks), q.max
+}
+
+// setMax changes max size of queue. Already queued tasks are kept,
+// even if there are more than max of them.
+func (q *queue) setMax(max int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.max = max
+	q.cond.Broadcast()
+}
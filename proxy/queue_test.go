@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTestTask(key string) *Task {
+	return &Task{key: key, ctx: context.Background()}
+}
+
+func TestQueue(t *testing.T) {
+	q := newQueue(1, nil)
+	if !q.push(newTestTask("A"), false) {
+		t.Fatalf("push to empty queue failed")
+	}
+	if q.push(newTestTask("B"), false) {
+		t.Fatalf("push to full queue succeeded")
+	}
+
+	q.setMax(2)
+	if !q.push(newTestTask("B"), false) {
+		t.Fatalf("push after setMax failed")
+	}
+	q.setMax(1)
+	if q.len() != 2 {
+		t.Fatalf("setMax must keep queued tasks, got %d", q.len())
+	}
+	if task, _ := q.pop(); task.key != "A" {
+		t.Errorf("expected A, got %s", task.key)
+	}
+
+	// closed queue rejects new tasks, but gives queued ones
+	q.close()
+	if q.push(newTestTask("C"), true) {
+		t.Fatalf("push to closed queue succeeded")
+	}
+	if task, ok := q.pop(); !ok || task.key != "B" {
+		t.Errorf("expected B from closed queue")
+	}
+	if _, ok := q.pop(); ok {
+		t.Errorf("pop from closed empty queue succeeded")
+	}
+}
+
+func TestQueueClose(t *testing.T) {
+	q := newQueue(1, nil)
+	q.push(newTestTask("A"), false)
+
+	// blocked push returns on close
+	pushed := make(chan bool)
+	go func() { pushed <- q.push(newTestTask("B"), true) }()
+	time.Sleep(10 * time.Millisecond)
+	q.close()
+	if <-pushed {
+		t.Errorf("blocked push succeeded after close")
+	}
+
+	tasks := q.drain()
+	if len(tasks) != 1 || tasks[0].key != "A" {
+		t.Errorf("expected drained A, got %v", tasks)
+	}
+	if !q.isClosed() || q.len() != 0 {
+		t.Errorf("expected closed empty queue")
+	}
+}
+
+func TestQueueCancel(t *testing.T) {
+	q := newQueue(1, nil)
+	a := newTestTask("A")
+	q.push(a, false)
+
+	// blocked push returns on cancel of task
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Task{key: "B", ctx: ctx}
+	pushed := make(chan bool)
+	go func() { pushed <- q.push(b, true) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if <-pushed {
+		t.Errorf("blocked push succeeded after cancel")
+	}
+
+	if q.remove(b) {
+		t.Errorf("removed task, which is not queued")
+	}
+	if !q.remove(a) || q.len() != 0 {
+		t.Errorf("queued task is not removed")
+	}
+}
+
+func TestEnqueueSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+
+	p := &Proxy{queue: newQueue(1, nil)}
+	if !p.enqueue(newTestTask("A"), false) {
+		t.Fatalf("enqueue to empty queue failed")
+	}
+	if p.enqueue(newTestTask("B"), false) {
+		t.Fatalf("enqueue to full queue succeeded")
+	}
+	task, _ := p.queue.pop()
+	task.wait.End()
+
+	// push of A, wait and push of B, wait of A
+	spans := exporter.GetSpans()
+	if len(spans) != 4 {
+		t.Fatalf("expected 4 spans, got %d", len(spans))
+	}
+	if spans[3].Name != "queue.wait" || spans[3].Parent.SpanID() != spans[0].SpanContext.SpanID() {
+		t.Errorf("wait of A must end last as child of push: %s", spans[3].Name)
+	}
+	if spans[2].Status.Code != codes.Error {
+		t.Errorf("push to full queue must fail")
+	}
+}
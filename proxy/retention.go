@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.uber.org/zap"
+)
+
+// RetentionRule limits how long bars of a time series are stored.
+type RetentionRule struct {
+	Function string
+	// Interval of TIME_SERIES_INTRADAY, empty matches all intervals
+	Interval string
+	Keep     time.Duration
+}
+
+func (r RetentionRule) String() string {
+	s := r.Function
+	if r.Interval != "" {
+		s += ":" + r.Interval
+	}
+	return s + "=" + r.Keep.String()
+}
+
+// ParseRetention parses comma separated rules in format
+// function[:interval]=duration, e.g.
+// "TIME_SERIES_INTRADAY:1min=30d,TIME_SERIES_INTRADAY=90d".
+// Duration is in time.ParseDuration format or in days, e.g. "30d".
+// Series without rule are kept forever.
+func ParseRetention(s string) ([]RetentionRule, error) {
+	rules := []RetentionRule{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		eq := strings.Index(item, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid retention rule %q", item)
+		}
+		parts := strings.Split(item[:eq], ":")
+		if len(parts) > 2 {
+			return nil, fmt.Errorf("invalid retention rule %q", item)
+		}
+		rule := RetentionRule{Function: strings.ToUpper(parts[0])}
+		if len(parts) == 2 {
+			rule.Interval = parts[1]
+		}
+
+		ts, ok := parseTimeSeries(rule.Function)
+		if !ok {
+			return nil, fmt.Errorf("retention of %s is not supported", rule.Function)
+		}
+		if rule.Interval != "" {
+			if ts != timeSeriesIntraday || !validInterval(rule.Interval) {
+				return nil, fmt.Errorf("invalid interval of retention rule %q", item)
+			}
+		}
+		keep, err := parseRetentionPeriod(item[eq+1:])
+		if err != nil || keep <= 0 {
+			return nil, fmt.Errorf("invalid period of retention rule %q", item)
+		}
+		rule.Keep = keep
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// validInterval returns true if s is an interval of intraday series
+func validInterval(s string) bool {
+	return intervalRank(s) >= 0
+}
+
+// intervalRank orders intervals of intraday series from the finest
+// one, it is -1 for other strings
+func intervalRank(s string) int {
+	for t := TimeIntervalOneMinute; t <= TimeIntervalSixtyMinute; t++ {
+		if t.keyName() == s {
+			return int(t)
+		}
+	}
+	return -1
+}
+
+// parseRetentionPeriod parses duration, "d" suffix means days
+func parseRetentionPeriod(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// CompactStats is the result of a compaction run.
+type CompactStats struct {
+	// Tickers are records changed by compaction
+	Tickers int `json:"tickers"`
+	// Removed are responses without bars left
+	Removed int `json:"removed"`
+	// Expired are bars dropped from responses
+	Expired int `json:"expired"`
+	// Rolled are daily bars made of expired intraday bars
+	Rolled int `json:"rolled"`
+}
+
+// Retention periodically drops bars of stored responses older than
+// rules allow. Before expiry intraday bars of fully covered regular
+// session are rolled up into daily bars of days without stored daily
+// bars, which are stored as a daily response of the ticker, so that
+// coarse history is kept. Rolled up responses rank below responses of
+// Alpha Vantage, see MetaData.rolledUp. Bars expire by whole days of
+// the exchange.
+//
+// Responses of a ticker are stored in one record, see MongoDB, so
+// bars are dropped by rewriting records instead of TTL indexes.
+// CSV responses have no metadata and are kept.
+type Retention struct {
+	p     *Proxy
+	rules []RetentionRule
+	now   func() time.Time
+}
+
+// NewRetention returns retention of history stored by p.
+func NewRetention(p *Proxy, rules []RetentionRule) *Retention {
+	return &Retention{
+		p:     p,
+		rules: rules,
+		now:   func() time.Time { return calendar.WallClock(time.Now()) },
+	}
+}
+
+// Run compacts history every period until stop is closed. Of proxies
+// sharing LimitStore only the leader compacts, see Proxy.Leader.
+func (r *Retention) Run(period time.Duration, stop <-chan struct{}) {
+	if len(r.rules) == 0 {
+		return
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		if r.p.Leader("retention", 2*period) {
+			stats, err := r.Compact(context.Background())
+			if err != nil {
+				r.p.rep.Report(err, reporter.LevelError, nil)
+			}
+			r.p.lg.Info("Compact history", zap.Int("tickers", stats.Tickers), zap.Int("removed", stats.Removed),
+				zap.Int("expired", stats.Expired), zap.Int("rolled", stats.Rolled))
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Compact applies rules to all stored records. Record changed during
+// compaction, e.g. by a new response, is skipped until the next run.
+func (r *Retention) Compact(ctx context.Context) (CompactStats, error) {
+	total := CompactStats{}
+	now := r.now()
+	err := r.p.db.Each(ctx, func(item *Item) error {
+		ohlcv, stats := r.compact(item.Ohlcv, now)
+		if stats == (CompactStats{}) {
+			return nil
+		}
+		ok, err := r.p.db.Replace(ctx, item, ohlcv)
+		if err != nil || !ok {
+			return err
+		}
+		stats.Tickers = 1
+		total.Tickers += stats.Tickers
+		total.Removed += stats.Removed
+		total.Expired += stats.Expired
+		total.Rolled += stats.Rolled
+		return nil
+	})
+	return total, err
+}
+
+// expiredSeries are bars of one series expired in a record
+type expiredSeries struct {
+	ts       TimeSeries
+	interval string
+	meta     *MetaData
+	bars     map[time.Time]*TimeSeriesValue
+}
+
+// compact returns responses without bars expired at now and with
+// daily bars rolled up from expired intraday bars.
+func (r *Retention) compact(ohlcv []primitive.Binary, now time.Time) ([]primitive.Binary, CompactStats) {
+	stats := CompactStats{}
+	kept := make([]primitive.Binary, 0, len(ohlcv))
+	expired := map[string]*expiredSeries{}
+	for _, data := range ohlcv {
+		body, series, err := r.expire(data.Data, now)
+		if err != nil || series == nil {
+			// not a series of rules, or not parsed
+			kept = append(kept, data)
+			continue
+		}
+		if body == nil {
+			stats.Removed++
+		} else {
+			kept = append(kept, primitive.Binary{Subtype: data.Subtype, Data: body})
+		}
+
+		key := series.ts.keyName() + ":" + series.interval
+		if prev, ok := expired[key]; ok {
+			for t, v := range series.bars {
+				prev.bars[t] = v
+			}
+		} else {
+			expired[key] = series
+		}
+	}
+
+	// finer intervals are rolled up first, days of stored daily bars
+	// and of finer intervals are not rolled up again
+	keys := make([]string, 0, len(expired))
+	for key := range expired {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := expired[keys[i]], expired[keys[j]]
+		if a.ts != b.ts {
+			return a.ts < b.ts
+		}
+		return intervalRank(a.interval) < intervalRank(b.interval)
+	})
+	covered := dailyDays(kept)
+	for _, key := range keys {
+		series := expired[key]
+		stats.Expired += len(series.bars)
+		if series.ts != timeSeriesIntraday {
+			continue
+		}
+		daily := rollupDaily(r.p.cal, series.interval, series.bars, covered)
+		if len(daily) == 0 {
+			continue
+		}
+		body, err := encodeDaily(series.meta, series.interval, daily)
+		if err != nil {
+			r.p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": series.meta.Symbol})
+			continue
+		}
+		for _, v := range daily {
+			covered[v.Time] = true
+		}
+		kept = append(kept, primitive.Binary{Subtype: 0x00, Data: body})
+		stats.Rolled += len(daily)
+	}
+	return kept, stats
+}
+
+// dailyDays returns days of daily bars of json responses.
+func dailyDays(ohlcv []primitive.Binary) map[time.Time]bool {
+	fn, _ := av.LookupFunction(TimeSeriesDaily.keyName())
+	dataKey := fn.DataKey(url.Values{})
+	days := map[time.Time]bool{}
+	for _, data := range ohlcv {
+		if !bytes.HasPrefix(bytes.TrimSpace(data.Data), []byte("{")) {
+			continue
+		}
+		values, err := parseTimeSeriesJSON(data.Data, dataKey)
+		if err != nil {
+			continue
+		}
+		for _, v := range values {
+			days[v.Time] = true
+		}
+	}
+	return days
+}
+
+// rule returns retention rule of series, rule of the interval wins
+// over rule of all intervals
+func (r *Retention) rule(ts TimeSeries, interval string) (RetentionRule, bool) {
+	var found *RetentionRule
+	for i, rule := range r.rules {
+		if rule.Function != ts.keyName() {
+			continue
+		}
+		if rule.Interval == interval {
+			return rule, true
+		}
+		if rule.Interval == "" && found == nil {
+			found = &r.rules[i]
+		}
+	}
+	if found == nil {
+		return RetentionRule{}, false
+	}
+	return *found, true
+}
+
+// expire drops bars of response older than its rule allows. It returns
+// nil series if nothing expired, and nil body if no bars are left.
+func (r *Retention) expire(body []byte, now time.Time) ([]byte, *expiredSeries, error) {
+	if !bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		return body, nil, nil
+	}
+	meta, err := parseMetaData(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, nil, err
+	}
+	ts, dataKey, ok := seriesOf(resp, meta)
+	if !ok {
+		return body, nil, nil
+	}
+	rule, ok := r.rule(ts, meta.Interval)
+	if !ok {
+		return body, nil, nil
+	}
+	y, m, d := now.Add(-rule.Keep).Date()
+	cutoff := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+
+	values, err := parseTimeSeriesJSON(body, dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	series := &expiredSeries{ts: ts, interval: meta.Interval, meta: meta, bars: map[time.Time]*TimeSeriesValue{}}
+	for _, v := range values {
+		if v.Time.Before(cutoff) {
+			series.bars[v.Time] = v
+		}
+	}
+	if len(series.bars) == 0 {
+		return body, nil, nil
+	}
+	if len(series.bars) == len(values) {
+		return nil, series, nil
+	}
+
+	var bars map[string]json.RawMessage
+	if err := json.Unmarshal(resp[dataKey], &bars); err != nil {
+		return nil, nil, err
+	}
+	for date := range bars {
+		t, err := parseDate(date, timeSeriesDateFormats...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if t.Before(cutoff) {
+			delete(bars, date)
+		}
+	}
+	if resp[dataKey], err = json.Marshal(bars); err != nil {
+		return nil, nil, err
+	}
+	body, err = json.Marshal(resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, series, nil
+}
+
+// seriesOf returns time series of json response and its data key.
+// Daily and daily adjusted series have the same key, adjusted ones
+// mention dividends in metadata.
+func seriesOf(resp map[string]json.RawMessage, meta *MetaData) (TimeSeries, string, bool) {
+	for ts := TimeSeriesDaily; ts <= timeSeriesIntraday; ts++ {
+		fn, ok := av.LookupFunction(ts.keyName())
+		if !ok {
+			continue
+		}
+		query := url.Values{}
+		query.Set(av.QueryInterval, meta.Interval)
+		dataKey := fn.DataKey(query)
+		if _, ok := resp[dataKey]; !ok {
+			continue
+		}
+		if ts == TimeSeriesDaily && strings.Contains(meta.Information, "Dividend") {
+			continue
+		}
+		return ts, dataKey, true
+	}
+	return 0, "", false
+}
+
+// rollupDaily returns daily bars of intraday bars of interval in
+// regular session, sorted by date. Days of covered are skipped, as well
+// as days whose session is not fully covered by bars, e.g. by compact
+// response, as their open and volume would be wrong.
+func rollupDaily(cal *calendar.Calendar, interval string, bars map[time.Time]*TimeSeriesValue,
+	covered map[time.Time]bool) []*TimeSeriesValue {
+
+	step, err := time.ParseDuration(strings.TrimSuffix(interval, "in"))
+	if err != nil || step <= 0 {
+		return nil
+	}
+	values := make([]*TimeSeriesValue, 0, len(bars))
+	// counts are bars of session by date, need is their amount in
+	// full session
+	counts := map[time.Time]int{}
+	need := map[time.Time]int{}
+	for _, v := range bars {
+		y, m, d := v.Time.Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, v.Time.Location())
+		if covered[date] {
+			continue
+		}
+		open, close, ok := cal.Session(date)
+		if !ok || v.Time.Before(open) || !v.Time.Before(close) {
+			// pre-market and post-market bars are not in daily bars
+			continue
+		}
+		counts[date]++
+		need[date] = int((close.Sub(open) + step - 1) / step)
+		values = append(values, v)
+	}
+	sort.Sort(sortTimeSeriesValuesByDate(values))
+
+	daily := []*TimeSeriesValue{}
+	var day *TimeSeriesValue
+	for _, v := range values {
+		y, m, d := v.Time.Date()
+		date := time.Date(y, m, d, 0, 0, 0, 0, v.Time.Location())
+		if counts[date] < need[date] {
+			continue
+		}
+		if day == nil || !day.Time.Equal(date) {
+			day = &TimeSeriesValue{Time: date, Open: v.Open, High: v.High, Low: v.Low}
+			daily = append(daily, day)
+		}
+		if v.High > day.High {
+			day.High = v.High
+		}
+		if v.Low < day.Low {
+			day.Low = v.Low
+		}
+		day.Close = v.Close
+		day.Volume += v.Volume
+	}
+	return daily
+}
+
+// rollupInformation marks "Information" of metadata of responses
+// rolled up by Retention.
+const rollupInformation = "rolled up from"
+
+// rolledUp returns true if response is daily bars rolled up by
+// Retention rather than a response of Alpha Vantage.
+func (m *MetaData) rolledUp() bool {
+	return strings.Contains(m.Information, rollupInformation)
+}
+
+// encodeDaily returns daily bars as TIME_SERIES_DAILY json response,
+// metadata tells interval of the rolled up bars.
+func encodeDaily(meta *MetaData, interval string, daily []*TimeSeriesValue) ([]byte, error) {
+	if len(daily) == 0 {
+		return nil, fmt.Errorf("no daily bars of %s", meta.Symbol)
+	}
+	format := func(f float64) string { return strconv.FormatFloat(f, 'f', 4, 64) }
+	series := map[string]map[string]string{}
+	for _, v := range daily {
+		series[v.Time.Format("2006-01-02")] = map[string]string{
+			"1. open":   format(v.Open),
+			"2. high":   format(v.High),
+			"3. low":    format(v.Low),
+			"4. close":  format(v.Close),
+			"5. volume": strconv.FormatFloat(v.Volume, 'f', -1, 64),
+		}
+	}
+	return json.Marshal(map[string]interface{}{
+		"Meta Data": map[string]string{
+			"1. Information":    "Daily Prices (open, high, low, close) and Volumes, " + rollupInformation + " " + interval + " bars",
+			"2. Symbol":         meta.Symbol,
+			"3. Last Refreshed": daily[len(daily)-1].Time.Format("2006-01-02"),
+			"4. Output Size":    "Compact",
+			"5. Time Zone":      meta.TimeZone,
+		},
+		"Time Series (Daily)": series,
+	})
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	calendar "github.com/adnilote/stock-proxy/trading-calendar"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestParseRetention(t *testing.T) {
+	cases := []struct {
+		in    string
+		rules []RetentionRule
+		fail  bool
+	}{
+		{"", []RetentionRule{}, false},
+		{"time_series_intraday:1min=30d, TIME_SERIES_DAILY=8760h", []RetentionRule{
+			{Function: "TIME_SERIES_INTRADAY", Interval: "1min", Keep: 30 * 24 * time.Hour},
+			{Function: "TIME_SERIES_DAILY", Keep: 8760 * time.Hour},
+		}, false},
+		{"TIME_SERIES_INTRADAY=90d", []RetentionRule{
+			{Function: "TIME_SERIES_INTRADAY", Keep: 90 * 24 * time.Hour},
+		}, false},
+		{"TIME_SERIES_INTRADAY:1min", nil, true},
+		{"TIME_SERIES_INTRADAY:2min=1d", nil, true},
+		{"TIME_SERIES_DAILY:1min=1d", nil, true},
+		{"GLOBAL_QUOTE=1d", nil, true},
+		{"TIME_SERIES_DAILY=0s", nil, true},
+		{"TIME_SERIES_DAILY=week", nil, true},
+	}
+	for caseNum, item := range cases {
+		rules, err := ParseRetention(item.in)
+		if (err != nil) != item.fail {
+			t.Errorf("[%d] unexpected error: %v", caseNum, err)
+			continue
+		}
+		if len(rules) != len(item.rules) {
+			t.Errorf("[%d] got %v, expected %v", caseNum, rules, item.rules)
+			continue
+		}
+		for i := range rules {
+			if rules[i] != item.rules[i] {
+				t.Errorf("[%d] got %v, expected %v", caseNum, rules[i], item.rules[i])
+			}
+		}
+	}
+}
+
+const intradayResponse = `{
+	"Meta Data": {
+		"1. Information": "Intraday (1min) open, high, low, close prices and volume",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-06 09:32:00",
+		"4. Interval": "1min",
+		"5. Output Size": "Compact",
+		"6. Time Zone": "US/Eastern"
+	},
+	"Time Series (1min)": {
+		"2019-08-06 09:32:00": {"1. open": "10.0", "2. high": "11.0", "3. low": "9.0", "4. close": "10.5", "5. volume": "100"},
+		"2019-08-05 09:32:00": {"1. open": "3.0", "2. high": "4.0", "3. low": "2.5", "4. close": "3.5", "5. volume": "20"},
+		"2019-08-02 09:32:00": {"1. open": "1.0", "2. high": "2.0", "3. low": "0.5", "4. close": "1.5", "5. volume": "10"}
+	}
+}`
+
+const olderIntradayResponse = `{
+	"Meta Data": {
+		"1. Information": "Intraday (1min) open, high, low, close prices and volume",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-02 09:33:00",
+		"4. Interval": "1min",
+		"5. Output Size": "Compact",
+		"6. Time Zone": "US/Eastern"
+	},
+	"Time Series (1min)": {
+		"2019-08-02 09:33:00": {"1. open": "1.5", "2. high": "3.0", "3. low": "1.0", "4. close": "2.0", "5. volume": "5"},
+		"2019-08-02 09:32:00": {"1. open": "1.0", "2. high": "2.0", "3. low": "0.5", "4. close": "1.5", "5. volume": "10"}
+	}
+}`
+
+const dailyResponse = `{
+	"Meta Data": {
+		"1. Information": "Daily Prices (open, high, low, close) and Volumes",
+		"2. Symbol": "AMZN",
+		"3. Last Refreshed": "2019-08-06",
+		"4. Output Size": "Compact",
+		"5. Time Zone": "US/Eastern"
+	},
+	"Time Series (Daily)": {
+		"2019-08-01": {"1. open": "1.0", "2. high": "2.0", "3. low": "0.5", "4. close": "1.5", "5. volume": "10"}
+	}
+}`
+
+// TestCompact checks that expired intraday bars are dropped, partly
+// covered session is not rolled up and series without rule are kept.
+func TestCompact(t *testing.T) {
+	r := &Retention{p: &Proxy{cal: calendar.New()}, rules: []RetentionRule{
+		{Function: "TIME_SERIES_INTRADAY", Interval: "1min", Keep: 24 * time.Hour},
+	}}
+	now := time.Date(2019, 8, 6, 12, 0, 0, 0, time.UTC)
+	ohlcv := []primitive.Binary{
+		{Data: []byte(intradayResponse)},
+		{Data: []byte(olderIntradayResponse)},
+		{Data: []byte(dailyResponse)},
+		{Data: []byte("timestamp,open,high,low,close,volume\n")},
+	}
+
+	kept, stats := r.compact(ohlcv, now)
+	if stats != (CompactStats{Removed: 1, Expired: 2}) {
+		t.Errorf("wrong stats %+v", stats)
+	}
+	if len(kept) != 3 {
+		t.Fatalf("expected 3 responses without rolled up one, got %d", len(kept))
+	}
+	if string(kept[1].Data) != dailyResponse || string(kept[2].Data) != string(ohlcv[3].Data) {
+		t.Errorf("responses without rule must be kept")
+	}
+
+	bars, err := parseTimeSeriesJSON(kept[0].Data, "Time Series (1min)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bars) != 2 || bars[0].Time != time.Date(2019, 8, 5, 9, 32, 0, 0, time.UTC) {
+		t.Errorf("bars since 2019-08-05 must be kept: %v", bars)
+	}
+
+	// compacted responses are not changed again
+	if _, stats := r.compact(kept, now); stats != (CompactStats{}) {
+		t.Errorf("expected no changes, got %+v", stats)
+	}
+}
+
+// sessionResponse returns intraday response of interval with bars of
+// regular session of days from its open, each bar at price of the day
+// with volume 1, and extra bars.
+func sessionResponse(t *testing.T, interval string, days map[time.Time]float64, extra ...*TimeSeriesValue) []byte {
+	step, _ := time.ParseDuration(strings.TrimSuffix(interval, "in"))
+	cal := calendar.New()
+	values := []*TimeSeriesAdjustedValue{}
+	for day, price := range days {
+		open, close, _ := cal.Session(day)
+		for bar := open; bar.Before(close); bar = bar.Add(step) {
+			values = append(values, &TimeSeriesAdjustedValue{TimeSeriesValue: TimeSeriesValue{
+				Time: bar, Open: price, High: price, Low: price, Close: price, Volume: 1}})
+		}
+	}
+	for _, v := range extra {
+		values = append(values, &TimeSeriesAdjustedValue{TimeSeriesValue: *v})
+	}
+	query := url.Values{"symbol": {"AMZN"}, "interval": {interval}}
+	body, err := encodeSeries(timeSeriesIntraday, query, values, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+// TestCompactRollup checks that only fully covered sessions of days
+// without stored daily bars are rolled up, once of the finest interval,
+// and that rolled up bars rank below daily bars of Alpha Vantage.
+func TestCompactRollup(t *testing.T) {
+	r := &Retention{p: &Proxy{cal: calendar.New()}, rules: []RetentionRule{
+		{Function: "TIME_SERIES_INTRADAY", Keep: 24 * time.Hour},
+	}}
+	now := time.Date(2019, 8, 6, 12, 0, 0, 0, time.UTC)
+	day := func(m time.Month, d int) time.Time { return time.Date(2019, m, d, 0, 0, 0, 0, time.UTC) }
+	// 2019-07-30 is covered by 3 bars only
+	halfHour := sessionResponse(t, "30min", map[time.Time]float64{day(8, 2): 2},
+		&TimeSeriesValue{Time: day(7, 30).Add(9*time.Hour + 30*time.Minute), Open: 7, High: 7, Low: 7, Close: 7, Volume: 1},
+		&TimeSeriesValue{Time: day(7, 30).Add(10 * time.Hour), Open: 7, High: 7, Low: 7, Close: 7, Volume: 1},
+		&TimeSeriesValue{Time: day(7, 30).Add(10*time.Hour + 30*time.Minute), Open: 7, High: 7, Low: 7, Close: 7, Volume: 1})
+	// 2019-08-02 is rolled up of 30min bars, 2019-08-01 has daily
+	// bar, post-market bar of 2019-07-31 is skipped
+	hour := sessionResponse(t, "60min", map[time.Time]float64{day(8, 2): 9, day(8, 1): 9, day(7, 31): 3},
+		&TimeSeriesValue{Time: day(7, 31).Add(17 * time.Hour), Open: 9, High: 90, Low: 9, Close: 9, Volume: 900})
+	ohlcv := []primitive.Binary{
+		{Data: halfHour},
+		{Data: hour},
+		{Data: []byte(dailyResponse)},
+	}
+
+	kept, stats := r.compact(ohlcv, now)
+	if stats != (CompactStats{Removed: 2, Expired: 38, Rolled: 2}) {
+		t.Errorf("wrong stats %+v", stats)
+	}
+	if len(kept) != 3 || string(kept[0].Data) != dailyResponse {
+		t.Fatalf("expected daily response and 2 rolled up ones, got %d", len(kept))
+	}
+	cases := []struct {
+		data     []byte
+		interval string
+		expected TimeSeriesValue
+	}{
+		{kept[1].Data, "30min", TimeSeriesValue{Time: day(8, 2), Open: 2, High: 2, Low: 2, Close: 2, Volume: 13}},
+		{kept[2].Data, "60min", TimeSeriesValue{Time: day(7, 31), Open: 3, High: 3, Low: 3, Close: 3, Volume: 7}},
+	}
+	for caseNum, item := range cases {
+		daily, err := parseTimeSeriesJSON(item.data, "Time Series (Daily)")
+		if err != nil || len(daily) != 1 || *daily[0] != item.expected {
+			t.Errorf("[%d] wrong daily bars %+v: %v", caseNum, daily, err)
+		}
+		meta, err := parseMetaData(item.data)
+		if err != nil || !meta.rolledUp() || !strings.Contains(meta.Information, item.interval) {
+			t.Errorf("[%d] wrong metadata of rolled up bars %+v: %v", caseNum, meta, err)
+		}
+	}
+
+	// later rolled up bars do not replace daily bars of Alpha Vantage
+	stale, err := encodeDaily(&MetaData{Symbol: "AMZN"}, "1min", []*TimeSeriesValue{
+		{Time: day(8, 1), Open: 9, High: 9, Low: 9, Close: 9, Volume: 9},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := &Item{Ohlcv: append(kept, primitive.Binary{Data: stale})}
+	bars := seriesBars(item, "Time Series (Daily)")
+	if len(bars) != 3 || bars[1].Close != 1.5 {
+		t.Errorf("daily bar of Alpha Vantage must win over rolled up one: %+v", bars)
+	}
+
+	// rolled up days are not rolled up again
+	ohlcv = append(kept, primitive.Binary{Data: sessionResponse(t, "60min", map[time.Time]float64{day(8, 2): 9})})
+	if _, stats := r.compact(ohlcv, now); stats != (CompactStats{Removed: 1, Expired: 7}) {
+		t.Errorf("expected no rolled up bars, got %+v", stats)
+	}
+}
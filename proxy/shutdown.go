@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/redact"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.uber.org/zap"
+)
+
+// PendingTask is a task persisted on shutdown to be fetched after
+// restart.
+type PendingTask struct {
+	ID      primitive.ObjectID `bson:"_id,omitempty"`
+	Key     string             `bson:"key"`
+	Query   url.Values         `bson:"query"`
+	Created time.Time          `bson:"created"`
+}
+
+// PendingDB is a store of tasks not finished on shutdown.
+type PendingDB struct {
+	db      *mongo.Collection
+	timeout time.Duration
+}
+
+// Add stores task, secret params of client are redacted.
+func (d *PendingDB) Add(task *Task) error {
+	ctx, cancel := dbContext(context.Background(), d.timeout)
+	defer cancel()
+	_, err := d.db.InsertOne(ctx, PendingTask{
+		Key:     task.key,
+		Query:   redact.Query(task.query),
+		Created: time.Now(),
+	})
+	return err
+}
+
+// Take removes and returns all stored tasks.
+func (d *PendingDB) Take() ([]PendingTask, error) {
+	ctx, cancel := dbContext(context.Background(), d.timeout)
+	defer cancel()
+
+	tasks := []PendingTask{}
+	cur, err := d.db.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	if err := cur.All(ctx, &tasks); err != nil {
+		return nil, err
+	}
+	for _, task := range tasks {
+		if _, err := d.db.DeleteOne(ctx, bson.M{"_id": task.ID}); err != nil {
+			return nil, err
+		}
+	}
+	return tasks, nil
+}
+
+// persist stores task not sent to Alpha Vantage because of shutdown.
+// Sync client gets 503.
+func (p *Proxy) persist(task *Task) {
+	if task.wait != nil {
+		task.wait.End()
+	}
+	if err := p.pending.Add(task); err != nil {
+		p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": task.key})
+	} else {
+		atomic.AddInt64(&p.persisted, 1)
+	}
+	if task.sendClient {
+		writeError(task.w, errShuttingDown)
+		task.out <- struct{}{}
+	}
+}
+
+// restore queues tasks persisted on the previous shutdown, as async
+// ones. Tasks which do not fit in queue are left persisted.
+func (p *Proxy) restore() {
+	pending, err := p.pending.Take()
+	if err != nil {
+		p.rep.Report(err, reporter.LevelError, nil)
+		return
+	}
+
+	restored := 0
+	for _, pt := range pending {
+		task, apiErr := p.newTask(context.Background(), nil, pt.Query, false)
+		if apiErr != nil {
+			p.lg.Warn("Drop invalid pending task", zap.String("ticker", pt.Key), zap.Error(apiErr))
+			continue
+		}
+		task.client = "restore"
+		if !p.try(task) {
+			if err := p.pending.Add(task); err != nil {
+				p.rep.Report(err, reporter.LevelError, map[string]interface{}{"ticker": pt.Key})
+			}
+			continue
+		}
+		restored++
+	}
+	if len(pending) > 0 {
+		p.lg.Info("Restore pending tasks", zap.Int("restored", restored), zap.Int("pending", len(pending)))
+	}
+}
+
+// closing returns true if Close was called.
+func (p *Proxy) closing() bool {
+	return p.queue.isClosed()
+}
+
+// Close stops accepting tasks and waits for queued ones to be sent to
+// Alpha Vantage within ShutdownTimeout. Tasks left by then are persisted
+// and queued again by NewProxy after restart, their sync clients get
+// 503. Requests already sent to Alpha Vantage are finished, as they are
+// limited by av-client timeout.
+//
+// Close does not close mongoDB session of the proxy.
+func (p *Proxy) Close() error {
+	if p.closing() {
+		return errors.New("proxy is already closed")
+	}
+	p.queue.close()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	p.mu.Lock()
+	timer := time.NewTimer(p.timeout)
+	p.mu.Unlock()
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		p.lg.Info("Proxy closed, all tasks finished")
+		return nil
+	case <-timer.C:
+	}
+
+	// workers persist tasks waiting for API key budget
+	close(p.stop)
+	for _, task := range p.queue.drain() {
+		p.persist(task)
+	}
+	<-done
+
+	p.lg.Warn("Proxy closed by timeout", zap.Int64("persisted", atomic.LoadInt64(&p.persisted)))
+	return nil
+}
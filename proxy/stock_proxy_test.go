@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"log"
@@ -16,7 +17,8 @@ import (
 	av "github.com/adnilote/stock-proxy/av-client"
 	"go.uber.org/zap"
 
-	mgo "gopkg.in/mgo.v2"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var handler *Proxy
@@ -52,22 +54,22 @@ func init() {
 	}
 
 	// connect to db
-	sess, err := mgo.Dial(dbURL)
+	client, err := mongo.Connect(context.Background(), options.Client().ApplyURI(dbURL))
 	if err != nil {
 		log.Fatalf("Error connecting to mongoDB: %v", err)
 	}
 
-	collection := sess.DB("av").C("timeseries")
+	db := client.Database("av")
 
 	// get amount of records in db
-	n, err := collection.Count()
+	n, err := db.Collection(collTimeseries).EstimatedDocumentCount(context.Background())
 	if err != nil {
 		log.Fatalf("Error count in mongoDB: %v", err)
 	}
 	log.Printf("Start db collection_count = %d", n)
 
 	// handler
-	handler, err = NewProxy(collection, lg)
+	handler, err = NewProxy(db, lg, Options{})
 	if err != nil {
 		log.Fatalf("Error in NewProxy: %v", err)
 	}
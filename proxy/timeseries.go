@@ -2,8 +2,10 @@ package proxy
 
 import (
 	"encoding/csv"
+	"encoding/json"
 	"io"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -64,6 +66,16 @@ func (t TimeSeries) keyName() string {
 	return "UNKNOWN"
 }
 
+// parseTimeSeries returns TimeSeries by its Alpha Vantage name
+func parseTimeSeries(name string) (TimeSeries, bool) {
+	for t := TimeSeriesDaily; t <= timeSeriesIntraday; t++ {
+		if t.keyName() == name {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
 // TimeInterval specifies a frequency to query for intraday stock data.
 // For valid options, see the TimeInterval* package constants.
 type TimeInterval uint8
@@ -188,6 +200,10 @@ func parseTimeSeriesRecord(s []string) (*TimeSeriesValue, error) {
 		volume
 	)
 
+	if len(s) <= volume {
+		return nil, errors.Errorf("expected at least %d columns, got %d", volume+1, len(s))
+	}
+
 	value := &TimeSeriesValue{}
 
 	d, err := parseDate(s[timestamp], timeSeriesDateFormats...)
@@ -228,3 +244,49 @@ func parseTimeSeriesRecord(s []string) (*TimeSeriesValue, error) {
 
 	return value, nil
 }
+
+// parseTimeSeriesJSON will parse json response of time series,
+// dataKey is the key of series in response, e.g. "Time Series (5min)".
+func parseTimeSeriesJSON(body []byte, dataKey string) ([]*TimeSeriesValue, error) {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, errors.Wrap(err, "error parsing response")
+	}
+	var series map[string]map[string]string
+	if err := json.Unmarshal(resp[dataKey], &series); err != nil {
+		return nil, errors.Wrapf(err, "error parsing %s", dataKey)
+	}
+
+	values := make([]*TimeSeriesValue, 0, len(series))
+	for date, fields := range series {
+		// strip numbering, i.e. "1. open" -> "open"
+		columns := map[string]string{}
+		for k, v := range fields {
+			if i := strings.Index(k, ". "); i >= 0 {
+				k = k[i+2:]
+			}
+			columns[k] = v
+		}
+
+		// FX series have no volume
+		if columns["volume"] == "" {
+			columns["volume"] = "0"
+		}
+		value, err := parseTimeSeriesRecord([]string{
+			date,
+			columns["open"],
+			columns["high"],
+			columns["low"],
+			columns["close"],
+			columns["volume"],
+		})
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+
+	sort.Sort(sortTimeSeriesValuesByDate(values))
+
+	return values, nil
+}
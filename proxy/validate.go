@@ -0,0 +1,128 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+)
+
+var (
+	// outputSizes are allowed values of av.QueryOutputSize
+	outputSizes = []string{"compact", "full"}
+	// dataTypes are allowed values of av.QueryDataType
+	dataTypes = []string{"json", "csv"}
+)
+
+// timeSeriesNames returns Alpha Vantage names of all TimeSeries.
+func timeSeriesNames() []string {
+	names := []string{}
+	for t := TimeSeriesDaily; t <= timeSeriesIntraday; t++ {
+		names = append(names, t.keyName())
+	}
+	return names
+}
+
+// timeIntervalNames returns Alpha Vantage names of all TimeInterval.
+func timeIntervalNames() []string {
+	names := []string{}
+	for t := TimeIntervalOneMinute; t <= TimeIntervalSixtyMinute; t++ {
+		names = append(names, t.keyName())
+	}
+	return names
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// validateQuery checks query params of function against the av-client
+// function registry and TimeSeries/TimeInterval enums, so that
+// invalid requests do not waste upstream rate limit. Params not
+// accepted by function are rejected.
+func validateQuery(query url.Values) *APIError {
+	function := query.Get(av.QueryFunction)
+	if function == "" {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeMissingParam,
+			Field:   av.QueryFunction,
+			Message: "function required",
+			Allowed: av.FunctionNames(),
+		}
+	}
+
+	fn, ok := av.LookupFunction(function)
+	if ok && strings.HasPrefix(fn.Name, "TIME_SERIES_") {
+		ok = contains(timeSeriesNames(), fn.Name)
+	}
+	if !ok {
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeUnknownFunction,
+			Field:   av.QueryFunction,
+			Message: "unknown function " + function,
+			Allowed: av.FunctionNames(),
+		}
+	}
+
+	// misspelled params would be dropped silently
+	params := append([]string{av.QueryFunction}, fn.Params()...)
+	unknown := []string{}
+	for param := range query {
+		if !contains(params, param) {
+			unknown = append(unknown, param)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return &APIError{
+			Status:  http.StatusBadRequest,
+			Code:    CodeInvalidParam,
+			Field:   unknown[0],
+			Message: "unknown param " + unknown[0] + " of " + fn.Name,
+			Allowed: params,
+		}
+	}
+
+	for _, param := range fn.Required {
+		if query.Get(param) == "" {
+			return &APIError{
+				Status:  http.StatusBadRequest,
+				Code:    CodeMissingParam,
+				Field:   param,
+				Message: param + " required by " + fn.Name,
+			}
+		}
+	}
+
+	allowed := map[string][]string{
+		av.QueryInterval:   timeIntervalNames(),
+		av.QueryOutputSize: outputSizes,
+		av.QueryDataType:   dataTypes,
+	}
+	for _, param := range fn.Params() {
+		v := query.Get(param)
+		if v == "" || allowed[param] == nil {
+			continue
+		}
+		if !contains(allowed[param], v) {
+			return &APIError{
+				Status:  http.StatusBadRequest,
+				Code:    CodeInvalidParam,
+				Field:   param,
+				Message: "invalid " + param + " " + v,
+				Allowed: allowed[param],
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	av "github.com/adnilote/stock-proxy/av-client"
+)
+
+func TestValidateQuery(t *testing.T) {
+	cases := []struct {
+		params url.Values
+		code   string
+		field  string
+	}{
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_INTRADAY"},
+				av.QueryInterval: {"5min"},
+				av.QuerySymbol:   {"amzn"},
+			},
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_INTRADAY"},
+				av.QueryInterval: {"2min"},
+				av.QuerySymbol:   {"amzn"},
+			},
+			code:  CodeInvalidParam,
+			field: av.QueryInterval,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction:   {"TIME_SERIES_DAILY"},
+				av.QuerySymbol:     {"amzn"},
+				av.QueryOutputSize: {"huge"},
+			},
+			code:  CodeInvalidParam,
+			field: av.QueryOutputSize,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_DAILY"},
+				av.QuerySymbol:   {"amzn"},
+				av.QueryDataType: {"xml"},
+			},
+			code:  CodeInvalidParam,
+			field: av.QueryDataType,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_HOURLY"},
+				av.QuerySymbol:   {"amzn"},
+			},
+			code:  CodeUnknownFunction,
+			field: av.QueryFunction,
+		},
+		{
+			params: url.Values{
+				av.QuerySymbol: {"amzn"},
+			},
+			code:  CodeMissingParam,
+			field: av.QueryFunction,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_INTRADAY"},
+				av.QuerySymbol:   {"amzn"},
+			},
+			code:  CodeMissingParam,
+			field: av.QueryInterval,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction:     {"CURRENCY_EXCHANGE_RATE"},
+				av.QueryFromCurrency: {"BTC"},
+			},
+			code:  CodeMissingParam,
+			field: av.QueryToCurrency,
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_INTRADAY"},
+				"intreval":       {"5min"},
+				av.QuerySymbol:   {"amzn"},
+			},
+			code:  CodeInvalidParam,
+			field: "intreval",
+		},
+		{
+			params: url.Values{
+				av.QueryFunction: {"TIME_SERIES_DAILY"},
+				av.QueryInterval: {"5min"},
+				av.QuerySymbol:   {"amzn"},
+			},
+			code:  CodeInvalidParam,
+			field: av.QueryInterval,
+		},
+	}
+
+	for caseNum, cs := range cases {
+		err := validateQuery(cs.params)
+		if cs.code == "" {
+			if err != nil {
+				t.Errorf("[%d] unexpected error: %s", caseNum, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("[%d] expected error %s", caseNum, cs.code)
+			continue
+		}
+		if err.Code != cs.code || err.Field != cs.field {
+			t.Errorf("[%d] got %s/%s, expected %s/%s",
+				caseNum, err.Code, err.Field, cs.code, cs.field)
+		}
+		if err.Status != http.StatusBadRequest {
+			t.Errorf("[%d] wrong Status: got %d", caseNum, err.Status)
+		}
+	}
+}
+
+func TestValidateQueryUnknown(t *testing.T) {
+	err := validateQuery(url.Values{
+		av.QueryFunction: {"GLOBAL_QUOTE"},
+		av.QuerySymbol:   {"amzn"},
+		"apikey":         {"demo"},
+	})
+	if err == nil || err.Field != "apikey" || err.Message != "unknown param apikey of GLOBAL_QUOTE" ||
+		strings.Join(err.Allowed, ",") != "function,symbol,datatype" {
+		t.Errorf("wrong error %+v", err)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeError(w, validateQuery(url.Values{
+		av.QueryFunction: {"TIME_SERIES_INTRADAY"},
+		av.QueryInterval: {"2min"},
+		av.QuerySymbol:   {"amzn"},
+	}))
+
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("wrong StatusCode: got %d, expected %d", w.Code, http.StatusBadRequest)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("wrong Content-Type: got %s", ct)
+	}
+	expected := `{"code":"invalid_param","field":"interval","message":"invalid interval 2min","allowed":["1min","5min","15min","30min","60min"]}` + "\n"
+	if w.Body.String() != expected {
+		t.Errorf("got %s, expected %s", w.Body.String(), expected)
+	}
+}
@@ -0,0 +1,44 @@
+package redact
+
+import (
+	"net/url"
+)
+
+// redactedError is an error with redacted message. It has no cause,
+// so that secrets do not leak through error chain.
+type redactedError struct {
+	msg     string
+	timeout bool
+}
+
+func (e *redactedError) Error() string { return e.msg }
+
+// Timeout reports whether redacted error was a timeout.
+func (e *redactedError) Timeout() bool { return e.timeout }
+
+// Error returns err with secrets redacted from its message. URL of
+// *url.Error is redacted keeping its type, other errors with secrets
+// are replaced by error with redacted message only.
+func Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if urlErr, ok := err.(*url.Error); ok {
+		return &url.Error{
+			Op:  urlErr.Op,
+			URL: String(urlErr.URL),
+			Err: Error(urlErr.Err),
+		}
+	}
+
+	msg := err.Error()
+	clean := String(msg)
+	if clean == msg {
+		return err
+	}
+	timeout := false
+	if t, ok := err.(interface{ Timeout() bool }); ok {
+		timeout = t.Timeout()
+	}
+	return &redactedError{msg: clean, timeout: timeout}
+}
@@ -0,0 +1,105 @@
+// Package redact scrubs secrets, e.g. Alpha Vantage API keys, from
+// strings, errors, query params, log fields and Sentry events.
+//
+// Values of secret params, like apikey=..., are always redacted.
+// Registered secrets, see SetSecrets, are redacted anywhere in text,
+// e.g. in messages of upstream errors.
+package redact
+
+import (
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Redacted replaces secrets.
+const Redacted = "REDACTED"
+
+// secretParams are names of params and headers with credentials.
+var secretParams = []string{"apikey", "api_key", "token", "access_token", "password", "secret", "authorization"}
+
+// paramRe matches value of secret param in URL, query or header like
+// text, e.g. "apikey=KEY", "token: KEY" or `"password":"KEY"`.
+var paramRe = regexp.MustCompile(`(?i)("?\b(?:` + strings.Join(secretParams, "|") + `)"?\s*[=:]\s*"?)(?:bearer\s+|basic\s+)?[^&\s"',;]+`)
+
+var (
+	mu      sync.RWMutex
+	secrets []string
+)
+
+// SetSecrets registers secrets, e.g. API keys, which are redacted
+// anywhere in text. Secrets of previous call are kept, as they may
+// be still in flight.
+func SetSecrets(values ...string) {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, v := range values {
+		// too short secrets would redact usual words
+		if len(v) < 8 || containsString(secrets, v) {
+			continue
+		}
+		secrets = append(secrets, v)
+	}
+	// longer first, so that secret containing another one is
+	// redacted as a whole
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+}
+
+// String returns s with secrets replaced by Redacted.
+func String(s string) string {
+	s = paramRe.ReplaceAllString(s, "${1}"+Redacted)
+
+	mu.RLock()
+	defer mu.RUnlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, Redacted, -1)
+	}
+	return s
+}
+
+// Query returns copy of query with values of secret params replaced
+// by Redacted.
+func Query(query url.Values) url.Values {
+	clean := make(url.Values, len(query))
+	for k, values := range query {
+		if IsSecretParam(k) {
+			clean[k] = []string{Redacted}
+			continue
+		}
+		for _, v := range values {
+			clean[k] = append(clean[k], String(v))
+		}
+	}
+	return clean
+}
+
+// IsSecretParam returns true if param or header name holds
+// credentials, e.g. apikey.
+func IsSecretParam(name string) bool {
+	for _, param := range secretParams {
+		if strings.EqualFold(name, param) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask hides all but last 4 characters of secret, e.g. to tell API
+// keys apart in metrics.
+func Mask(secret string) string {
+	if len(secret) <= 4 {
+		return "****"
+	}
+	return "****" + secret[len(secret)-4:]
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package redact
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/getsentry/sentry-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const testKey = "7Z29L509PNF9IE24"
+
+func TestString(t *testing.T) {
+	SetSecrets(testKey, "short")
+
+	cases := []struct {
+		in  string
+		out string
+	}{
+		{"https://www.alphavantage.co/query?apikey=ABC&symbol=amzn", "https://www.alphavantage.co/query?apikey=REDACTED&symbol=amzn"},
+		{"query?function=FX_DAILY&APIKEY=ABC", "query?function=FX_DAILY&APIKEY=REDACTED"},
+		{`{"api_key": "ABC", "symbol": "amzn"}`, `{"api_key": "REDACTED", "symbol": "amzn"}`},
+		{"Authorization: Bearer abc.def", "Authorization: REDACTED"},
+		{"invalid key " + testKey + " used", "invalid key REDACTED used"},
+		// short secrets are not registered
+		{"short symbol", "short symbol"},
+		{"symbol=amzn&interval=5min", "symbol=amzn&interval=5min"},
+	}
+	for caseNum, item := range cases {
+		if out := String(item.in); out != item.out {
+			t.Errorf("[%d] wrong redaction: got %q, expected %q", caseNum, out, item.out)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	query := url.Values{"apikey": {"ABC"}, "symbol": {"amzn"}, "keywords": {testKey}}
+	clean := Query(query)
+	if clean.Get("apikey") != Redacted || clean.Get("symbol") != "amzn" || clean.Get("keywords") != Redacted {
+		t.Errorf("wrong query: %v", clean)
+	}
+	if query.Get("apikey") != "ABC" {
+		t.Errorf("query must not be changed")
+	}
+}
+
+// TestError checks that API key does not leak through error of
+// upstream request.
+func TestError(t *testing.T) {
+	SetSecrets(testKey)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+	}))
+	defer server.Close()
+
+	_, err := http.Get(server.URL + "/query?function=GLOBAL_QUOTE&symbol=amzn&apikey=" + testKey)
+	if err == nil || !strings.Contains(err.Error(), testKey) {
+		t.Fatalf("expected error with key, got %v", err)
+	}
+
+	cases := []error{
+		err,
+		errors.New("bad key " + testKey),
+		&url.Error{Op: "Get", URL: "?apikey=ABC", Err: errors.New("key " + testKey)},
+	}
+	for caseNum, item := range cases {
+		clean := Error(item)
+		if strings.Contains(clean.Error(), testKey) || strings.Contains(clean.Error(), "ABC") {
+			t.Errorf("[%d] key leaks: %v", caseNum, clean)
+		}
+		if _, ok := item.(*url.Error); ok {
+			if _, ok := clean.(*url.Error); !ok {
+				t.Errorf("[%d] type of url.Error is lost", caseNum)
+			}
+		}
+	}
+	if plain := errors.New("not found"); Error(plain) != plain {
+		t.Errorf("error without secrets must be kept")
+	}
+}
+
+func TestCore(t *testing.T) {
+	SetSecrets(testKey)
+	obs, logs := observer.New(zap.DebugLevel)
+	lg := zap.New(Core(obs)).With(zap.String("url", "?apikey="+testKey))
+
+	lg.Error("request "+testKey+" failed",
+		zap.Error(errors.New("key "+testKey)),
+		zap.String("apikey", "ABC"),
+		zap.Stringer("query", &url.URL{Path: "/query", RawQuery: "apikey=ABC"}),
+		zap.Any("extra", map[string]string{"k": testKey}),
+		zap.Int("n", 1),
+	)
+
+	entries := logs.AllUntimed()
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 entry, got %d", len(entries))
+	}
+	line := entries[0].Message
+	for k, v := range entries[0].ContextMap() {
+		line += " " + k + "=" + fmt.Sprint(v)
+	}
+	if strings.Contains(line, testKey) || strings.Contains(line, "ABC") {
+		t.Errorf("key leaks to log: %s", line)
+	}
+	if entries[0].ContextMap()["n"] != int64(1) {
+		t.Errorf("fields without secrets must be kept")
+	}
+}
+
+func TestSentryEvent(t *testing.T) {
+	SetSecrets(testKey)
+	event := sentry.NewEvent()
+	event.Message = "key " + testKey
+	event.Exception = []sentry.Exception{{Value: `Get "?apikey=ABC": EOF`}}
+	event.Extra = map[string]interface{}{"apikey": "ABC", "ticker": "AMZN", "query": url.Values{"apikey": {"ABC"}}}
+	event.Request = &sentry.Request{
+		URL:         "http://proxy/sync/",
+		QueryString: "apikey=ABC&symbol=amzn",
+		Headers:     map[string]string{"Authorization": "Basic abc", "X-Request-ID": "1"},
+	}
+	event = SentryEvent(event, nil)
+
+	dump := event.Message + event.Exception[0].Value + event.Request.QueryString + event.Request.Headers["Authorization"]
+	for _, v := range event.Extra {
+		dump += fmt.Sprint(v)
+	}
+	if strings.Contains(dump, testKey) || strings.Contains(dump, "ABC") || strings.Contains(dump, "abc") {
+		t.Errorf("key leaks to sentry: %s", dump)
+	}
+	if event.Extra["ticker"] != "AMZN" || event.Request.Headers["X-Request-ID"] != "1" {
+		t.Errorf("values without secrets must be kept")
+	}
+}
+
+func TestMask(t *testing.T) {
+	if m := Mask(testKey); m != "****IE24" {
+		t.Errorf("wrong mask %s", m)
+	}
+	if m := Mask("abc"); m != "****" {
+		t.Errorf("wrong mask of short key %s", m)
+	}
+}
@@ -0,0 +1,53 @@
+package redact
+
+import (
+	"fmt"
+
+	"github.com/getsentry/sentry-go"
+)
+
+// SentryEvent redacts secrets from event before it is sent, e.g.
+//
+//	sentry.Init(sentry.ClientOptions{BeforeSend: redact.SentryEvent})
+func SentryEvent(event *sentry.Event, hint *sentry.EventHint) *sentry.Event {
+	event.Message = String(event.Message)
+	for i := range event.Exception {
+		event.Exception[i].Value = String(event.Exception[i].Value)
+	}
+	event.Extra = extra(event.Extra)
+	for _, b := range event.Breadcrumbs {
+		b.Message = String(b.Message)
+		b.Data = extra(b.Data)
+	}
+
+	if r := event.Request; r != nil {
+		r.URL = String(r.URL)
+		r.QueryString = String(r.QueryString)
+		r.Data = String(r.Data)
+		r.Cookies = ""
+		for k, v := range r.Headers {
+			if IsSecretParam(k) {
+				r.Headers[k] = Redacted
+			} else {
+				r.Headers[k] = String(v)
+			}
+		}
+	}
+	return event
+}
+
+// extra redacts values of event extra or breadcrumb data.
+func extra(values map[string]interface{}) map[string]interface{} {
+	for k, v := range values {
+		switch {
+		case IsSecretParam(k):
+			values[k] = Redacted
+		case v == nil:
+		default:
+			if s := fmt.Sprintf("%v", v); String(s) != s {
+				values[k] = String(s)
+			}
+		}
+	}
+	return values
+}
@@ -0,0 +1,74 @@
+package redact
+
+import (
+	"fmt"
+
+	"go.uber.org/zap/zapcore"
+)
+
+// core redacts message and fields of log entries of next core.
+type core struct {
+	zapcore.Core
+}
+
+// Core returns core redacting secrets from messages and fields, e.g.
+//
+//	lg = lg.WithOptions(zap.WrapCore(redact.Core))
+func Core(next zapcore.Core) zapcore.Core {
+	return &core{Core: next}
+}
+
+func (c *core) With(fields []zapcore.Field) zapcore.Core {
+	return &core{Core: c.Core.With(Fields(fields))}
+}
+
+func (c *core) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(ent.Level) {
+		return ce.AddCore(ent, c)
+	}
+	return ce
+}
+
+func (c *core) Write(ent zapcore.Entry, fields []zapcore.Field) error {
+	ent.Message = String(ent.Message)
+	return c.Core.Write(ent, Fields(fields))
+}
+
+// Fields returns copy of fields with secrets redacted from strings,
+// errors, stringers and values of secret keys.
+func Fields(fields []zapcore.Field) []zapcore.Field {
+	clean := make([]zapcore.Field, len(fields))
+	for i, f := range fields {
+		clean[i] = field(f)
+	}
+	return clean
+}
+
+func field(f zapcore.Field) zapcore.Field {
+	if IsSecretParam(f.Key) {
+		return zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: Redacted}
+	}
+
+	switch f.Type {
+	case zapcore.StringType:
+		f.String = String(f.String)
+	case zapcore.ByteStringType:
+		if b, ok := f.Interface.([]byte); ok {
+			f.Interface = []byte(String(string(b)))
+		}
+	case zapcore.ErrorType:
+		if err, ok := f.Interface.(error); ok {
+			f.Interface = Error(err)
+		}
+	case zapcore.StringerType:
+		if s, ok := f.Interface.(fmt.Stringer); ok {
+			f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: String(s.String())}
+		}
+	case zapcore.ReflectType:
+		// keep structure of values without secrets
+		if v := fmt.Sprintf("%+v", f.Interface); String(v) != v {
+			f = zapcore.Field{Key: f.Key, Type: zapcore.StringType, String: String(v)}
+		}
+	}
+	return f
+}
@@ -2,54 +2,48 @@ package main
 
 import (
 	"log"
+	"os"
 	"time"
 
+	reporter "github.com/adnilote/stock-proxy/error-reporter"
+	"github.com/adnilote/stock-proxy/redact"
 	"github.com/getsentry/sentry-go"
 	"go.uber.org/zap"
 )
 
-// ConfigureSentry initiates Sentry
-func ConfigureSentry(dsn string) {
-	// dsn := config.GetSentryDSN()
-	// if dsn == "" {
-	// 	return
-	// }
+// rep reports errors of main, see ConfigureSentry
+var rep reporter.Reporter = reporter.Nop{}
 
+// ConfigureSentry initiates Sentry and returns reporter, which logs
+// errors and sends them to Sentry in background without duplicates.
+func ConfigureSentry(dsn string, lg *zap.Logger) reporter.Reporter {
 	err := sentry.Init(sentry.ClientOptions{
 		Dsn:              dsn,
 		AttachStacktrace: true,
+		BeforeSend:       redact.SentryEvent,
 	})
 	if err != nil {
 		log.Printf("sentry initialization failed: %v", err)
+		return reporter.NewLog(lg)
 	}
-}
-
-// CaptureError sends to Sentry general exception info
-// with sentry.Level and with some extra provided detail in params.
-// Also write into log.
-func CaptureError(err error, level sentry.Level, params ...map[string]interface{}) {
-	sentry.WithScope(func(scope *sentry.Scope) {
-		var extra map[string]interface{}
-		if len(params) > 0 {
-			extra = params[0]
-		} else {
-			extra = map[string]interface{}{}
-		}
-
-		for k, v := range extra {
-			scope.SetExtra(k, v)
-		}
-
-		scope.SetLevel(level)
 
-		sentry.CaptureException(err)
-	})
+	return reporter.Multi(
+		reporter.NewLog(lg),
+		reporter.NewDedup(reporter.NewAsync(reporter.NewSentry(sentry.CurrentHub()), 100, time.Second), time.Minute),
+	)
+}
 
-	if level == sentry.LevelFatal {
-		lg.Fatal("", zap.Error(err))
+// CaptureError reports err with level and with some extra provided
+// detail in params. Fatal error is flushed and exits the process.
+func CaptureError(err error, level reporter.Level, params ...map[string]interface{}) {
+	var extra map[string]interface{}
+	if len(params) > 0 {
+		extra = params[0]
 	}
-	if level == sentry.LevelError {
-		lg.Error("", zap.Error(err))
+	rep.Report(err, level, extra)
+
+	if level == reporter.LevelFatal {
+		rep.Flush(5 * time.Second)
+		os.Exit(1)
 	}
-	sentry.Flush(time.Second * 5)
 }
@@ -0,0 +1,98 @@
+// Package tracing sets up OpenTelemetry tracing of stock proxy.
+// Spans are exported by OTLP/HTTP, trace context of requests is
+// propagated by W3C traceparent header.
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/adnilote/stock-proxy/internal/httputil"
+	"github.com/adnilote/stock-proxy/redact"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracerName is name of tracer of stock proxy spans.
+const TracerName = "github.com/adnilote/stock-proxy"
+
+// Tracer returns tracer of global provider, which does nothing
+// until Setup.
+func Tracer() trace.Tracer {
+	return otel.Tracer(TracerName)
+}
+
+// NewProvider returns provider batching spans to exporter, e.g.
+// tracetest.NewInMemoryExporter in tests.
+func NewProvider(exporter sdktrace.SpanExporter, service string) *sdktrace.TracerProvider {
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", service))),
+	)
+}
+
+// Setup installs W3C trace context propagator and, if endpoint is
+// set, global provider exporting spans to OTLP/HTTP endpoint, e.g.
+// "http://otel-collector:4318". Returned shutdown flushes spans.
+func Setup(ctx context.Context, endpoint, service string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{}, propagation.Baggage{}))
+	if endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	provider := NewProvider(exporter, service)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// Handler starts server span of requests to h, continuing trace of
+// incoming traceparent header. Span is in context of request.
+func Handler(name string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := Tracer().Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.method", r.Method),
+				attribute.String("http.target", redact.String(r.URL.RequestURI())),
+			))
+		defer span.End()
+
+		sw := httputil.NewStatusWriter(w)
+		h(sw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.status_code", sw.Code))
+		if sw.Code >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(sw.Code))
+		}
+	}
+}
+
+// Detach returns context with values of ctx, e.g. span, which is not
+// cancelled with ctx, e.g. for async task outliving request.
+func Detach(ctx context.Context) context.Context {
+	return detached{parent: ctx}
+}
+
+// detached is context with values of parent and without its deadline
+// and cancellation.
+type detached struct {
+	parent context.Context
+}
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
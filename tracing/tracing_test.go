@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestHandler(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	if _, err := Setup(context.Background(), "", "test"); err != nil {
+		t.Fatal(err)
+	}
+
+	var detached context.Context
+	h := Handler("sync", func(w http.ResponseWriter, r *http.Request) {
+		detached = Detach(r.Context())
+		_, span := Tracer().Start(detached, "queue.push")
+		span.End()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+
+	r, _ := http.NewRequest("GET", "/sync/?symbol=amzn", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx, cancel := context.WithCancel(context.Background())
+	h(httptest.NewRecorder(), r.WithContext(ctx))
+	cancel()
+
+	if detached.Err() != nil {
+		t.Errorf("detached context is cancelled with request")
+	}
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	push, server := spans[0], spans[1]
+	if server.Name != "sync" || server.SpanKind != trace.SpanKindServer {
+		t.Errorf("wrong server span: %s %s", server.Name, server.SpanKind)
+	}
+	if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("trace of traceparent is not continued: %s", server.SpanContext.TraceID())
+	}
+	if server.Parent.SpanID().String() != "00f067aa0ba902b7" {
+		t.Errorf("wrong parent of server span: %s", server.Parent.SpanID())
+	}
+	if push.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Errorf("span in detached context is not child of server span")
+	}
+	if server.Status.Description != http.StatusText(http.StatusServiceUnavailable) {
+		t.Errorf("wrong status of server span: %+v", server.Status)
+	}
+}
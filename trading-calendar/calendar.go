@@ -0,0 +1,259 @@
+package calendar
+
+import (
+	"time"
+)
+
+// Session is a part of a trading day.
+type Session uint8
+
+const (
+	Closed Session = iota
+	PreMarket
+	Regular
+	PostMarket
+)
+
+func (s Session) String() string {
+	switch s {
+	case Closed:
+		return "Closed"
+	case PreMarket:
+		return "PreMarket"
+	case Regular:
+		return "Regular"
+	case PostMarket:
+		return "PostMarket"
+	}
+	return "Unknown"
+}
+
+// Hours are the sessions of a trading day: pre-market from PreOpen
+// till Open, regular from Open till Close, post-market from Close
+// till PostClose.
+type Hours struct {
+	PreOpen   time.Time
+	Open      time.Time
+	Close     time.Time
+	PostClose time.Time
+}
+
+// Calendar is the NYSE/NASDAQ trading calendar. Days are taken by
+// their date fields as is, instants (SessionAt, IsOpen, LastClose,
+// NextOpen) are converted to US/Eastern first.
+type Calendar struct {
+	// special closures, e.g. national days of mourning
+	closures map[date]string
+}
+
+// New returns NYSE/NASDAQ trading calendar.
+func New() *Calendar {
+	return &Calendar{
+		closures: map[date]string{
+			{2001, time.September, 11}: "September 11",
+			{2001, time.September, 12}: "September 11",
+			{2001, time.September, 13}: "September 11",
+			{2001, time.September, 14}: "September 11",
+			{2004, time.June, 11}:      "Reagan Day of Mourning",
+			{2007, time.January, 2}:    "Ford Day of Mourning",
+			{2012, time.October, 29}:   "Hurricane Sandy",
+			{2012, time.October, 30}:   "Hurricane Sandy",
+			{2018, time.December, 5}:   "Bush Day of Mourning",
+			{2025, time.January, 9}:    "Carter Day of Mourning",
+		},
+	}
+}
+
+type date struct {
+	year  int
+	month time.Month
+	day   int
+}
+
+func dateOf(t time.Time) date {
+	y, m, d := t.Date()
+	return date{y, m, d}
+}
+
+func (d date) weekday() time.Weekday {
+	return time.Date(d.year, d.month, d.day, 0, 0, 0, 0, time.UTC).Weekday()
+}
+
+func (d date) add(days int) date {
+	return dateOf(time.Date(d.year, d.month, d.day+days, 0, 0, 0, 0, time.UTC))
+}
+
+// nthWeekday returns n-th weekday of month, last one if n is -1
+func nthWeekday(year int, month time.Month, weekday time.Weekday, n int) date {
+	if n < 0 {
+		last := time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC)
+		return dateOf(last.AddDate(0, 0, -(int(last.Weekday()-weekday+7) % 7)))
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return dateOf(first.AddDate(0, 0, int(weekday-first.Weekday()+7)%7+7*(n-1)))
+}
+
+// observed moves holiday on weekend to the nearest weekday
+func observed(d date) date {
+	switch d.weekday() {
+	case time.Saturday:
+		return d.add(-1)
+	case time.Sunday:
+		return d.add(1)
+	}
+	return d
+}
+
+// easter returns Easter Sunday of year, by anonymous Gregorian algorithm
+func easter(year int) date {
+	a := year % 19
+	b, c := year/100, year%100
+	d, e := b/4, b%4
+	f := (b + 8) / 25
+	g := (b - f + 1) / 3
+	h := (19*a + b - d - g + 15) % 30
+	i, k := c/4, c%4
+	l := (32 + 2*e + 2*i - h - k) % 7
+	m := (a + 11*h + 22*l) / 451
+	month := (h + l - 7*m + 114) / 31
+	day := (h+l-7*m+114)%31 + 1
+	return date{year, time.Month(month), day}
+}
+
+// holidays returns full day holidays of year by date
+func (c *Calendar) holidays(year int) map[date]string {
+	h := map[date]string{
+		nthWeekday(year, time.January, time.Monday, 3):    "Martin Luther King Jr. Day",
+		nthWeekday(year, time.February, time.Monday, 3):   "Washington's Birthday",
+		easter(year).add(-2):                              "Good Friday",
+		nthWeekday(year, time.May, time.Monday, -1):       "Memorial Day",
+		observed(date{year, time.July, 4}):                "Independence Day",
+		nthWeekday(year, time.September, time.Monday, 1):  "Labor Day",
+		nthWeekday(year, time.November, time.Thursday, 4): "Thanksgiving Day",
+		observed(date{year, time.December, 25}):           "Christmas Day",
+	}
+	// NYSE does not close on Friday, December 31, if New Year's Day
+	// is on Saturday
+	if newYear := (date{year, time.January, 1}); newYear.weekday() != time.Saturday {
+		h[observed(newYear)] = "New Year's Day"
+	}
+	if year >= 2022 {
+		h[observed(date{year, time.June, 19})] = "Juneteenth"
+	}
+	for d, name := range c.closures {
+		if d.year == year {
+			h[d] = name
+		}
+	}
+	return h
+}
+
+// Holiday returns name of holiday on day, if market is closed on it.
+func (c *Calendar) Holiday(day time.Time) (string, bool) {
+	name, ok := c.holidays(day.Year())[dateOf(day)]
+	return name, ok
+}
+
+// IsTradingDay returns true if market is open on day.
+func (c *Calendar) IsTradingDay(day time.Time) bool {
+	if day.Weekday() == time.Saturday || day.Weekday() == time.Sunday {
+		return false
+	}
+	_, ok := c.Holiday(day)
+	return !ok
+}
+
+// IsEarlyClose returns true if market closes at 13:00 on day: the day
+// before Independence Day, the day after Thanksgiving and Christmas Eve.
+func (c *Calendar) IsEarlyClose(day time.Time) bool {
+	if !c.IsTradingDay(day) {
+		return false
+	}
+	d := dateOf(day)
+	switch {
+	case d.month == time.July && d.day == 3:
+		return d.weekday() != time.Friday
+	case d.month == time.December && d.day == 24:
+		return d.weekday() != time.Friday
+	case d == nthWeekday(d.year, time.November, time.Thursday, 4).add(1):
+		return true
+	}
+	return false
+}
+
+// Hours returns trading hours of day in US/Eastern,
+// ok is false if market is closed on day.
+func (c *Calendar) Hours(day time.Time) (Hours, bool) {
+	if !c.IsTradingDay(day) {
+		return Hours{}, false
+	}
+	y, m, d := day.Date()
+	h := Hours{
+		PreOpen:   Date(y, m, d, 4, 0),
+		Open:      Date(y, m, d, 9, 30),
+		Close:     Date(y, m, d, 16, 0),
+		PostClose: Date(y, m, d, 20, 0),
+	}
+	if c.IsEarlyClose(day) {
+		h.Close = Date(y, m, d, 13, 0)
+		h.PostClose = Date(y, m, d, 17, 0)
+	}
+	return h, true
+}
+
+// Session returns open and close of regular session on day as wall
+// clock in day's location, the way Alpha Vantage timestamps are parsed.
+// ok is false if market is closed on day.
+func (c *Calendar) Session(day time.Time) (time.Time, time.Time, bool) {
+	h, ok := c.Hours(day)
+	if !ok {
+		return time.Time{}, time.Time{}, false
+	}
+	wall := func(t time.Time) time.Time {
+		y, m, d := day.Date()
+		return time.Date(y, m, d, t.Hour(), t.Minute(), 0, 0, day.Location())
+	}
+	return wall(h.Open), wall(h.Close), true
+}
+
+// SessionAt returns session of market at instant t.
+func (c *Calendar) SessionAt(t time.Time) Session {
+	t = In(t)
+	h, ok := c.Hours(t)
+	switch {
+	case !ok, t.Before(h.PreOpen), !t.Before(h.PostClose):
+		return Closed
+	case t.Before(h.Open):
+		return PreMarket
+	case t.Before(h.Close):
+		return Regular
+	}
+	return PostMarket
+}
+
+// IsOpen returns true if regular session is on at instant t.
+func (c *Calendar) IsOpen(t time.Time) bool {
+	return c.SessionAt(t) == Regular
+}
+
+// LastClose returns close of the last regular session ended before
+// or at instant t.
+func (c *Calendar) LastClose(t time.Time) time.Time {
+	t = In(t)
+	for day := t; ; day = day.AddDate(0, 0, -1) {
+		if h, ok := c.Hours(day); ok && !h.Close.After(t) {
+			return h.Close
+		}
+	}
+}
+
+// NextOpen returns open of the first regular session started after
+// instant t.
+func (c *Calendar) NextOpen(t time.Time) time.Time {
+	t = In(t)
+	for day := t; ; day = day.AddDate(0, 0, 1) {
+		if h, ok := c.Hours(day); ok && h.Open.After(t) {
+			return h.Open
+		}
+	}
+}
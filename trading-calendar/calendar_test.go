@@ -0,0 +1,143 @@
+package calendar
+
+import (
+	"testing"
+	"time"
+)
+
+func day(s string) time.Time {
+	d, _ := time.Parse("2006-01-02", s)
+	return d
+}
+
+func TestHolidays(t *testing.T) {
+	c := New()
+
+	cases := []struct {
+		day     string
+		holiday string
+	}{
+		{day: "2019-01-01", holiday: "New Year's Day"},
+		{day: "2019-01-21", holiday: "Martin Luther King Jr. Day"},
+		{day: "2019-04-19", holiday: "Good Friday"},
+		{day: "2019-05-27", holiday: "Memorial Day"},
+		{day: "2019-07-04", holiday: "Independence Day"},
+		{day: "2019-11-28", holiday: "Thanksgiving Day"},
+		{day: "2020-07-03", holiday: "Independence Day"},
+		{day: "2021-12-24", holiday: "Christmas Day"},
+		{day: "2022-06-20", holiday: "Juneteenth"},
+		{day: "2023-01-02", holiday: "New Year's Day"},
+		{day: "2024-03-29", holiday: "Good Friday"},
+		{day: "2025-01-09", holiday: "Carter Day of Mourning"},
+		{day: "2026-07-03", holiday: "Independence Day"},
+		// no holidays
+		{day: "2019-08-05"},
+		{day: "2021-06-18"},
+		{day: "2021-12-31"},
+		{day: "2022-12-30"},
+	}
+	for caseNum, cs := range cases {
+		name, ok := c.Holiday(day(cs.day))
+		if name != cs.holiday || ok != (cs.holiday != "") {
+			t.Errorf("[%d] %s: got %q, expected %q", caseNum, cs.day, name, cs.holiday)
+		}
+	}
+
+	if c.IsTradingDay(day("2019-08-03")) {
+		t.Errorf("Saturday must not be trading day")
+	}
+	if !c.IsTradingDay(day("2019-08-05")) {
+		t.Errorf("2019-08-05 must be trading day")
+	}
+}
+
+func TestEarlyClose(t *testing.T) {
+	c := New()
+	for _, d := range []string{"2019-07-03", "2019-11-29", "2019-12-24", "2023-07-03", "2024-12-24"} {
+		if !c.IsEarlyClose(day(d)) {
+			t.Errorf("%s must be early close", d)
+		}
+	}
+	for _, d := range []string{"2019-08-05", "2020-07-03", "2021-12-24", "2022-07-01", "2020-12-23"} {
+		if c.IsEarlyClose(day(d)) {
+			t.Errorf("%s must not be early close", d)
+		}
+	}
+
+	h, ok := c.Hours(day("2019-11-29"))
+	if !ok || h.Close.Hour() != 13 || h.PostClose.Hour() != 17 {
+		t.Errorf("wrong early close hours: %+v", h)
+	}
+}
+
+func TestSessionAt(t *testing.T) {
+	c := New()
+
+	cases := []struct {
+		utc     string
+		session Session
+	}{
+		// summer, EDT is UTC-4
+		{utc: "2019-08-05 07:59", session: Closed},
+		{utc: "2019-08-05 08:00", session: PreMarket},
+		{utc: "2019-08-05 13:30", session: Regular},
+		{utc: "2019-08-05 19:59", session: Regular},
+		{utc: "2019-08-05 20:00", session: PostMarket},
+		{utc: "2019-08-06 00:00", session: Closed},
+		// winter, EST is UTC-5
+		{utc: "2019-12-02 14:29", session: PreMarket},
+		{utc: "2019-12-02 14:30", session: Regular},
+		{utc: "2019-12-02 21:00", session: PostMarket},
+		// early close
+		{utc: "2019-12-24 18:00", session: PostMarket},
+		// weekend and holiday
+		{utc: "2019-08-03 15:00", session: Closed},
+		{utc: "2019-12-25 15:00", session: Closed},
+	}
+	for caseNum, cs := range cases {
+		tm, _ := time.Parse("2006-01-02 15:04", cs.utc)
+		if s := c.SessionAt(tm); s != cs.session {
+			t.Errorf("[%d] %s: got %s, expected %s", caseNum, cs.utc, s, cs.session)
+		}
+	}
+
+	// Friday close and Monday open around weekend
+	sat, _ := time.Parse("2006-01-02 15:04", "2019-08-03 15:00")
+	if close := c.LastClose(sat); !close.Equal(Date(2019, time.August, 2, 16, 0)) {
+		t.Errorf("wrong LastClose: %s", close)
+	}
+	if open := c.NextOpen(sat); !open.Equal(Date(2019, time.August, 5, 9, 30)) {
+		t.Errorf("wrong NextOpen: %s", open)
+	}
+}
+
+func TestEasternZone(t *testing.T) {
+	if eastern == nil {
+		t.Skip("tz database is not available")
+	}
+	// DST rules must match tz database
+	start := time.Date(2007, time.January, 1, 0, 0, 0, 0, time.UTC)
+	for tm := start; tm.Year() < 2030; tm = tm.Add(time.Hour) {
+		_, expected := tm.In(eastern).Zone()
+		_, got := tm.In(easternZone(tm)).Zone()
+		if got != expected {
+			t.Fatalf("%s: got offset %d, expected %d", tm, got, expected)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tm, err := ParseTime("2019-08-05 16:00:00", "US/Eastern")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tm.Equal(time.Date(2019, time.August, 5, 20, 0, 0, 0, time.UTC)) {
+		t.Errorf("wrong time: %s", tm.UTC())
+	}
+	if w := WallClock(tm); w != time.Date(2019, time.August, 5, 16, 0, 0, 0, time.UTC) {
+		t.Errorf("wrong wall clock: %s", w)
+	}
+	if _, err := ParseTime("05.08.2019", "US/Eastern"); err == nil {
+		t.Errorf("expected error")
+	}
+}
@@ -0,0 +1,90 @@
+package calendar
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// eastern is US/Eastern location, nil if tz database is not available
+// (e.g. in alpine image without tzdata), then DST rules are applied
+// by easternZone.
+var eastern, _ = time.LoadLocation("America/New_York")
+
+var (
+	est = time.FixedZone("EST", -5*3600)
+	edt = time.FixedZone("EDT", -4*3600)
+)
+
+// easternZone returns US/Eastern zone at instant t by US DST rules
+// since 2007: daylight time from 2:00 of the second Sunday of March
+// till 2:00 of the first Sunday of November.
+func easternZone(t time.Time) *time.Location {
+	year := t.UTC().Year()
+	start := nthWeekday(year, time.March, time.Sunday, 2)
+	end := nthWeekday(year, time.November, time.Sunday, 1)
+	// 2:00 EST and 2:00 EDT in UTC
+	dstStart := time.Date(start.year, start.month, start.day, 7, 0, 0, 0, time.UTC)
+	dstEnd := time.Date(end.year, end.month, end.day, 6, 0, 0, 0, time.UTC)
+	if !t.Before(dstStart) && t.Before(dstEnd) {
+		return edt
+	}
+	return est
+}
+
+// In returns t in US/Eastern.
+func In(t time.Time) time.Time {
+	if eastern != nil {
+		return t.In(eastern)
+	}
+	return t.In(easternZone(t))
+}
+
+// Date returns the instant of wall clock hour:min of the date in
+// US/Eastern.
+func Date(year int, month time.Month, day, hour, min int) time.Time {
+	if eastern != nil {
+		return time.Date(year, month, day, hour, min, 0, 0, eastern)
+	}
+	// guess zone by the same wall clock in EST, transitions at 2:00
+	// do not matter for trading hours
+	t := time.Date(year, month, day, hour, min, 0, 0, est)
+	return time.Date(year, month, day, hour, min, 0, 0, easternZone(t))
+}
+
+// WallClock returns wall clock of instant t in US/Eastern as time in UTC
+// location, the way Alpha Vantage timestamps are parsed without zone.
+func WallClock(t time.Time) time.Time {
+	t = In(t)
+	y, m, d := t.Date()
+	return time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+// ParseTime parses timestamp of Alpha Vantage metadata, e.g.
+// "2019-08-05 16:00:00" or "2019-08-05", in time zone tz,
+// e.g. "US/Eastern" of "5. Time Zone".
+func ParseTime(value, tz string) (time.Time, error) {
+	var wall time.Time
+	var err error
+	for _, format := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		wall, err = time.Parse(format, value)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return time.Time{}, errors.Errorf("applicable date format not found for date %s", value)
+	}
+
+	y, m, d := wall.Date()
+	switch tz {
+	case "US/Eastern", "America/New_York", "":
+		t := Date(y, m, d, wall.Hour(), wall.Minute())
+		return t.Add(time.Duration(wall.Second()) * time.Second), nil
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		return time.Time{}, errors.Wrapf(err, "unknown time zone %s", tz)
+	}
+	return time.Date(y, m, d, wall.Hour(), wall.Minute(), wall.Second(), 0, loc), nil
+}